@@ -878,7 +878,9 @@ func newEchoServerPodSpec(podName string, hostNetwork bool) *v1.Pod {
 
 // LaunchEchoserverPodOnNode launches a pod serving http on port 8091 to act
 // as the target for source IP preservation test. The client's source ip would
-// be echoed back by the web server.
+// be echoed back by the web server.  On a dual-stack target the echoed
+// client_address is of whichever family carried the connection, so callers
+// asserting on it should compare against the client's address of that family.
 func (j *ServiceTestJig) LaunchEchoserverPodOnNode(f *Framework, nodeName, podName string, hostNetwork bool) *v1.Pod {
 	Logf("Creating echo server pod %q in namespace %q", podName, f.Namespace.Name)
 	pod := newEchoServerPodSpec(podName, hostNetwork)
@@ -19,6 +19,7 @@ package network
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -262,6 +263,43 @@ var _ = SIGDescribe("[Feature:CalicoPolicy-ALP] calico application layer policy"
 			testIstioCanGetPut(f, f.Namespace, http.MethodPut, service, podServer, nil)
 		})
 
+		It("should enforce http method rules over HTTP/2 and HTTP/3", func() {
+			By("creating policy which allow GET")
+			gnp := `
+- apiVersion: projectcalico.org/v3
+  kind: GlobalNetworkPolicy
+  metadata:
+    name: http-method
+  spec:
+    selector: pod-name == "server"
+    ingress:
+      - action: Allow
+        http:
+          methods: ["GET"]
+    egress:
+      - action: Allow
+`
+			calicoctl.Apply(gnp)
+			defer calicoctl.DeleteGNP("http-method")
+
+			// Some L7 enforcement paths differ per protocol version, so probe
+			// with each version the client's curl supports.
+			httpVerFlags := []string{"--http2"}
+			if curlSupportsHTTP3(f) {
+				httpVerFlags = append(httpVerFlags, "--http3")
+			} else {
+				framework.Logf("Client image's curl lacks HTTP3 support, skipping the HTTP/3 probes.")
+			}
+
+			for _, httpVerFlag := range httpVerFlags {
+				By(fmt.Sprintf("testing http method rule enforcement when probing with %s, allow Get", httpVerFlag))
+				testIstioCanGetPutX(f, f.Namespace, http.MethodGet, service, podServer, nil, httpVerFlag)
+
+				By(fmt.Sprintf("testing http method rule enforcement when probing with %s, deny Put", httpVerFlag))
+				testIstioCannotGetPutX(f, f.Namespace, http.MethodPut, service, podServer, nil, httpVerFlag)
+			}
+		})
+
 		It("should enforce policy with both http method and service account rule", func() {
 			By("creating \"sa-first\" and \"sa-second\" service account")
 			saFirst := alp.CreateServiceAccount(f, "sa-first", f.Namespace.Name, map[string]string{"sa-first": "true"})
@@ -896,6 +934,188 @@ var _ = SIGDescribe("[Feature:CalicoPolicy-ALP] calico application layer policy
 			testIstioCanGetPut(f, f.Namespace, http.MethodPut, service, podServer, connect)
 
 		})
+
+		It("should enforce http path rules with exact and prefix matches", func() {
+			By("creating policy allowing GETs only for an exact path with query string and one prefix")
+			gnp := `
+- apiVersion: projectcalico.org/v3
+  kind: GlobalNetworkPolicy
+  metadata:
+    name: http-paths
+  spec:
+    selector: pod-name == "server"
+    ingress:
+      - action: Allow
+        http:
+          methods: ["GET"]
+          paths:
+          - exact: "/v2/keys?recursive=true"
+          - prefix: "/v2/keys/prefixed"
+    egress:
+      - action: Allow
+`
+			calicoctl.Apply(gnp)
+			defer calicoctl.DeleteGNP("http-paths")
+
+			By("allowing a GET for the exact path including its query string")
+			status, err := testIstioHTTPStatusForPath(f, service, "/v2/keys?recursive=true")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(http.StatusOK))
+
+			By("allowing a GET under the configured prefix")
+			// 404 proves the request got through to etcd (the key does not
+			// exist) rather than being answered by the sidecar.
+			status, err = testIstioHTTPStatusForPath(f, service, "/v2/keys/prefixed/missing")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(http.StatusNotFound))
+
+			By("denying a GET for a path matching neither rule")
+			status, err = testIstioHTTPStatusForPath(f, service, "/v2/other")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(Equal(http.StatusForbidden))
+		})
+
+		It("should key http rule enforcement off the service's declared app protocol", func() {
+			By("creating policy which allow GET")
+			gnp := `
+- apiVersion: projectcalico.org/v3
+  kind: GlobalNetworkPolicy
+  metadata:
+    name: http-appproto
+  spec:
+    selector: pod-name == "server"
+    ingress:
+      - action: Allow
+        http:
+          methods: ["GET"]
+    egress:
+      - action: Allow
+`
+			calicoctl.Apply(gnp)
+			defer calicoctl.DeleteGNP("http-appproto")
+
+			By("verifying the method rule is enforced while the port declares http")
+			testIstioCanGetPut(f, f.Namespace, http.MethodGet, service, podServer, nil)
+			testIstioCannotGetPut(f, f.Namespace, http.MethodPut, service, podServer, nil)
+
+			By("redeclaring the service port as opaque tcp")
+			service = alp.SetServicePortAppProtocol(f, service, "tcp")
+
+			By("verifying the traffic is no longer parsed, so the method rule cannot apply")
+			// Over an opaque tcp port the sidecar stops parsing HTTP, and in
+			// line with the suite's treatment of rules that cannot apply to
+			// the traffic, PUTs pass through again.
+			testIstioCanGetPut(f, f.Namespace, http.MethodPut, service, podServer, nil)
+
+			By("redeclaring the port as http and verifying enforcement returns")
+			service = alp.SetServicePortAppProtocol(f, service, "http")
+			testIstioCanGetPut(f, f.Namespace, http.MethodGet, service, podServer, nil)
+			testIstioCannotGetPut(f, f.Namespace, http.MethodPut, service, podServer, nil)
+		})
+	})
+
+	Describe("istio injection namespace toggling", func() {
+
+		// launchProbePod creates a throwaway pod and returns it for sidecar
+		// inspection; the caller owns cleanup.
+		launchProbePod := func(base string) *v1.Pod {
+			podName := framework.CreateExecPodOrFail(f.ClientSet, f.Namespace.Name, base, nil)
+			pod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Get(podName, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			return pod
+		}
+
+		It("should stop injecting sidecars when the namespace label is removed and resume when re-added", func() {
+			// The suite BeforeEach has already enabled injection for the test
+			// namespace, so start by turning it off.
+			By("Disabling istio injection for the namespace.")
+			alp.DisableIstioInjectionForNamespace(f, f.Namespace)
+
+			By("Launching a pod and verifying it gets no sidecars.")
+			bareProbe := launchProbePod("no-sidecar-probe-")
+			defer framework.DeletePodOrFail(f.ClientSet, f.Namespace.Name, bareProbe.Name)
+			Expect(alp.VerifySideCarsForPod(bareProbe)).To(BeFalse(),
+				"a pod created with injection disabled should have no sidecars")
+
+			By("Re-enabling istio injection for the namespace.")
+			alp.EnableIstioInjectionForNamespace(f, f.Namespace)
+
+			By("Launching another pod and verifying sidecars are injected again.")
+			injectedProbe := launchProbePod("sidecar-probe-")
+			defer framework.DeletePodOrFail(f.ClientSet, f.Namespace.Name, injectedProbe.Name)
+			Expect(alp.VerifySideCarsForPod(injectedProbe)).To(BeTrue(),
+				"a pod created with injection re-enabled should have sidecars")
+		})
+	})
+
+	Describe("ALP raw TCP passthrough", func() {
+		var podServer *v1.Pod
+		var service *v1.Service
+		const redisPort = 6379
+
+		BeforeEach(func() {
+			By("Creating a redis server, a raw TCP service that speaks no HTTP.")
+			podServer, service = createIstioRawTCPPodAndService(f, f.Namespace, "redis-server", redisPort, nil)
+			framework.Logf("Waiting for the redis server to come up.")
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			cleanupServerPodAndService(f, podServer, service)
+			calicoctl.Cleanup()
+		})
+
+		It("should pass raw TCP through the sidecar with no policy", func() {
+			testIstioRawTCP(f, f.Namespace, "redis-default-client", service, redisPort, podServer, nil, true)
+		})
+
+		Context("with an L4 service-account rule and no http rules", func() {
+
+			BeforeEach(func() {
+				// Only serviceAccounts and L4 matches here: Dikastes must
+				// enforce this without any HTTP parsing, or the sidecar
+				// would break the raw TCP stream.
+				gnp := fmt.Sprintf(`
+- apiVersion: projectcalico.org/v3
+  kind: GlobalNetworkPolicy
+  metadata:
+    name: redis-sa-allow
+  spec:
+    selector: pod-name == "redis-server"
+    ingress:
+      - action: Allow
+        protocol: TCP
+        source:
+          serviceAccounts:
+            names: ["redis-can-connect"]
+        destination:
+          ports: [%d]
+    egress:
+      - action: Allow
+`,
+					redisPort)
+				calicoctl.Apply(gnp)
+			})
+
+			AfterEach(func() {
+				calicoctl.DeleteGNP("redis-sa-allow")
+			})
+
+			It("should allow the \"redis-can-connect\" service account to speak redis", func() {
+				By("creating \"redis-can-connect\" service account")
+				sa := alp.CreateServiceAccount(f, "redis-can-connect", f.Namespace.Name, nil)
+				defer alp.DeleteServiceAccount(f, sa)
+
+				By("testing redis connectivity with pod using \"redis-can-connect\" service account")
+				testIstioRawTCP(f, f.Namespace, "redis-client-allowed", service, redisPort, podServer, sa, true)
+			})
+
+			It("should not allow the default service account to speak redis", func() {
+				By("testing redis connectivity with pod using the default service account")
+				testIstioRawTCP(f, f.Namespace, "redis-client-denied", service, redisPort, podServer, nil, false)
+			})
+		})
 	})
 })
 
@@ -982,6 +1202,116 @@ func createGetPutPodAndService(f *framework.Framework, namespace *v1.Namespace,
 	return pod, service
 }
 
+// createIstioRawTCPPodAndService launches a redis server behind a service
+// whose port is named tcp-<port>, so Istio treats the traffic as opaque TCP
+// rather than trying to parse it as HTTP.
+func createIstioRawTCPPodAndService(f *framework.Framework, namespace *v1.Namespace, podName string, port int, labels map[string]string) (*v1.Pod, *v1.Service) {
+	pod, service := createServerPodAndServiceX(f, namespace, podName, []int{port},
+		func(pod *v1.Pod) {
+			// Apply labels.
+			for k, v := range labels {
+				pod.Labels[k] = v
+			}
+
+			oldContainers := pod.Spec.Containers
+			pod.Spec.Containers = []v1.Container{}
+			for _, container := range oldContainers {
+				// Strip out readiness probe because Istio doesn't support HTTP health probes when in mTLS mode.
+				container.ReadinessProbe = nil
+				container.Image = "redis:4.0-alpine"
+				container.Env = nil
+				pod.Spec.Containers = append(pod.Spec.Containers, container)
+			}
+		},
+		func(svc *v1.Service) {
+			oldPorts := svc.Spec.Ports
+			svc.Spec.Ports = []v1.ServicePort{}
+			for _, port := range oldPorts {
+				// The tcp- name prefix tells Istio this is not HTTP.
+				port.Name = fmt.Sprintf("tcp-%d", port.Port)
+				svc.Spec.Ports = append(svc.Spec.Ports, port)
+			}
+		},
+	)
+
+	alp.VerifyContainersForPod(pod)
+
+	return pod, service
+}
+
+// testIstioRawTCP probes the redis service with a protocol-level PING over
+// plain TCP and asserts on whether a PONG comes back.  There is deliberately
+// no HTTP anywhere in this path, so it exercises the sidecar's raw TCP
+// handling rather than its HTTP filters.
+func testIstioRawTCP(f *framework.Framework, ns *v1.Namespace, podNameBase string, service *v1.Service, targetPort int, targetPod *v1.Pod, account *v1.ServiceAccount, canConnect bool) {
+	expectation := "should"
+	retries := alp.CanNumberOfRetries
+	if !canConnect {
+		expectation = "should not"
+		retries = alp.CannotNumberOfRetries
+	}
+	By(fmt.Sprintf("Creating client pod %s that %s be able to speak redis to %s.", podNameBase, expectation, service.Name))
+
+	// Make sure we do not have pod with same name which is still terminating from previous call to this function.
+	err := alp.WaitForPodNotFoundInNamespace(f, ns, podNameBase)
+	if err != nil {
+		framework.Failf("pod %q was not deleted: %v", podNameBase, err)
+	}
+
+	podName := calico.GenerateRandomName(podNameBase)
+	cmd := fmt.Sprintf(
+		"for i in $(seq 1 %d); do printf 'PING\\r\\n' | nc -w 3 %s.%s %d | grep PONG && exit 0 || sleep 1; done; exit 1",
+		retries, service.Name, service.Namespace, targetPort)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: podName,
+			Labels: map[string]string{
+				"pod-name": podNameBase,
+			},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			NodeSelector:  map[string]string{"beta.kubernetes.io/os": "linux"},
+			Containers: []v1.Container{
+				{
+					Name:  fmt.Sprintf("%s-container", podName),
+					Image: "busybox",
+					Args:  []string{"/bin/sh", "-c", cmd},
+				},
+			},
+		},
+	}
+	if account != nil {
+		pod.Spec.ServiceAccountName = account.Name
+	}
+	podClient, err := f.ClientSet.CoreV1().Pods(ns.Name).Create(pod)
+	Expect(err).NotTo(HaveOccurred())
+	containerName := podClient.Spec.Containers[0].Name
+	defer func() {
+		By(fmt.Sprintf("Cleaning up the pod %s", podName))
+		if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(podClient.Name, nil); err != nil {
+			framework.Failf("unable to cleanup pod %v: %v", podClient.Name, err)
+		}
+	}()
+
+	alp.VerifyContainersForPod(podClient)
+
+	// As with the HTTP probes, the injected sidecars never exit, so wait for
+	// the probe container alone rather than the whole pod.
+	framework.Logf("Waiting for %s to complete.", podClient.Name)
+	err = alp.WaitForContainerSuccess(f.ClientSet, podClient, containerName)
+	if canConnect && err != nil {
+		diags := alp.GetProbeAndTargetDiags(f, podClient, targetPod, containerName)
+		framework.Failf("Pod %s should be able to speak redis to service %s, but could not.%s",
+			podName, service.Name, diags)
+	}
+	if !canConnect && err == nil {
+		diags := alp.GetProbeAndTargetDiags(f, podClient, targetPod, containerName)
+		framework.Failf("Pod %s should not be able to speak redis to service %s, but could.%s",
+			podName, service.Name, diags)
+	}
+}
+
 // testIstioCanConnect works like testCanConnect(), but takes the target Pod for diagnostics, and an optional Service
 // Account for the probe pod.
 func testIstioCanConnect(f *framework.Framework, ns *v1.Namespace, podName string, service *v1.Service, targetPort int, targetPod *v1.Pod, account *v1.ServiceAccount) {
@@ -1105,6 +1435,24 @@ func testIstioCannotConnectX(f *framework.Framework, ns *v1.Namespace, podName s
 }
 
 func testIstioGetPutCmd(service *v1.Service, method string, n int) (string, string) {
+	return testIstioGetPutCmdX(service, method, n, "")
+}
+
+// curlSupportsHTTP3 reports whether curl in the probe image was built with
+// HTTP/3 support, by checking the feature list from "curl --version".
+func curlSupportsHTTP3(f *framework.Framework) bool {
+	output, err := calico.ExecuteCmdInPod(f, "curl --version")
+	if err != nil {
+		framework.Logf("Failed to check curl features: %v", err)
+		return false
+	}
+	return strings.Contains(output, "HTTP3")
+}
+
+// testIstioGetPutCmdX is testIstioGetPutCmd with an extra curl flag selecting
+// the HTTP protocol version to probe with (e.g. "--http2"); empty means curl's
+// default HTTP/1.1.
+func testIstioGetPutCmdX(service *v1.Service, method string, n int, httpVerFlag string) (string, string) {
 	var cmd string
 	var expect string
 	port := service.Spec.Ports[0].Port
@@ -1112,6 +1460,9 @@ func testIstioGetPutCmd(service *v1.Service, method string, n int) (string, stri
 	// Setup retry. Each retry max timeout 5 seconds. Total timeout 50 seconds.
 	retryArgs := fmt.Sprintf("--connect-timeout 3 --max-time 5 --retry %d --retry-delay 0 --retry-max-time 50 --retry-connrefused",
 		n)
+	if httpVerFlag != "" {
+		retryArgs = httpVerFlag + " " + retryArgs
+	}
 
 	switch method {
 	case http.MethodGet:
@@ -1130,8 +1481,50 @@ func testIstioGetPutCmd(service *v1.Service, method string, n int) (string, stri
 	return cmd, expect
 }
 
+// testIstioHTTPStatusForPath curls the given path on the service from a fresh
+// client pod and returns the final HTTP status code.  Unlike the get/put
+// helpers it does not interpret the response: path-rule tests need to tell a
+// sidecar 403 apart from a backend 404, so the caller asserts on the code.
+func testIstioHTTPStatusForPath(f *framework.Framework, service *v1.Service, path string) (int, error) {
+	port := service.Spec.Ports[0].Port
+	cmd := fmt.Sprintf("curl --connect-timeout 3 --max-time 5 --retry %d --retry-delay 0 --retry-max-time 50 --retry-connrefused "+
+		"-s -o /dev/null -w '%%{http_code}' 'http://%s:%d%s'",
+		alp.CanNumberOfRetries, service.Name, port, path)
+
+	clientPod, output, err := calico.ExecuteCmdInPodX(f, cmd, func(pod *v1.Pod) {
+		// Do not use same pod name for hostexec pod, see testIstioCanGetPutX.
+		pod.Name = fmt.Sprintf("%s%s", "pathprobe-", utilrand.String(5))
+		pod.Spec.HostNetwork = false
+		pod.Spec.RestartPolicy = v1.RestartPolicyNever
+	})
+	Expect(clientPod).NotTo(BeNil())
+
+	defer func() {
+		// Clean up the pod
+		f.PodClient().Delete(clientPod.Name, metav1.NewDeleteOptions(0))
+		err := framework.WaitForPodToDisappear(f.ClientSet, f.Namespace.Name, clientPod.Name, labelutils.Everything(), time.Second, wait.ForeverTestTimeout)
+		if err != nil {
+			framework.Failf("Failed to delete %s pod: %v", clientPod.Name, err)
+		}
+	}()
+
+	if err != nil {
+		return 0, fmt.Errorf("curl for %s failed: %v (output %q)", path, err, output)
+	}
+	status, convErr := strconv.Atoi(strings.TrimSpace(output))
+	if convErr != nil {
+		return 0, fmt.Errorf("could not parse status code from %q: %v", output, convErr)
+	}
+	framework.Logf("GET %s on service %s returned status %d", path, service.Name, status)
+	return status, nil
+}
+
 func testIstioCanGetPut(f *framework.Framework, ns *v1.Namespace, method string, service *v1.Service, targetPod *v1.Pod, account *v1.ServiceAccount) {
-	cmd, expect := testIstioGetPutCmd(service, method, alp.CanNumberOfRetries)
+	testIstioCanGetPutX(f, ns, method, service, targetPod, account, "")
+}
+
+func testIstioCanGetPutX(f *framework.Framework, ns *v1.Namespace, method string, service *v1.Service, targetPod *v1.Pod, account *v1.ServiceAccount, httpVerFlag string) {
+	cmd, expect := testIstioGetPutCmdX(service, method, alp.CanNumberOfRetries, httpVerFlag)
 
 	clientPod, output, err := calico.ExecuteCmdInPodX(f, cmd, func(pod *v1.Pod) {
 		// Do not use same pod name for hostexec pod.
@@ -1173,7 +1566,11 @@ func testIstioCanGetPut(f *framework.Framework, ns *v1.Namespace, method string,
 }
 
 func testIstioCannotGetPut(f *framework.Framework, ns *v1.Namespace, method string, service *v1.Service, targetPod *v1.Pod, account *v1.ServiceAccount) {
-	cmd, expect := testIstioGetPutCmd(service, method, alp.CannotNumberOfRetries)
+	testIstioCannotGetPutX(f, ns, method, service, targetPod, account, "")
+}
+
+func testIstioCannotGetPutX(f *framework.Framework, ns *v1.Namespace, method string, service *v1.Service, targetPod *v1.Pod, account *v1.ServiceAccount, httpVerFlag string) {
+	cmd, expect := testIstioGetPutCmdX(service, method, alp.CannotNumberOfRetries, httpVerFlag)
 
 	clientPod, output, err := calico.ExecuteCmdInPodX(f, cmd, func(pod *v1.Pod) {
 		pod.Name = fmt.Sprintf("%s%s", "getput-", utilrand.String(5))
@@ -0,0 +1,161 @@
+/*
+Copyright (c) 2018 Tigera, Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/utils/calico"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = SIGDescribe("CalicoAntiSpoofing", func() {
+
+	// Calico programs a reverse path filter for each workload, so packets a pod
+	// sends from an address other than its own are dropped unless the pod is
+	// annotated with cni.projectcalico.org/allowedSourcePrefixes covering the
+	// forged address.  We verify both halves of that contract here, using a
+	// client that binds an extra address on its eth0 and connects from it.
+
+	const (
+		spoofedIP     = "10.233.99.99"
+		spoofedPrefix = "10.233.99.0/24"
+	)
+
+	f := framework.NewDefaultFramework("anti-spoof")
+	var (
+		jig       *framework.ServiceTestJig
+		nodeName  string
+		serverPod *v1.Pod
+		target    string
+	)
+
+	BeforeEach(func() {
+		if os.Getenv("WINDOWS_OS") != "" {
+			framework.Skipf("Anti-spoofing test is not supported on Windows nodes.")
+		}
+		jig = framework.NewServiceTestJig(f.ClientSet, "anti-spoof")
+		nodes := jig.GetNodes(1)
+		if len(nodes.Items) == 0 {
+			framework.Skipf("No nodes exist, can't continue test.")
+		}
+		// Keep client and server on the same node, so the reply to the spoofed
+		// address only depends on the local routes that Calico programs for
+		// allowedSourcePrefixes.
+		nodeName = nodes.Items[0].Name
+
+		By("Creating an echo server pod to connect to.")
+		jig.LaunchEchoserverPodOnNode(f, nodeName, "spoof-server", false)
+		var err error
+		serverPod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Get("spoof-server", metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		target = fmt.Sprintf("%v:8080", serverPod.Status.PodIP)
+	})
+
+	// createSpoofClientPod starts a long-running busybox pod with the network
+	// capabilities needed to add an extra address to its interface.  If
+	// allowPrefix is non-empty the pod is annotated so that Calico accepts
+	// packets sourced from that prefix.
+	createSpoofClientPod := func(name, allowPrefix string) *v1.Pod {
+		privileged := true
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"pod-name": name,
+				},
+			},
+			Spec: v1.PodSpec{
+				NodeName: nodeName,
+				Containers: []v1.Container{
+					{
+						Name:  fmt.Sprintf("%s-container", name),
+						Image: "busybox",
+						Args:  []string{"/bin/sh", "-c", "sleep 3600"},
+						SecurityContext: &v1.SecurityContext{
+							Privileged: &privileged,
+						},
+					},
+				},
+			},
+		}
+		if allowPrefix != "" {
+			pod.ObjectMeta.Annotations = map[string]string{
+				"cni.projectcalico.org/allowedSourcePrefixes": fmt.Sprintf(`["%s"]`, allowPrefix),
+			}
+		}
+		pod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(pod)
+		Expect(err).NotTo(HaveOccurred())
+		err = framework.WaitForPodRunningInNamespace(f.ClientSet, pod)
+		Expect(err).NotTo(HaveOccurred())
+		return pod
+	}
+
+	// addSpoofedAddress binds the spoofed address on the pod's eth0, skipping
+	// the test if the image or pod security setup does not allow it.
+	addSpoofedAddress := func(pod *v1.Pod) {
+		cmd := fmt.Sprintf("ip addr add %s/32 dev eth0", spoofedIP)
+		if _, err := framework.RunHostCmd(f.Namespace.Name, pod.Name, cmd); err != nil {
+			framework.Skipf("Cannot manipulate addresses in the client pod (%v); skipping anti-spoofing test.", err)
+		}
+	}
+
+	// connectFrom attempts an HTTP exchange with the server, binding the given
+	// local address, and reports whether the connection succeeded.
+	connectFrom := func(pod *v1.Pod, localIP string) error {
+		cmd := fmt.Sprintf("echo -e 'GET / HTTP/1.0\\r\\n\\r\\n' | nc -w 5 -s %s %s %d",
+			localIP, serverPod.Status.PodIP, 8080)
+		stdout, err := framework.RunHostCmd(f.Namespace.Name, pod.Name, cmd)
+		framework.Logf("Connection from %v (source %v) to %v: output %q err %v",
+			pod.Name, localIP, target, stdout, err)
+		return err
+	}
+
+	It("should drop packets with a forged source IP [Feature:CalicoAntiSpoof]", func() {
+		By("Creating a client pod without an allowedSourcePrefixes annotation.")
+		clientPod := createSpoofClientPod(calico.GenerateRandomName("spoof-client"), "")
+		defer cleanupExecPodOrFail(f, clientPod)
+		addSpoofedAddress(clientPod)
+
+		By("Verifying the client can connect from its own address.")
+		err := connectFrom(clientPod, clientPod.Status.PodIP)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Verifying a connection from the forged source IP is dropped.")
+		err = connectFrom(clientPod, spoofedIP)
+		Expect(err).To(HaveOccurred(),
+			"connection with forged source %v should have been dropped", spoofedIP)
+	})
+
+	It("should allow forged source IPs covered by allowedSourcePrefixes [Feature:CalicoAntiSpoof]", func() {
+		By("Creating a client pod annotated to allow the spoofed prefix.")
+		clientPod := createSpoofClientPod(calico.GenerateRandomName("spoof-client-allowed"), spoofedPrefix)
+		defer cleanupExecPodOrFail(f, clientPod)
+		addSpoofedAddress(clientPod)
+
+		By("Verifying a connection from the allowed forged source IP passes.")
+		err := connectFrom(clientPod, spoofedIP)
+		Expect(err).NotTo(HaveOccurred(),
+			"connection from %v should be allowed by the allowedSourcePrefixes annotation", spoofedIP)
+	})
+})
@@ -80,6 +80,58 @@ var _ = SIGDescribe("CALICO-CNI", func() {
 		framework.Logf("Node for testing <%s>, with %d pods %d IPs", testNode, initialPodCount, initialIPCount)
 	})
 
+	Context("CNI with floating IPs", func() {
+		It("should NAT between the floating IP and the pod [Feature:CalicoFloatingIP]", func() {
+			const floatingPoolCIDR = "10.222.113.0/24"
+			const floatingIP = "10.222.113.55"
+			const port = 8091
+
+			ctl := calico.ConfigureCalicoctl(f)
+			defer ctl.Cleanup()
+
+			By("Creating a pool so the floating IP is routable within the cluster.")
+			ctl.ApplyIPPool("e2e-floating-pool", floatingPoolCIDR)
+			defer ctl.DeleteIPPool("e2e-floating-pool")
+
+			By("Creating an echo server with a floating IP and a plain echo server.")
+			targetNode := nodeNames[len(nodeNames)-1]
+			floatPod := createFloatingIPPodOnNode(f, testNode, calico.GenerateRandomName("floating-pod"), floatingIP)
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(floatPod.Namespace).Delete(floatPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", floatPod.Name, err)
+				}
+			}()
+			targetPod := createEchoserverPodOnNode(f, targetNode, calico.GenerateRandomName("floating-target"), false, true)
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(targetPod.Namespace).Delete(targetPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", targetPod.Name, err)
+				}
+			}()
+
+			By("Checking the workload endpoint carries the 1:1 NAT.")
+			nats, err := ctl.GetWorkloadEndpointIPNATs(f.Namespace.Name, floatPod.Name)
+			Expect(err).NotTo(HaveOccurred())
+			if len(nats) == 0 {
+				framework.Skipf("The CNI plugin did not apply the floatingIPs annotation; the feature is not enabled.")
+			}
+			Expect(nats).To(HaveKeyWithValue(floatPod.Status.PodIP, floatingIP))
+
+			By("Verifying the echo server sees the floating IP as the pod's source.")
+			outboundCmd := fmt.Sprintf("wget -T 5 %v:%d -O - | grep client_address", targetPod.Status.PodIP, port)
+			Eventually(func() (string, error) {
+				return framework.RunHostCmd(f.Namespace.Name, floatPod.Name, outboundCmd)
+			}, 2*time.Minute, 5*time.Second).Should(ContainSubstring("client_address=%s", floatingIP),
+				"traffic from the pod should be SNATed to its floating IP")
+
+			By("Verifying traffic to the floating IP reaches the pod.")
+			inboundCmd := fmt.Sprintf("wget -T 5 %v:%d -O - | grep client_address", floatingIP, port)
+			Eventually(func() (string, error) {
+				return framework.RunHostCmd(f.Namespace.Name, targetPod.Name, inboundCmd)
+			}, 2*time.Minute, 5*time.Second).Should(ContainSubstring("client_address="),
+				"traffic to the floating IP should be DNATed to the pod")
+		})
+	})
+
 	Context("CNI with Max IP per Node", func() {
 		var maxPods int
 		var maxTestPods int
@@ -246,3 +298,26 @@ func createEchoserverPodOnNode(f *framework.Framework, nodeName, podName string,
 	Expect(err).NotTo(HaveOccurred())
 	return pod
 }
+
+// createFloatingIPPodOnNode launches an echo server pod carrying the Calico
+// floatingIPs annotation, which requests a 1:1 NAT between the floating IP
+// and the pod's real IP.
+func createFloatingIPPodOnNode(f *framework.Framework, nodeName, podName, floatingIP string) *v1.Pod {
+	framework.Logf("Creating pod %q with floating IP %v in namespace %q", podName, floatingIP, f.Namespace.Name)
+	pod := newEchoServerPodSpec(podName, false)
+	pod.ObjectMeta.Annotations = map[string]string{
+		"cni.projectcalico.org/floatingIPs": fmt.Sprintf(`["%s"]`, floatingIP),
+	}
+	pod.Spec.NodeName = nodeName
+
+	podClient := f.ClientSet.Core().Pods(f.Namespace.Name)
+	_, err := podClient.Create(pod)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = f.WaitForPodRunning(podName)
+	Expect(err).NotTo(HaveOccurred())
+
+	pod, err = podClient.Get(podName, metav1.GetOptions{})
+	Expect(err).NotTo(HaveOccurred())
+	return pod
+}
@@ -15,6 +15,7 @@ package network
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -24,9 +25,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
 	utilversion "k8s.io/kubernetes/pkg/util/version"
 	"k8s.io/kubernetes/test/e2e/framework"
 	"k8s.io/kubernetes/test/utils/calico"
+	"k8s.io/kubernetes/test/utils/winctl"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -176,7 +179,7 @@ var _ = SIGDescribe("IPVSEgress", func() {
 					node = nodeNames[1]
 				}
 				svcPort := 8080
-				svcClusterIP, svcNodePort, dstPod := setupPodServiceOnNode(f, jig, node, svcPort, c.svcTweak, c.dstHostNetworked)
+				svcClusterIP, svcNodePort, dstPod := setupPodServiceOnNode(f, jig, nil, node, svcPort, c.svcTweak, c.dstHostNetworked)
 				// Figure out the correct target to pass to wget, depending on the destination and type of test.
 				// We may also flip the expectSNAT flag here if the scenario requires it.
 				if c.accessType == "cluster IP" {
@@ -355,6 +358,31 @@ var _ = SIGDescribe("IPVSEgress", func() {
 	Context("scenario-0L12: pod0 -> node1 NodePort local-only -> pod2",
 		describeEgressTest(egressTest{dstPod: 2, accessType: "node1 NodePort", svcTweak: setLocalOnly}))
 
+	// With externalTrafficPolicy=Local a NodePort only forwards to endpoints on
+	// the node actually addressed; a node with no local endpoint must drop the
+	// connection rather than bounce it to another node.  The table above always
+	// addresses a node that can serve the service, so cover the drop case here.
+	Context("scenario-0L02: pod0 -> NodePort local-only -> pod2, with and without a local endpoint", func() {
+		It("should drop on the node with no local endpoint and connect via the node with one", func() {
+			svcPort := 8080
+
+			By("Creating a local-only service backed by a single pod on node1.")
+			_, svcNodePort, _ := setupPodServiceOnNode(f, jig, nil, nodeNames[1], svcPort, setLocalOnly, false)
+
+			By("Creating a client pod on node0.")
+			serverPodLabels := jig.Labels
+			jig.Labels = map[string]string{"pod-name": "ipvs-egress-source"}
+			client := jig.LaunchEchoserverPodOnNode(f, nodeNames[0], "ipvs-egress-source", false)
+			jig.Labels = serverPodLabels
+
+			By("Checking the NodePort on node0, which has no local endpoint, drops the connection.")
+			testConnection(f, client, fmt.Sprintf("%v:%v", nodeIPs[0], svcNodePort), notReachable)
+
+			By("Checking the NodePort on node1, which hosts the endpoint, accepts the connection.")
+			testConnection(f, client, fmt.Sprintf("%v:%v", nodeIPs[1], svcNodePort), reachableWithSNAT)
+		})
+	})
+
 	// ===== Access via external IPs =====
 	// BUG: Calico currently fails to detect externalIP as a forwarding destination so egress policy not applied.
 
@@ -472,6 +500,8 @@ var _ = SIGDescribe("IPVSHostEndpoint", func() {
 		accessType string
 		// expect SNAT
 		expectSNAT bool
+		// Index of the node to attach the host endpoint to (defaults to node 0).
+		hepNode int
 	}
 
 	type hepPolicyConfig struct {
@@ -549,6 +579,47 @@ var _ = SIGDescribe("IPVSHostEndpoint", func() {
 			policyNames = []string{}
 		})
 
+		// applyHostEndpoint creates a host endpoint with the given name and "hep"
+		// label for the node identified by its Calico node name and IP.
+		applyHostEndpoint := func(name, hepLabel, calicoNodeName, nodeIP string) {
+			hostEpStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: HostEndpoint
+metadata:
+  name: %s
+  labels:
+    hep: %s
+spec:
+  node: %s
+  expectedIPs:
+  - %s
+`,
+				name, hepLabel, calicoNodeName, nodeIP)
+			calicoctl.Apply(hostEpStr)
+		}
+
+		// applyLabeledHostEndpoint is applyHostEndpoint for tests that need
+		// full control of the host endpoint's labels.
+		applyLabeledHostEndpoint := func(name, calicoNodeName, nodeIP string, hepLabels map[string]string) {
+			labelLines := ""
+			for k, v := range hepLabels {
+				labelLines += fmt.Sprintf("    %s: %q\n", k, v)
+			}
+			hostEpStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: HostEndpoint
+metadata:
+  name: %s
+  labels:
+%sspec:
+  node: %s
+  expectedIPs:
+  - %s
+`,
+				name, labelLines, calicoNodeName, nodeIP)
+			calicoctl.Apply(hostEpStr)
+		}
+
 		describeEgressTest := func(c hepTestConfig, policyConfigs []hepPolicyConfig) func() {
 			return func() {
 				var (
@@ -557,6 +628,7 @@ var _ = SIGDescribe("IPVSHostEndpoint", func() {
 					action       string
 					expectSNAT   bool
 					reachability string
+					hostEpName   string
 				)
 
 				expectAccessAllowed := func() {
@@ -578,6 +650,9 @@ var _ = SIGDescribe("IPVSHostEndpoint", func() {
 				if c.dstPod > 3 {
 					panic("dstpod id bigger than 3")
 				}
+				if c.hepNode > 1 {
+					panic("hepNode id bigger than 1")
+				}
 
 				getPolicyAction := func(p hepPolicyConfig, allowOrDeny string) string {
 					if p.actionType == "ingress" {
@@ -608,9 +683,17 @@ var _ = SIGDescribe("IPVSHostEndpoint", func() {
 				}
 
 				BeforeEach(func() {
+					// Scenarios may attach the host endpoint to a node other than node 0.
+					hepNodeName = nodeNames[c.hepNode]
+					hepCalicoNodeName = calicoNodeNames[c.hepNode]
+					hepNodeIP = nodeIPs[c.hepNode]
+					hostEpName = ""
+					// Keep calicoctl off the host endpoint node so its logs stay accessible.
+					calicoctl.SetNodeToRun(nodeNames[1-c.hepNode])
+
 					// Setup destination service and pod.
 					svcPort := 8080
-					svcClusterIP, svcNodePort, dstPod := setupPodServiceOnNode(f, jig, nodeNameMap[c.dstPod], svcPort, c.svcTweak, c.dstHostNetworked)
+					svcClusterIP, svcNodePort, dstPod := setupPodServiceOnNode(f, jig, calicoctl, nodeNameMap[c.dstPod], svcPort, c.svcTweak, c.dstHostNetworked)
 
 					// Setup source client.
 					src := &source{nodeNameMap[c.srcPod], "ipvs-hep-source", c.srcHostNetworked}
@@ -645,7 +728,9 @@ var _ = SIGDescribe("IPVSHostEndpoint", func() {
 					for _, name := range policyNames {
 						calicoctl.DeleteGNP(name)
 					}
-					calicoctl.DeleteHE("host-ep")
+					if hostEpName != "" {
+						calicoctl.DeleteHE(hostEpName)
+					}
 					calicoctl.Cleanup()
 
 					cleanupExecPodOrFail(f, client)
@@ -669,11 +754,12 @@ var _ = SIGDescribe("IPVSHostEndpoint", func() {
 						// -- "kubectl log" if calicoctl pod is running on the node with a host endpoint policy.
 						// This policy should set before the creation of a host endpoint policy.
 						By("allowing connection to kubelet port 10250 for kubectl exec/log")
+						kubectlPolicyName := calico.UniqueName("allow-kubectl-800")
 						policyStr := fmt.Sprintf(`
 apiVersion: projectcalico.org/v3
 kind: GlobalNetworkPolicy
 metadata:
-  name: allow-kubectl-800
+  name: %s
 spec:
   applyOnForward: false
   selector: hep == "node0"
@@ -691,25 +777,13 @@ spec:
       ports:
       - %s
 `,
-							"10250", "10250")
+							kubectlPolicyName, "10250", "10250")
 						calicoctl.Apply(policyStr)
-						policyNames = append(policyNames, "allow-kubectl-800")
+						policyNames = append(policyNames, kubectlPolicyName)
 
 						By("test connection by creating a HostEndpoint")
-						hostEpStr := fmt.Sprintf(`
-apiVersion: projectcalico.org/v3
-kind: HostEndpoint
-metadata:
-  name: host-ep
-  labels:
-    hep: node0
-spec:
-  node: %s
-  expectedIPs:
-  - %s
-`,
-							hepCalicoNodeName, hepNodeIP)
-						calicoctl.Apply(hostEpStr)
+						hostEpName = calico.UniqueName("host-ep")
+						applyHostEndpoint(hostEpName, "node0", hepCalicoNodeName, hepNodeIP)
 
 						if (c.dstHostNetworked && policy.actionType == "ingress") ||
 							(c.srcHostNetworked && policy.actionType == "egress") {
@@ -721,38 +795,40 @@ spec:
 						}
 
 						By("allowing traffic after installing a host endpoint allow policy")
+						allowPolicyName := calico.UniqueName("allow-500")
 						policyStr = fmt.Sprintf(`
 apiVersion: projectcalico.org/v3
 kind: GlobalNetworkPolicy
 metadata:
-  name: allow-500
+  name: %s
 spec:
   applyOnForward: %t
   selector: hep == "node0"
   order: 500
 %s
 `,
-							policy.applyOnForward, getPolicyAction(policy, "Allow"))
+							allowPolicyName, policy.applyOnForward, getPolicyAction(policy, "Allow"))
 						calicoctl.Apply(policyStr)
-						policyNames = append(policyNames, "allow-500")
+						policyNames = append(policyNames, allowPolicyName)
 
 						expectAccessAllowed()
 
 						By("testing connection after installing a host endpoint deny policy with lower order")
+						denyPolicyName := calico.UniqueName("deny-200")
 						policyStr = fmt.Sprintf(`
 apiVersion: projectcalico.org/v3
 kind: GlobalNetworkPolicy
 metadata:
-  name: deny-200
+  name: %s
 spec:
   applyOnForward: %t
   selector: hep == "node0"
   order: 200
 %s
 `,
-							policy.applyOnForward, getPolicyAction(policy, "Deny"))
+							denyPolicyName, policy.applyOnForward, getPolicyAction(policy, "Deny"))
 						calicoctl.Apply(policyStr)
-						policyNames = append(policyNames, "deny-200")
+						policyNames = append(policyNames, denyPolicyName)
 
 						if policy.policyApply {
 							By("policy apply. denying connection after installing a host endpoint deny policy with lower order")
@@ -853,6 +929,792 @@ spec:
 			describeEgressTest(hepTestConfig{srcPod: 2, dstPod: 1, accessType: "NodePort"},
 				[]hepPolicyConfig{{actionType: "egress", applyOnForward: false, policyApply: false},
 					{actionType: "egress", applyOnForward: true, policyApply: false}}))
+
+		// ===== host endpoint on the other node =====
+
+		Context("ingress-0-2 hep-node1: pod0 -> Pod IP -> pod2 with host endpoint on node1 [Feature:IPVSHep][Feature:IPVSHepIngress]",
+			describeEgressTest(hepTestConfig{srcPod: 0, srcHostNetworked: true, dstPod: 2, accessType: "pod IP", hepNode: 1},
+				[]hepPolicyConfig{{actionType: "ingress", applyOnForward: false, policyApply: false},
+					{actionType: "ingress", applyOnForward: true, policyApply: true}}))
+
+		// ===== host endpoint policy for local process traffic =====
+
+		It("should apply host endpoint policy to local process traffic with applyOnForward false [Feature:IPVSHep]", func() {
+			hepNode, err := f.ClientSet.CoreV1().Nodes().Get(nodeNames[0], metav1.GetOptions{})
+			framework.ExpectNoError(err)
+			if _, err := framework.IssueSSHCommandWithResult("command -v wget", framework.TestContext.Provider, hepNode); err != nil {
+				framework.Skipf("wget not available on node %s, can't run local-process test.", hepNode.Name)
+			}
+
+			By("Setting up a host-networked server pod on the host endpoint node")
+			svcPort := 8080
+			setupPodServiceOnNode(f, jig, calicoctl, nodeNames[0], svcPort, nil, true)
+			target := fmt.Sprintf("%v:%v", nodeIPs[0], svcPort)
+
+			By("Verifying a local process on the node can connect with no host endpoint")
+			framework.ExpectNoError(calico.TestConnectionFromHost(hepNode, target))
+
+			defer calicoctl.Cleanup()
+
+			By("allowing connection to kubelet port 10250 for kubectl exec/log")
+			policyStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-kubectl-800
+spec:
+  applyOnForward: false
+  selector: hep == "node0"
+  order: 800
+  ingress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      ports:
+      - %s
+  egress:
+  - action: Allow
+    protocol: TCP
+    source:
+      ports:
+      - %s
+`,
+				"10250", "10250")
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("allow-kubectl-800")
+
+			By("Creating a host endpoint and verifying local process traffic hits default deny")
+			hostEpName := calico.UniqueName("host-ep")
+			applyHostEndpoint(hostEpName, "node0", calicoNodeNames[0], nodeIPs[0])
+			defer calicoctl.DeleteHE(hostEpName)
+			Expect(calico.TestConnectionFromHost(hepNode, target)).To(HaveOccurred(),
+				"local process traffic should be denied by default once the host endpoint exists")
+
+			By("Verifying an applyOnForward=false allow policy still applies to local process traffic")
+			policyStr = `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-500
+spec:
+  applyOnForward: false
+  selector: hep == "node0"
+  order: 500
+  ingress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      ports:
+      - 8080
+  egress:
+  - action: Allow
+`
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("allow-500")
+			framework.ExpectNoError(calico.TestConnectionFromHost(hepNode, target))
+
+			By("Verifying an applyOnForward=false deny policy still applies to local process traffic")
+			policyStr = `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: deny-200
+spec:
+  applyOnForward: false
+  selector: hep == "node0"
+  order: 200
+  ingress:
+  - action: Deny
+    protocol: TCP
+    destination:
+      ports:
+      - 8080
+  egress:
+  - action: Allow
+`
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("deny-200")
+			Expect(calico.TestConnectionFromHost(hepNode, target)).To(HaveOccurred(),
+				"local process traffic should be governed by the lower-order deny policy")
+		})
+
+		// ===== host endpoint ingress from outside the cluster =====
+
+		It("should govern NodePort traffic from an external source [Feature:IPVSHep][Feature:IPVSHepIngress]", func() {
+			// Use a local process on the other node as the external source: its
+			// traffic reaches node 0's NodePort with a source IP from outside
+			// the pod network, just like a client outside the cluster.
+			externalNode, err := f.ClientSet.CoreV1().Nodes().Get(nodeNames[1], metav1.GetOptions{})
+			framework.ExpectNoError(err)
+			if _, err := framework.IssueSSHCommandWithResult("command -v wget", framework.TestContext.Provider, externalNode); err != nil {
+				framework.Skipf("wget not available on node %s, can't run external-source test.", externalNode.Name)
+			}
+
+			By("Setting up a backend pod and NodePort service on the host endpoint node")
+			svcPort := 8080
+			_, svcNodePort, _ := setupPodServiceOnNode(f, jig, calicoctl, nodeNames[0], svcPort, nil, false)
+			target := fmt.Sprintf("%v:%v", nodeIPs[0], svcNodePort)
+
+			By("Verifying the external source can reach the NodePort with no host endpoint")
+			framework.ExpectNoError(calico.TestConnectionFromHost(externalNode, target))
+
+			defer calicoctl.Cleanup()
+
+			By("allowing connection to kubelet port 10250 for kubectl exec/log")
+			policyStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-kubectl-800
+spec:
+  applyOnForward: false
+  selector: hep == "node0"
+  order: 800
+  ingress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      ports:
+      - %s
+  egress:
+  - action: Allow
+    protocol: TCP
+    source:
+      ports:
+      - %s
+`,
+				"10250", "10250")
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("allow-kubectl-800")
+
+			By("Creating a host endpoint and verifying forwarded NodePort traffic is still allowed")
+			hostEpName := calico.UniqueName("host-ep")
+			applyHostEndpoint(hostEpName, "node0", calicoNodeNames[0], nodeIPs[0])
+			defer calicoctl.DeleteHE(hostEpName)
+			framework.ExpectNoError(calico.TestConnectionFromHost(externalNode, target))
+
+			By("Verifying an applyOnForward allow policy admits the external traffic")
+			policyStr = `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-500
+spec:
+  applyOnForward: true
+  selector: hep == "node0"
+  order: 500
+  ingress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      ports:
+      - 8080
+  egress:
+  - action: Allow
+`
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("allow-500")
+			framework.ExpectNoError(calico.TestConnectionFromHost(externalNode, target))
+
+			By("Verifying a lower-order deny policy blocks the external traffic")
+			policyStr = `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: deny-200
+spec:
+  applyOnForward: true
+  selector: hep == "node0"
+  order: 200
+  ingress:
+  - action: Deny
+    protocol: TCP
+    destination:
+      ports:
+      - 8080
+  egress:
+  - action: Allow
+`
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("deny-200")
+			Expect(calico.TestConnectionFromHost(externalNode, target)).To(HaveOccurred(),
+				"external NodePort traffic should be governed by host endpoint ingress policy")
+		})
+
+		// ===== host endpoint policy independence across nodes =====
+
+		It("should enforce each node's host endpoint policy independently [Feature:IPVSHep]", func() {
+			svcPort := 8080
+
+			By("Setting up one backend pod and NodePort service per node")
+			_, svcNodePort0, _ := setupPodServiceOnNode(f, jig, calicoctl, nodeNames[0], svcPort, nil, false)
+			jigB := framework.NewServiceTestJig(f.ClientSet, "ipvs-hep-b")
+			_, svcNodePort1, _ := setupPodServiceOnNode(f, jigB, calicoctl, nodeNames[1], svcPort, nil, false)
+
+			By("Creating a client pod on each node")
+			client0 := createExecPodOrFail(f, &source{nodeNames[0], "ipvs-hep-client0", false})
+			defer cleanupExecPodOrFail(f, client0)
+			client1 := createExecPodOrFail(f, &source{nodeNames[1], "ipvs-hep-client1", false})
+			defer cleanupExecPodOrFail(f, client1)
+
+			// Register before the host endpoint deferred deletes so it runs last.
+			defer calicoctl.Cleanup()
+
+			// Both nodes now carry a host endpoint, so allow kubelet traffic on
+			// both of them for kubectl exec/log.
+			By("allowing connection to kubelet port 10250 for kubectl exec/log")
+			policyStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-kubectl-800
+spec:
+  applyOnForward: false
+  selector: has(hep)
+  order: 800
+  ingress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      ports:
+      - %s
+  egress:
+  - action: Allow
+    protocol: TCP
+    source:
+      ports:
+      - %s
+`,
+				"10250", "10250")
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("allow-kubectl-800")
+
+			By("Creating a host endpoint on each node")
+			hostEpNode0 := calico.UniqueName("host-ep-node0")
+			applyHostEndpoint(hostEpNode0, "node0", calicoNodeNames[0], nodeIPs[0])
+			defer calicoctl.DeleteHE(hostEpNode0)
+			hostEpNode1 := calico.UniqueName("host-ep-node1")
+			applyHostEndpoint(hostEpNode1, "node1", calicoNodeNames[1], nodeIPs[1])
+			defer calicoctl.DeleteHE(hostEpNode1)
+
+			By("Denying port 8080 on node0's host endpoint only")
+			policyStr = `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: deny-node0-200
+spec:
+  applyOnForward: true
+  selector: hep == "node0"
+  order: 200
+  ingress:
+  - action: Deny
+    protocol: TCP
+    destination:
+      ports:
+      - 8080
+  egress:
+  - action: Allow
+`
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("deny-node0-200")
+
+			By("Allowing port 8080 on node1's host endpoint")
+			policyStr = `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-node1-200
+spec:
+  applyOnForward: true
+  selector: hep == "node1"
+  order: 200
+  ingress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      ports:
+      - 8080
+  egress:
+  - action: Allow
+`
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("allow-node1-200")
+
+			By("Denying access to node0's NodePort from the other node")
+			testConnection(f, client1, fmt.Sprintf("%v:%v", nodeIPs[0], svcNodePort0), notReachable)
+
+			By("Allowing access to node1's NodePort from the other node")
+			testConnection(f, client0, fmt.Sprintf("%v:%v", nodeIPs[1], svcNodePort1), reachableWithSNAT)
+		})
+
+		// ===== control-plane failsafes =====
+
+		It("should keep kubelet traffic working with the failsafe policy in place [Feature:IPVSHep]", func() {
+			By("Creating a pod on the host endpoint node to exec into")
+			execPod := createExecPodOrFail(f, &source{nodeNames[0], "ipvs-hep-failsafe", false})
+			defer cleanupExecPodOrFail(f, execPod)
+
+			// kubectl exec goes apiserver -> kubelet:10250 -> pod, so it fails
+			// if host endpoint policy cuts off kubelet traffic on the pod's node.
+			kubeletReachable := func() error {
+				_, err := framework.RunKubectl(
+					"exec",
+					fmt.Sprintf("--namespace=%v", execPod.Namespace),
+					execPod.Name, "-c", "exec",
+					"--",
+					"/bin/sh", "-c", "echo hello")
+				return err
+			}
+
+			By("Verifying kubectl exec works with no host endpoint")
+			framework.ExpectNoError(kubeletReachable())
+
+			// Register before the deferred deletes so it runs last.
+			defer calicoctl.Cleanup()
+
+			By("Creating a host endpoint with no failsafe policy")
+			hostEpName := calico.UniqueName("host-ep")
+			applyHostEndpoint(hostEpName, "node0", hepCalicoNodeName, hepNodeIP)
+			defer calicoctl.DeleteHE(hostEpName)
+
+			By("Verifying kubectl exec fails once default deny cuts off kubelet traffic")
+			Eventually(kubeletReachable, 30*time.Second, 2*time.Second).ShouldNot(Succeed(),
+				"kubectl exec should fail while kubelet port 10250 is denied")
+
+			By("Opening the control-plane failsafe ports")
+			calico.ApplyHostEndpointFailsafes(calicoctl, `hep == "node0"`)
+			defer calicoctl.DeleteGNP(calico.HostEndpointFailsafeName)
+
+			By("Verifying kubectl exec works again with the failsafes in place")
+			Eventually(kubeletReachable, 30*time.Second, 2*time.Second).Should(Succeed())
+		})
+
+		// ===== host process to a clusterIP backed by a local pod =====
+
+		// A host process connecting to a clusterIP that DNATs to a pod on the
+		// same node takes a subtle path: the connection leaves the host as
+		// local process traffic (host endpoint egress policy applies, even
+		// with applyOnForward false) and arrives at the workload after DNAT
+		// (workload ingress policy applies).  This test pins down both halves.
+		It("should apply policy to host traffic to a clusterIP with a local backend [Feature:IPVSHep]", func() {
+			hepNode, err := f.ClientSet.CoreV1().Nodes().Get(nodeNames[0], metav1.GetOptions{})
+			framework.ExpectNoError(err)
+			if _, err := framework.IssueSSHCommandWithResult("command -v wget", framework.TestContext.Provider, hepNode); err != nil {
+				framework.Skipf("wget not available on node %s, can't run host-to-clusterIP test.", hepNode.Name)
+			}
+
+			By("Setting up a backend pod on the host endpoint node behind a clusterIP service")
+			svcPort := 8080
+			svcIP, _, _ := setupPodServiceOnNode(f, jig, calicoctl, nodeNames[0], svcPort, nil, false)
+			target := fmt.Sprintf("%v:%v", svcIP, svcPort)
+
+			By("Verifying the host can reach the clusterIP with no host endpoint")
+			framework.ExpectNoError(calico.TestConnectionFromHost(hepNode, target))
+
+			defer calicoctl.Cleanup()
+
+			By("Opening the control-plane failsafe ports")
+			calico.ApplyHostEndpointFailsafes(calicoctl, `hep == "node0"`)
+			defer calicoctl.DeleteGNP(calico.HostEndpointFailsafeName)
+
+			By("Creating a host endpoint and verifying host-to-clusterIP traffic hits default deny")
+			hostEpName := calico.UniqueName("host-ep")
+			applyHostEndpoint(hostEpName, "node0", calicoNodeNames[0], nodeIPs[0])
+			defer calicoctl.DeleteHE(hostEpName)
+			Expect(calico.TestConnectionFromHost(hepNode, target)).To(HaveOccurred(),
+				"host endpoint egress policy should govern host traffic to a clusterIP")
+
+			By("Verifying a host endpoint allow policy restores the clusterIP path")
+			policyStr := `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-host-500
+spec:
+  applyOnForward: false
+  selector: hep == "node0"
+  order: 500
+  ingress:
+  - action: Allow
+  egress:
+  - action: Allow
+`
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("allow-host-500")
+			framework.ExpectNoError(calico.TestConnectionFromHost(hepNode, target))
+
+			By("Verifying workload ingress policy also applies after the DNAT to the local pod")
+			policyStr = fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: deny-workload-100
+spec:
+  selector: pod-name == "%s"
+  order: 100
+  ingress:
+  - action: Deny
+`,
+				jig.Name)
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("deny-workload-100")
+			Expect(calico.TestConnectionFromHost(hepNode, target)).To(HaveOccurred(),
+				"workload ingress policy should govern DNATed host traffic to the local pod")
+		})
+
+		// ===== untracked (doNotTrack) host endpoint policy =====
+
+		It("should support a doNotTrack allow policy on a host endpoint [Feature:IPVSHep]", func() {
+			hepNode, err := f.ClientSet.CoreV1().Nodes().Get(nodeNames[0], metav1.GetOptions{})
+			framework.ExpectNoError(err)
+			clientNode, err := f.ClientSet.CoreV1().Nodes().Get(nodeNames[1], metav1.GetOptions{})
+			framework.ExpectNoError(err)
+			if _, err := framework.IssueSSHCommandWithResult("command -v wget", framework.TestContext.Provider, clientNode); err != nil {
+				framework.Skipf("wget not available on node %s, can't run doNotTrack test.", clientNode.Name)
+			}
+			conntrackFilter := "dport=8080"
+			if _, err := calico.CountConntrackEntries(hepNode, conntrackFilter); err != nil {
+				framework.Skipf("Can't read conntrack table on node %s: %v", hepNode.Name, err)
+			}
+
+			By("Setting up a host-networked server pod on the host endpoint node")
+			svcPort := 8080
+			setupPodServiceOnNode(f, jig, calicoctl, nodeNames[0], svcPort, nil, true)
+			target := fmt.Sprintf("%v:%v", nodeIPs[0], svcPort)
+
+			defer calicoctl.Cleanup()
+
+			By("Opening the control-plane failsafe ports")
+			calico.ApplyHostEndpointFailsafes(calicoctl, `hep == "node0"`)
+			defer calicoctl.DeleteGNP(calico.HostEndpointFailsafeName)
+
+			By("Creating a host endpoint so traffic to the server hits default deny")
+			hostEpName := calico.UniqueName("host-ep")
+			applyHostEndpoint(hostEpName, "node0", calicoNodeNames[0], nodeIPs[0])
+			defer calicoctl.DeleteHE(hostEpName)
+			Expect(calico.TestConnectionFromHost(clientNode, target)).To(HaveOccurred(),
+				"traffic to the server should be denied before the untracked allow policy")
+
+			By("Applying an untracked allow policy for the server port")
+			gnp := calico.ReadTestFileOrDie("templated-gnp-untracked.yaml", struct {
+				Name, Selector, Action string
+				Order, Port            int
+				DoNotTrack, PreDNAT    bool
+			}{
+				Name:       "untracked-allow-100",
+				Selector:   `hep == "node0"`,
+				Action:     "Allow",
+				Order:      100,
+				Port:       svcPort,
+				DoNotTrack: true,
+			})
+			if err := calicoctl.ApplyWithError(gnp); err != nil {
+				framework.Skipf("doNotTrack policy not supported by this datastore version: %v", err)
+			}
+			defer calicoctl.DeleteGNP("untracked-allow-100")
+
+			By("Counting conntrack entries for the server port before connecting")
+			before, err := calico.CountConntrackEntries(hepNode, conntrackFilter)
+			framework.ExpectNoError(err)
+
+			By("Verifying the untracked policy admits the traffic")
+			framework.ExpectNoError(calico.TestConnectionFromHost(clientNode, target))
+
+			By("Verifying the untracked flow left no conntrack entry")
+			after, err := calico.CountConntrackEntries(hepNode, conntrackFilter)
+			framework.ExpectNoError(err)
+			Expect(after).To(BeNumerically("<=", before),
+				"a doNotTrack flow should not create a conntrack entry")
+		})
+
+		// ===== preDNAT host endpoint policy =====
+
+		It("should block NodePort traffic before DNAT with a preDNAT deny policy [Feature:IPVSHep]", func() {
+			clientNode, err := f.ClientSet.CoreV1().Nodes().Get(nodeNames[1], metav1.GetOptions{})
+			framework.ExpectNoError(err)
+			if _, err := framework.IssueSSHCommandWithResult("command -v wget", framework.TestContext.Provider, clientNode); err != nil {
+				framework.Skipf("wget not available on node %s, can't run preDNAT test.", clientNode.Name)
+			}
+
+			By("Setting up a backend pod and NodePort service on the host endpoint node")
+			svcPort := 8080
+			_, svcNodePort, serverPod := setupPodServiceOnNode(f, jig, calicoctl, nodeNames[0], svcPort, nil, false)
+			nodePortTarget := fmt.Sprintf("%v:%v", nodeIPs[0], svcNodePort)
+			podTarget := fmt.Sprintf("%v:%v", serverPod.Status.PodIP, svcPort)
+
+			By("Creating a client pod on the other node for pod-to-pod traffic")
+			clientPod := createExecPodOrFail(f, &source{nodeNames[1], "prednat-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+
+			By("Verifying NodePort and pod-to-pod traffic with no policy")
+			framework.ExpectNoError(calico.TestConnectionFromHost(clientNode, nodePortTarget))
+			testConnection(f, clientPod, podTarget, reachableWithoutSNAT)
+
+			defer calicoctl.Cleanup()
+
+			By("Opening the control-plane failsafe ports")
+			calico.ApplyHostEndpointFailsafes(calicoctl, `hep == "node0"`)
+			defer calicoctl.DeleteGNP(calico.HostEndpointFailsafeName)
+
+			By("Creating a host endpoint on the NodePort node")
+			hostEpName := calico.UniqueName("host-ep")
+			applyHostEndpoint(hostEpName, "node0", calicoNodeNames[0], nodeIPs[0])
+			defer calicoctl.DeleteHE(hostEpName)
+
+			By("Applying a preDNAT deny policy for the NodePort")
+			gnp := calico.ReadTestFileOrDie("templated-gnp-untracked.yaml", struct {
+				Name, Selector, Action string
+				Order, Port            int
+				DoNotTrack, PreDNAT    bool
+			}{
+				Name:     "prednat-deny-100",
+				Selector: `hep == "node0"`,
+				Action:   "Deny",
+				Order:    100,
+				Port:     svcNodePort,
+				PreDNAT:  true,
+			})
+			if err := calicoctl.ApplyWithError(gnp); err != nil {
+				framework.Skipf("preDNAT policy not supported by this datastore version: %v", err)
+			}
+			defer calicoctl.DeleteGNP("prednat-deny-100")
+
+			By("Verifying external NodePort access is blocked before DNAT")
+			Expect(calico.TestConnectionFromHost(clientNode, nodePortTarget)).To(HaveOccurred(),
+				"preDNAT deny should block NodePort traffic before it is load-balanced")
+
+			By("Verifying cluster-internal pod-to-pod traffic is unaffected")
+			testConnection(f, clientPod, podTarget, reachableWithoutSNAT)
+		})
+
+		// ===== node-label-scoped host endpoint policy =====
+
+		It("should scope policy to host endpoints matching a node label [Feature:IPVSHep]", func() {
+			svcPort := 8080
+
+			By("Setting up one backend pod and NodePort service per node")
+			_, svcNodePort0, _ := setupPodServiceOnNode(f, jig, calicoctl, nodeNames[0], svcPort, nil, false)
+			jigB := framework.NewServiceTestJig(f.ClientSet, "ipvs-hep-b")
+			_, svcNodePort1, _ := setupPodServiceOnNode(f, jigB, calicoctl, nodeNames[1], svcPort, nil, false)
+
+			By("Creating a client pod on each node")
+			client0 := createExecPodOrFail(f, &source{nodeNames[0], "node-label-client0", false})
+			defer cleanupExecPodOrFail(f, client0)
+			client1 := createExecPodOrFail(f, &source{nodeNames[1], "node-label-client1", false})
+			defer cleanupExecPodOrFail(f, client1)
+
+			// Register before the host endpoint deferred deletes so it runs last.
+			defer calicoctl.Cleanup()
+
+			By("Opening the control-plane failsafe ports on both host endpoints")
+			calico.ApplyHostEndpointFailsafes(calicoctl, "has(hep)")
+			defer calicoctl.DeleteGNP(calico.HostEndpointFailsafeName)
+
+			By("Creating a labeled host endpoint on node0 and an unlabeled one on node1")
+			hostEpNode0 := calico.UniqueName("host-ep-node0")
+			applyLabeledHostEndpoint(hostEpNode0, calicoNodeNames[0], nodeIPs[0],
+				map[string]string{"hep": "node0", "env": "prod"})
+			defer calicoctl.DeleteHE(hostEpNode0)
+			hostEpNode1 := calico.UniqueName("host-ep-node1")
+			applyLabeledHostEndpoint(hostEpNode1, calicoNodeNames[1], nodeIPs[1],
+				map[string]string{"hep": "node1"})
+			defer calicoctl.DeleteHE(hostEpNode1)
+
+			By("Denying port 8080 on host endpoints labeled env=prod only")
+			policyStr := `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: deny-labeled-200
+spec:
+  applyOnForward: true
+  selector: env == "prod"
+  order: 200
+  ingress:
+  - action: Deny
+    protocol: TCP
+    destination:
+      ports:
+      - 8080
+  egress:
+  - action: Allow
+`
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("deny-labeled-200")
+
+			By("Denying access through the labeled node's NodePort")
+			testConnection(f, client1, fmt.Sprintf("%v:%v", nodeIPs[0], svcNodePort0), notReachable)
+
+			By("Allowing the identical path through the unlabeled node's NodePort")
+			testConnection(f, client0, fmt.Sprintf("%v:%v", nodeIPs[1], svcNodePort1), reachableWithSNAT)
+		})
+
+		// ===== host endpoint deletion restores traffic =====
+
+		It("should restore local-process traffic when the host endpoint is deleted [Feature:IPVSHep]", func() {
+			hepNode, err := f.ClientSet.CoreV1().Nodes().Get(nodeNames[0], metav1.GetOptions{})
+			framework.ExpectNoError(err)
+			if _, err := framework.IssueSSHCommandWithResult("command -v wget", framework.TestContext.Provider, hepNode); err != nil {
+				framework.Skipf("wget not available on node %s, can't run host endpoint deletion test.", hepNode.Name)
+			}
+
+			By("Setting up a backend pod on the host endpoint node behind a clusterIP service")
+			svcPort := 8080
+			svcIP, _, _ := setupPodServiceOnNode(f, jig, calicoctl, nodeNames[0], svcPort, nil, false)
+			target := fmt.Sprintf("%v:%v", svcIP, svcPort)
+
+			By("Verifying the host can reach the clusterIP with no host endpoint")
+			framework.ExpectNoError(calico.TestConnectionFromHost(hepNode, target))
+
+			defer calicoctl.Cleanup()
+
+			By("Opening the control-plane failsafe ports")
+			calico.ApplyHostEndpointFailsafes(calicoctl, `hep == "node0"`)
+			defer calicoctl.DeleteGNP(calico.HostEndpointFailsafeName)
+
+			By("Creating a host endpoint and verifying the local-process flow hits default deny")
+			hostEpName := calico.UniqueName("host-ep")
+			applyHostEndpoint(hostEpName, "node0", calicoNodeNames[0], nodeIPs[0])
+			hostEpDeleted := false
+			defer func() {
+				if !hostEpDeleted {
+					calicoctl.DeleteHE(hostEpName)
+				}
+			}()
+			Eventually(func() error {
+				if err := calico.TestConnectionFromHost(hepNode, target); err == nil {
+					return fmt.Errorf("connection from host to %v unexpectedly succeeded", target)
+				}
+				return nil
+			}, 30*time.Second, 2*time.Second).Should(Succeed(),
+				"host endpoint default deny should block the local-process flow")
+
+			By("Deleting the host endpoint and verifying the flow is allowed again")
+			calicoctl.DeleteHE(hostEpName)
+			hostEpDeleted = true
+			// With the host endpoint gone there is nothing for host policy to
+			// attach to, so the flow must revert to the no-policy baseline.
+			Eventually(func() error {
+				return calico.TestConnectionFromHost(hepNode, target)
+			}, 30*time.Second, 2*time.Second).Should(Succeed(),
+				"deleting the host endpoint should restore the local-process flow")
+		})
+
+		It("should keep failsafe host ports open under a default-deny host endpoint [Feature:IPVSHep]", func() {
+			hepNode, err := f.ClientSet.CoreV1().Nodes().Get(nodeNames[0], metav1.GetOptions{})
+			framework.ExpectNoError(err)
+			if _, err := framework.IssueSSHCommandWithResult("command -v wget", framework.TestContext.Provider, hepNode); err != nil {
+				framework.Skipf("wget not available on node %s, can't run failsafe port test.", hepNode.Name)
+			}
+
+			By("Setting up two backend services on the host endpoint node")
+			failsafePort := 8080
+			otherPort := 8081
+			svcIPA, _, _ := setupPodServiceOnNode(f, jig, calicoctl, nodeNames[0], failsafePort, nil, false)
+			jigB := framework.NewServiceTestJig(f.ClientSet, "ipvs-hep-fsb")
+			svcIPB, _, _ := setupPodServiceOnNode(f, jigB, calicoctl, nodeNames[0], otherPort, nil, false)
+			targetA := fmt.Sprintf("%v:%v", svcIPA, failsafePort)
+			targetB := fmt.Sprintf("%v:%v", svcIPB, otherPort)
+
+			By("Verifying the host can reach both services with no host endpoint")
+			framework.ExpectNoError(calico.TestConnectionFromHost(hepNode, targetA))
+			framework.ExpectNoError(calico.TestConnectionFromHost(hepNode, targetB))
+
+			defer calicoctl.Cleanup()
+
+			By("Opening the control-plane failsafe ports")
+			calico.ApplyHostEndpointFailsafes(calicoctl, `hep == "node0"`)
+			defer calicoctl.DeleteGNP(calico.HostEndpointFailsafeName)
+
+			By("Adding the first service's port to the outbound failsafe list")
+			restoreFailsafes := calicoctl.SetFailsafeOutboundHostPorts(append(
+				calico.DefaultFailsafeOutboundPorts, calico.FailsafePort{Protocol: "tcp", Port: failsafePort}))
+			defer restoreFailsafes()
+
+			By("Creating a default-deny host endpoint")
+			hostEpName := calico.UniqueName("host-ep")
+			applyHostEndpoint(hostEpName, "node0", calicoNodeNames[0], nodeIPs[0])
+			defer calicoctl.DeleteHE(hostEpName)
+
+			By("Verifying the port not in the failsafe list is blocked")
+			Eventually(func() error {
+				if err := calico.TestConnectionFromHost(hepNode, targetB); err == nil {
+					return fmt.Errorf("connection from host to %v unexpectedly succeeded", targetB)
+				}
+				return nil
+			}, 30*time.Second, 2*time.Second).Should(Succeed(),
+				"the host endpoint default deny should block ports outside the failsafe list")
+
+			By("Verifying the failsafe-listed port stays reachable")
+			framework.ExpectNoError(calico.TestConnectionFromHost(hepNode, targetA),
+				"a failsafe-listed port should stay open under default deny")
+
+			By("Removing the port from the failsafe list and verifying it becomes blocked")
+			calicoctl.SetFailsafeOutboundHostPorts(calico.DefaultFailsafeOutboundPorts)
+			Eventually(func() error {
+				if err := calico.TestConnectionFromHost(hepNode, targetA); err == nil {
+					return fmt.Errorf("connection from host to %v unexpectedly succeeded", targetA)
+				}
+				return nil
+			}, 60*time.Second, 2*time.Second).Should(Succeed(),
+				"removing the port from the failsafe list should close it again")
+		})
+
+		// ===== applyOnForward=false forwarding passthrough =====
+
+		// The matrix above covers applyOnForward=false alongside many other
+		// combinations; this is the isolated regression test for the guarantee
+		// itself: an AOF=false default deny on a host endpoint must leave
+		// forwarded pod traffic across that node completely alone.
+		It("should not affect forwarded pod traffic under an applyOnForward=false default deny [Feature:IPVSHep]", func() {
+			svcPort := 8080
+
+			By("Setting up a backend pod on the host endpoint node behind a clusterIP service")
+			svcClusterIP, _, dstPod := setupPodServiceOnNode(f, jig, calicoctl, nodeNames[0], svcPort, nil, false)
+			podTarget := fmt.Sprintf("%v:%v", dstPod.Status.PodIP, svcPort)
+			svcTarget := fmt.Sprintf("%v:%v", svcClusterIP, svcPort)
+
+			By("Creating a client pod on the other node")
+			client := createExecPodOrFail(f, &source{nodeNames[1], "aof-false-client", false})
+			defer cleanupExecPodOrFail(f, client)
+
+			By("Verifying forwarded pod-to-pod traffic works with no host endpoint")
+			testConnection(f, client, podTarget, reachableWithoutSNAT)
+
+			defer calicoctl.Cleanup()
+
+			By("Opening the control-plane failsafe ports")
+			calico.ApplyHostEndpointFailsafes(calicoctl, `hep == "node0"`)
+			defer calicoctl.DeleteGNP(calico.HostEndpointFailsafeName)
+
+			By("Creating a host endpoint on node0 with an applyOnForward=false default deny")
+			hostEpName := calico.UniqueName("host-ep")
+			applyHostEndpoint(hostEpName, "node0", calicoNodeNames[0], nodeIPs[0])
+			defer calicoctl.DeleteHE(hostEpName)
+			policyStr := `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: aof-false-deny-200
+spec:
+  applyOnForward: false
+  selector: hep == "node0"
+  order: 200
+  ingress:
+  - action: Deny
+  egress:
+  - action: Deny
+`
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("aof-false-deny-200")
+
+			By("Verifying forwarded traffic to the pod IP is unaffected")
+			testConnection(f, client, podTarget, reachableWithoutSNAT)
+
+			By("Verifying forwarded traffic via the clusterIP is unaffected")
+			testConnection(f, client, svcTarget, reachableWithoutSNAT)
+		})
 	})
 })
 
@@ -923,7 +1785,7 @@ var _ = SIGDescribe("IPVSIngress", func() {
 			Expect(len(nodeIPs)).To(Equal(3))
 
 			svcPort := 8080
-			svcClusterIP, svcNodePort, _ := setupPodServiceOnNode(f, jig, nodeNames[2], svcPort, nil, false)
+			svcClusterIP, svcNodePort, _ := setupPodServiceOnNode(f, jig, nil, nodeNames[2], svcPort, nil, false)
 
 			ipvsTC = IPVSTestConfig{
 				node0Name:    nodeNames[0],
@@ -1068,6 +1930,63 @@ var _ = SIGDescribe("IPVSIngress", func() {
 
 })
 
+var _ = SIGDescribe("IPVSSessionAffinity", func() {
+
+	// Verify that kube-proxy in IPVS mode honours sessionAffinity=ClientIP:
+	// repeated connections from a single client pod to a multi-backend service
+	// should always land on the same backend.
+
+	f := framework.NewDefaultFramework("ipvs-affinity")
+
+	It("should route repeated connections from one client to a single backend [Feature:IPVSIngress]", func() {
+		jig := framework.NewServiceTestJig(f.ClientSet, "ipvs-affinity")
+		nodes := jig.GetNodes(2)
+		if len(nodes.Items) < 2 {
+			framework.Skipf("Less than two schedulable nodes exist, can't continue test.")
+		}
+
+		ns := f.Namespace.Name
+		numPods := 2
+		svcPort := 80
+		svcName := "affinity-clientip"
+		podNames, svcIP, err := framework.StartServeHostnameService(f.ClientSet, f.InternalClientset, ns, svcName, svcPort, numPods)
+		Expect(err).NotTo(HaveOccurred())
+		defer framework.StopServeHostnameService(f.ClientSet, f.InternalClientset, ns, svcName)
+
+		By("Setting sessionAffinity=ClientIP on the service")
+		svc, err := f.ClientSet.CoreV1().Services(ns).Get(svcName, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+		_, err = f.ClientSet.CoreV1().Services(ns).Update(svc)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Making repeated requests from a single client pod")
+		execPod := createExecPodOrFail(f, &source{nodes.Items[0].Name, "affinity-client", false})
+		defer cleanupExecPodOrFail(f, execPod)
+
+		backends := getAffinityBackends(f, execPod, fmt.Sprintf("%v:%v", svcIP, svcPort), 10)
+		framework.Logf("Observed backends: %v (service pods %v)", backends, podNames)
+		Expect(len(backends)).To(Equal(1),
+			"sessionAffinity=ClientIP should pin all of a client's requests to one backend")
+	})
+})
+
+// getAffinityBackends hits the given hostname-serving target repeatedly from
+// the exec pod and returns the count of requests seen per backend hostname.
+func getAffinityBackends(f *framework.Framework, execPod *v1.Pod, target string, requests int) map[string]int {
+	backends := map[string]int{}
+	for i := 0; i < requests; i++ {
+		cmd := fmt.Sprintf("wget -q -T 2 -O - http://%v", target)
+		stdout, err := framework.RunHostCmd(f.Namespace.Name, execPod.Name, cmd)
+		if err != nil {
+			framework.Logf("Request %d to %v failed: %v", i, target, err)
+			continue
+		}
+		backends[strings.TrimSpace(stdout)]++
+	}
+	return backends
+}
+
 func getNodesInfo(f *framework.Framework, nodes *v1.NodeList, masterOK bool) ([]string, []string, []string) {
 	// By default, Calico node name is host name, e.g. ip-10-0-0-108.
 	// Kubernetes node name could be different (ip-10-0-0-108.us-west-2.compute.internal) if cloud provider is aws.
@@ -1130,6 +2049,38 @@ func cleanupExecPodOrFail(f *framework.Framework, pod *v1.Pod) {
 	Expect(err).NotTo(HaveOccurred())
 }
 
+// podIsWindows returns true if the given pod runs on a Windows node.  We can't
+// rely solely on the WINDOWS_OS environment variable here because a hybrid
+// cluster test may mix Linux and Windows pods within one run, so prefer the
+// pod's own OS node selector when it has one.
+func podIsWindows(pod *v1.Pod) bool {
+	if pod != nil {
+		if osName, ok := pod.Spec.NodeSelector["beta.kubernetes.io/os"]; ok {
+			return osName == "windows"
+		}
+	}
+	return os.Getenv("WINDOWS_OS") != "" || winctl.RunningWindowsTest()
+}
+
+// ipFamily reports which address family an IP literal belongs to.
+func ipFamily(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// expectedSourceForFamily returns the pod address that the echo server should
+// observe given the family of the address it actually reported, or "" if the
+// pod has no address of that family.
+func expectedSourceForFamily(pod *v1.Pod, observedIP string) string {
+	family := ipFamily(observedIP)
+	if pod.Status.PodIP != "" && ipFamily(pod.Status.PodIP) == family {
+		return pod.Status.PodIP
+	}
+	return ""
+}
+
 func testConnection(f *framework.Framework, client interface{}, target string, reachability string) {
 	var execPod *v1.Pod
 	var shell, opt, cmd string
@@ -1146,6 +2097,7 @@ func testConnection(f *framework.Framework, client interface{}, target string, r
 		panic("Unhandled client type")
 	}
 
+	isWindows := podIsWindows(execPod)
 	completedAttempts := 0
 	startTime := time.Now()
 	reason := "<unknown>"
@@ -1155,9 +2107,11 @@ func testConnection(f *framework.Framework, client interface{}, target string, r
 			time.Sleep(time.Second)
 		}
 		// First, do the connectivity check.
-		if os.Getenv("WINDOWS_OS") != "" {
+		if isWindows {
 			framework.Logf("Checking connectivity with 'Invoke-Webrequest %v'", target)
-			cmd = fmt.Sprintf("try {Invoke-Webrequest %v -TimeoutSec 2 -UseBasicParsing -DisableKeepAlive} catch { echo failed; exit 1 }; exit 0 ;", target)
+			// Echo the response body so that the client_address line from the
+			// echo server shows up in stdout, as it does for the wget probe.
+			cmd = fmt.Sprintf("try {$r = Invoke-Webrequest %v -TimeoutSec 2 -UseBasicParsing -DisableKeepAlive; echo $r.Content} catch { echo failed; exit 1 }; exit 0 ;", target)
 			shell = "powershell.exe"
 			opt = "-Command"
 		} else {
@@ -1184,31 +2138,52 @@ func testConnection(f *framework.Framework, client interface{}, target string, r
 				continue
 			}
 
-			if os.Getenv("WINDOWS_OS") == "" {
-				// Desired stdout in this format: "client_address=x.x.x.x\n"
-				outputs := strings.Split(strings.TrimSpace(stdout), "=")
-				if len(outputs) != 2 {
-					reason = fmt.Sprintf("exec pod returned unexpected stdout format: [%s]\n", stdout)
+			// Desired stdout contains a line "client_address=x.x.x.x".  The Windows
+			// echo server wraps the response body in extra CRLF-terminated lines, so
+			// scan for the client_address line rather than assuming it is the only
+			// output.
+			sourceIP := ""
+			for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+				line = strings.TrimSpace(line)
+				if strings.HasPrefix(line, "client_address=") {
+					sourceIP = strings.TrimPrefix(line, "client_address=")
+					break
+				}
+			}
+			if sourceIP == "" {
+				if isWindows {
+					// Some of the Windows server images don't echo the client
+					// address back; treat the successful connection as enough.
+					framework.Logf("No client_address in Windows response, skipping source IP check: [%s]", stdout)
+					return
+				}
+				reason = fmt.Sprintf("exec pod returned unexpected stdout format: [%s]\n", stdout)
+				framework.Logf(reason)
+				continue
+			}
+			if !execPod.Spec.HostNetwork && reachability == reachableWithoutSNAT {
+				// Verify observed source IP if exec pod is not running in host network namespace
+				// and we don't expect any SNAT in the data path.  With exec pod running in host
+				// network namespace and the destination IP is a virtual IP (service IP), the source
+				// IP that the destination sees may be different from the exec pod IP.  For
+				// instance, If the host happens to have a local IP 10.x.x.x which is closer to
+				// service IP 10.100.x.x than pod IP 192.168.x.x, this 10.x.x.x may be used by
+				// kernel as source IP.
+				//
+				// On a dual-stack target the echo server reports the client address for
+				// whichever family carried the connection, so compare against the exec
+				// pod's address of that same family.
+				expectedSourceIP := expectedSourceForFamily(execPod, sourceIP)
+				if expectedSourceIP == "" {
+					framework.Logf("Exec pod has no %s address, skipping source IP check for observed %s",
+						ipFamily(sourceIP), sourceIP)
+				} else if sourceIP != expectedSourceIP {
+					reason = "Failure: the server saw incorrect source IP, pod IP was unexpectedly SNATed."
 					framework.Logf(reason)
+					// We allow retries for this because there seems to be a race in kube-proxy's programming
+					// that sometimes results in connectivity before NAT is in place.
 					continue
 				}
-				if !execPod.Spec.HostNetwork && reachability == reachableWithoutSNAT {
-					// Verify observed source IP if exec pod is not running in host network namespace
-					// and we don't expect any SNAT in the data path.  With exec pod running in host
-					// network namespace and the destination IP is a virtual IP (service IP), the source
-					// IP that the destination sees may be different from the exec pod IP.  For
-					// instance, If the host happens to have a local IP 10.x.x.x which is closer to
-					// service IP 10.100.x.x than pod IP 192.168.x.x, this 10.x.x.x may be used by
-					// kernel as source IP.
-					sourceIP := outputs[1]
-					if sourceIP != execPod.Status.PodIP {
-						reason = "Failure: the server saw incorrect source IP, pod IP was unexpectedly SNATed."
-						framework.Logf(reason)
-						// We allow retries for this because there seems to be a race in kube-proxy's programming
-						// that sometimes results in connectivity before NAT is in place.
-						continue
-					}
-				}
 			}
 			return // Success!
 		} else {
@@ -1226,11 +2201,20 @@ func testConnection(f *framework.Framework, client interface{}, target string, r
 }
 
 func setupPodServiceOnNode(f *framework.Framework, jig *framework.ServiceTestJig,
+	ctl *calico.Calicoctl,
 	nodeName string,
 	svcPort int,
 	tweak func(svc *v1.Service),
 	dstHostNetworked bool,
 ) (string, int, *v1.Pod) {
+	if ctl != nil && !dstHostNetworked {
+		// Fail fast with a clear message if the target node can't allocate
+		// pod IPs yet, rather than debugging the resulting connectivity flake.
+		if err := ctl.WaitForIPAMBlock(nodeName, 30*time.Second); err != nil {
+			framework.Failf("Node %v is not ready to host the backend pod: %v", nodeName, err)
+		}
+	}
+
 	serviceName := jig.Name
 	By("creating a TCP service " + serviceName + " in namespace " + f.Namespace.Name + ".")
 	svc := jig.CreateTCPServiceWithPort(f.Namespace.Name, func(svc *v1.Service) {
@@ -1311,3 +2295,100 @@ func checkNodeIsMaster(f *framework.Framework, ips []string) bool {
 
 	return false
 }
+
+// clusterOwnedSourceIP reports whether ip is an address the cluster itself
+// would use as a SNAT source: one of a node's reported addresses, or an
+// address inside a node's pod CIDR.
+func clusterOwnedSourceIP(nodes *v1.NodeList, ip string) bool {
+	parsed := net.ParseIP(ip)
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		for _, addr := range node.Status.Addresses {
+			if addr.Address == ip {
+				return true
+			}
+		}
+		if node.Spec.PodCIDR != "" && parsed != nil {
+			if _, cidr, err := net.ParseCIDR(node.Spec.PodCIDR); err == nil && cidr.Contains(parsed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientIPFromResponse strips the ":port" suffix from the body an echo
+// server's /clientip endpoint returns, leaving just the address.
+func clientIPFromResponse(body string) (string, error) {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(body))
+	if err != nil {
+		return "", fmt.Errorf("unexpected /clientip response %q: %v", body, err)
+	}
+	return host, nil
+}
+
+var _ = SIGDescribe("LoadBalancer source IP preservation [Feature:CalicoLoadBalancer]", func() {
+	f := framework.NewDefaultFramework("lb-source-ip")
+	loadBalancerCreateTimeout := framework.LoadBalancerCreateTimeoutDefault
+
+	BeforeEach(func() {
+		// A cloud load balancer must be provisioned for the ingress IP to
+		// exist at all; skip everywhere else.
+		framework.SkipUnlessProviderIs("gce", "gke")
+		if nodes := framework.GetReadySchedulableNodesOrDie(f.ClientSet); len(nodes.Items) > framework.LargeClusterMinNodesNumber {
+			loadBalancerCreateTimeout = framework.LoadBalancerCreateTimeoutLarge
+		}
+	})
+
+	It("should preserve the client source IP only with externalTrafficPolicy=Local [Slow]", func() {
+		namespace := f.Namespace.Name
+		serviceName := "lb-source-ip"
+		jig := framework.NewServiceTestJig(f.ClientSet, serviceName)
+
+		svc := jig.CreateOnlyLocalLoadBalancerService(namespace, serviceName, loadBalancerCreateTimeout, true, nil)
+		defer func() {
+			jig.ChangeServiceType(svc.Namespace, svc.Name, v1.ServiceTypeClusterIP, loadBalancerCreateTimeout)
+			Expect(f.ClientSet.CoreV1().Services(svc.Namespace).Delete(svc.Name, nil)).NotTo(HaveOccurred())
+		}()
+
+		svcTCPPort := int(svc.Spec.Ports[0].Port)
+		ingressIP := framework.GetIngressPoint(&svc.Status.LoadBalancer.Ingress[0])
+
+		nodes := framework.GetReadySchedulableNodesOrDie(f.ClientSet)
+
+		By("reading the client IP the backend sees with the Local policy")
+		// With the Local policy the node forwards straight to a local
+		// backend without SNAT, so the backend must see our own address,
+		// not one belonging to the cluster.
+		content := jig.GetHTTPContent(ingressIP, svcTCPPort, framework.KubeProxyLagTimeout, "/clientip")
+		localClientIP, err := clientIPFromResponse(content.String())
+		framework.ExpectNoError(err)
+		framework.Logf("Local policy: backend saw client address %v", localClientIP)
+		if clusterOwnedSourceIP(nodes, localClientIP) {
+			framework.Failf("Source IP was NOT preserved with externalTrafficPolicy=Local; backend saw cluster-owned address %v", localClientIP)
+		}
+
+		By("switching the service to the Cluster policy")
+		svc = jig.UpdateServiceOrFail(svc.Namespace, svc.Name, func(svc *v1.Service) {
+			svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeCluster
+		})
+
+		By("checking the backend now sees a SNATed cluster-owned source")
+		var clusterClientIP string
+		pollErr := wait.PollImmediate(framework.Poll, framework.KubeProxyLagTimeout, func() (bool, error) {
+			content := jig.GetHTTPContent(ingressIP, svcTCPPort, framework.KubeProxyLagTimeout, "/clientip")
+			ip, err := clientIPFromResponse(content.String())
+			if err != nil {
+				return false, nil
+			}
+			clusterClientIP = ip
+			// The SNAT source is the forwarding node's own address or an
+			// address from its pod range, depending on the dataplane; either
+			// way it must be one the cluster owns and not ours.
+			return clusterClientIP != localClientIP && clusterOwnedSourceIP(nodes, clusterClientIP), nil
+		})
+		if pollErr != nil {
+			framework.Failf("Source IP was still preserved with externalTrafficPolicy=Cluster, got %v", clusterClientIP)
+		}
+	})
+})
@@ -23,7 +23,6 @@ import (
 	"k8s.io/kubernetes/test/utils/calico"
 
 	"fmt"
-	"io/ioutil"
 	"strings"
 
 	. "github.com/onsi/ginkgo"
@@ -54,26 +53,9 @@ var _ = framework.KubeDescribe("[Feature:CalicoPolicy-v1]", func() {
 	})
 	BeforeEach(func() {
 		Skip("Not running Calico V1 policy tests")
-		if calico.DatastoreType == "" {
-			// Infer datastore type by reading /etc/calico/calicoctl.cfg.
-			b, err := ioutil.ReadFile("/etc/calico/calicoctl.cfg")
-			Expect(err).NotTo(HaveOccurred())
-			for _, line := range strings.Split(string(b), "\n") {
-				if strings.Contains(line, "datastoreType") {
-					if strings.Contains(line, "kubernetes") {
-						calico.DatastoreType = "kdd"
-					}
-					if strings.Contains(line, "etcd") {
-						calico.DatastoreType = "etcd"
-					}
-				}
-			}
-			framework.Logf("datastoreType = %v", calico.DatastoreType)
-			Expect(calico.DatastoreType).NotTo(Equal(""))
-		}
-		if calico.DatastoreType == "kdd" {
-			Skip("KDD mode not supported")
-		}
+		// The deprecated calicoctl shell-out helpers now detect the datastore
+		// themselves, so these tests can run on KDD clusters too.
+		calico.DetectLocalDatastoreType()
 		framework.Logf("Running tests for datastoreType %s", calico.DatastoreType)
 	})
 	Context("Calico specific network policy", func() {
@@ -19,6 +19,7 @@ package network
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -170,6 +171,61 @@ var _ = SIGDescribe("[Feature:CalicoPolicy-v3][Serial]", func() {
 			testCannotConnectX(f, f.Namespace, "client", hepSvc, target2, avoidNodeCustomizer)
 		})
 
+		It("should revert to baseline when the host endpoint is deleted under a live policy", func() {
+			policy := fmt.Sprintf(strings.Join([]string{
+				"apiVersion: projectcalico.org/v3",
+				"kind: GlobalNetworkPolicy",
+				"metadata:",
+				"  name: %[1]s",
+				"spec:",
+				"  selector: host-endpoint == \"%[1]s\"",
+				"  ingress:",
+				"  - action: Allow",
+				"    protocol: TCP",
+				"    destination:",
+				"      ports:",
+				"      - hepport",
+			}, "\n"), hepNodeName)
+			ctl.Apply(policy)
+			defer ctl.Delete(policy)
+
+			target1 := fmt.Sprintf("%s.%s:%d", hepSvc.Name, hepSvc.Namespace, hepPort1)
+			target2 := fmt.Sprintf("%s.%s:%d", hepSvc.Name, hepSvc.Namespace, hepPort2)
+
+			By("Verifying the policy is enforced while the host endpoint exists.")
+			testCanConnectX(f, f.Namespace, "client", hepSvc, target1, avoidNodeCustomizer, func() {})
+			testCannotConnectX(f, f.Namespace, "client", hepSvc, target2, avoidNodeCustomizer)
+
+			// Grab the host IP now so the endpoint can be recreated even if an
+			// assertion below fails; the AfterEach expects it to exist.
+			serverPod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Get("server", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Deleting the host endpoint while the policy still references it.")
+			ctl.DeleteHE(hepNodeName)
+			hepRestored := false
+			defer func() {
+				if !hepRestored {
+					setupHostEndPoint(ctl, hepNodeName, hepPort1, serverPod.Status.HostIP)
+				}
+			}()
+
+			By("Verifying the node reverts to the no-host-policy baseline and stays healthy.")
+			// With the endpoint gone there is nothing for the policy to
+			// attach to, so both ports open up again; the dangling selector
+			// must not wedge felix or the node.
+			testCanConnectX(f, f.Namespace, "client", hepSvc, target1, avoidNodeCustomizer, func() {})
+			testCanConnectX(f, f.Namespace, "client", hepSvc, target2, avoidNodeCustomizer, func() {})
+			Expect(framework.WaitForNodeToBeReady(f.ClientSet, hepNodeName, 2*time.Minute)).To(BeTrue(),
+				"the node went unready after its host endpoint was deleted")
+
+			By("Recreating the host endpoint and verifying the policy re-applies.")
+			setupHostEndPoint(ctl, hepNodeName, hepPort1, serverPod.Status.HostIP)
+			hepRestored = true
+			testCanConnectX(f, f.Namespace, "client", hepSvc, target1, avoidNodeCustomizer, func() {})
+			testCannotConnectX(f, f.Namespace, "client", hepSvc, target2, avoidNodeCustomizer)
+		})
+
 		AfterEach(func() {
 			ctl.DeleteHE(hepNodeName)
 			ctl.Delete(defaultAllow)
@@ -18,12 +18,23 @@ package network
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"k8s.io/api/core/v1"
+	extensions "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/utils/alp"
 	"k8s.io/kubernetes/test/utils/calico"
+	imageutils "k8s.io/kubernetes/test/utils/image"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -47,24 +58,3432 @@ var _ = SIGDescribe("[Feature:CalicoPolicy-v3] calico policy", func() {
 		calicoctl = calico.ConfigureCalicoctl(f)
 	})
 
-	Context("Calico specific network policy", func() {
-		BeforeEach(func() {
-			// Create Server with Service
-			By("Creating a simple server.")
-			podServer, service = createServerPodAndService(f, f.Namespace, "server", []int{80})
-			framework.Logf("Waiting for Server to come up.")
+	Context("same-node policy evaluation", func() {
+		It("should require both source egress and destination ingress policies to allow traffic", func() {
+			ns := f.Namespace
+			jig := framework.NewServiceTestJig(f.ClientSet, "same-node")
+			nodes := jig.GetNodes(1)
+			if len(nodes.Items) == 0 {
+				framework.Skipf("No schedulable nodes exist, can't continue test.")
+			}
+			// Pin both the server and every client to a single node so the
+			// traffic never leaves the host: same-node traffic must still pass
+			// the source's egress policy AND the destination's ingress policy.
+			nodeName := nodes.Items[0].Name
+			sameNode := func(pod *v1.Pod) { pod.Spec.NodeName = nodeName }
+			clientName := "same-node-client"
+
+			By("Creating a server pod pinned to the chosen node.")
+			podServer, service := createServerPodAndServiceX(f, ns, "same-node-server", []int{serverPort1}, sameNode, func(_ *v1.Service) {})
+			defer cleanupServerPodAndService(f, podServer, service)
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
+			Expect(err).NotTo(HaveOccurred())
+			target := fmt.Sprintf("%s.%s:%d", service.Name, service.Namespace, serverPort1)
+
+			createPolicy := func(name string, podSelector map[string]string, types []networkingv1.PolicyType, ingress []networkingv1.NetworkPolicyIngressRule, egress []networkingv1.NetworkPolicyEgressRule) *networkingv1.NetworkPolicy {
+				policy := &networkingv1.NetworkPolicy{
+					ObjectMeta: metav1.ObjectMeta{Name: name},
+					Spec: networkingv1.NetworkPolicySpec{
+						PodSelector: metav1.LabelSelector{MatchLabels: podSelector},
+						PolicyTypes: types,
+						Ingress:     ingress,
+						Egress:      egress,
+					},
+				}
+				policy, err := f.ClientSet.NetworkingV1().NetworkPolicies(ns.Name).Create(policy)
+				Expect(err).NotTo(HaveOccurred())
+				return policy
+			}
+			serverSelector := map[string]string{"pod-name": podServer.Name}
+			clientSelector := map[string]string{"pod-name": clientName}
+			allowAllIngress := []networkingv1.NetworkPolicyIngressRule{{}}
+			allowAllEgress := []networkingv1.NetworkPolicyEgressRule{{}}
+
+			By("Verifying egress-allow on the client does not override ingress-deny on the server.")
+			egressAllow := createPolicy("client-egress-allow", clientSelector,
+				[]networkingv1.PolicyType{networkingv1.PolicyTypeEgress}, nil, allowAllEgress)
+			ingressDeny := createPolicy("server-ingress-deny", serverSelector,
+				[]networkingv1.PolicyType{networkingv1.PolicyTypeIngress}, nil, nil)
+			testCannotConnectX(f, ns, clientName, service, target, sameNode)
+			cleanupNetworkPolicy(f, ingressDeny)
+			cleanupNetworkPolicy(f, egressAllow)
+
+			By("Verifying ingress-allow on the server does not override egress-deny on the client.")
+			egressDeny := createPolicy("client-egress-deny", clientSelector,
+				[]networkingv1.PolicyType{networkingv1.PolicyTypeEgress}, nil, nil)
+			ingressAllow := createPolicy("server-ingress-allow", serverSelector,
+				[]networkingv1.PolicyType{networkingv1.PolicyTypeIngress}, allowAllIngress, nil)
+			defer cleanupNetworkPolicy(f, ingressAllow)
+			testCannotConnectX(f, ns, clientName, service, target, sameNode)
+			cleanupNetworkPolicy(f, egressDeny)
+
+			By("Verifying traffic passes when both egress and ingress policies allow it.")
+			egressAllow = createPolicy("client-egress-allow", clientSelector,
+				[]networkingv1.PolicyType{networkingv1.PolicyTypeEgress}, nil, allowAllEgress)
+			defer cleanupNetworkPolicy(f, egressAllow)
+			testCanConnectX(f, ns, clientName, service, target, sameNode, func() {})
+		})
+	})
+
+	Context("namespace profile sync", func() {
+		It("should reflect namespace labels in the generated profile", func() {
+			nsName := f.BaseName + "-profile"
+			ns, err := f.CreateNamespace(nsName, map[string]string{
+				"ns-label": "original",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			getLabelsToApply := func() map[string]interface{} {
+				profile, err := calicoctl.GetNamespaceProfile(ns.Name)
+				if err != nil {
+					framework.Logf("Failed to get namespace profile: %v", err)
+					return nil
+				}
+				spec, ok := profile["spec"].(map[string]interface{})
+				if !ok {
+					return nil
+				}
+				labels, _ := spec["labelsToApply"].(map[string]interface{})
+				return labels
+			}
+
+			By("Verifying the new namespace's profile applies the namespace labels.")
+			Eventually(getLabelsToApply, 30*time.Second, 2*time.Second).Should(
+				HaveKeyWithValue("pcns.ns-label", "original"))
+
+			By("Adding a namespace label and verifying it propagates to the profile.")
+			patch := `{"metadata":{"labels":{"added-label":"added"}}}`
+			_, err = f.ClientSet.CoreV1().Namespaces().Patch(ns.Name, types.StrategicMergePatchType, []byte(patch))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(getLabelsToApply, 30*time.Second, 2*time.Second).Should(
+				HaveKeyWithValue("pcns.added-label", "added"))
+		})
+
+		It("should garbage-collect namespaced policies when the namespace is deleted", func() {
+			nsName := f.BaseName + "-gc"
+			gcNs, err := f.CreateNamespace(nsName, map[string]string{
+				"ns-name": nsName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Creating Calico NetworkPolicies in the namespace.")
+			policyNames := []string{"gc-policy-a", "gc-policy-b"}
+			for _, name := range policyNames {
+				calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: NetworkPolicy
+metadata:
+  name: %s
+  namespace: %s
+spec:
+  order: 500
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Allow
+`,
+					name, gcNs.Name, name))
+			}
+			listPolicies := func() ([]string, error) {
+				return calicoctl.GetList("networkpolicy", gcNs.Name)
+			}
+			names, err := listPolicies()
+			Expect(err).NotTo(HaveOccurred())
+			for _, name := range policyNames {
+				Expect(names).To(ContainElement(name))
+			}
+
+			By("Deleting the namespace.")
+			err = f.ClientSet.CoreV1().Namespaces().Delete(gcNs.Name, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Verifying the policies are garbage-collected with it.")
+			Eventually(listPolicies, 5*time.Minute, 5*time.Second).Should(BeEmpty(),
+				"NetworkPolicies in namespace %v should be removed with the namespace", gcNs.Name)
+		})
+	})
+
+	Context("profile defaults", func() {
+		It("should apply the namespace profile default to pods selected by no policy", func() {
+			ns := f.Namespace
+			clientName := "profile-default-client"
+
+			By("Creating a server pod with no policies selecting it.")
+			podServer, service := createServerPodAndService(f, ns, "profile-default-server", []int{serverPort1})
+			defer cleanupServerPodAndService(f, podServer, service)
 			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
 			Expect(err).NotTo(HaveOccurred())
 
-			By("Creating client which will be able to contact the server since no policies are present.")
-			testCanConnect(f, f.Namespace, "client-can-connect", service, 80)
-			calicoctl = calico.ConfigureCalicoctl(f)
+			By("Verifying the default-allow namespace profile admits the traffic.")
+			testCanConnect(f, ns, clientName, service, serverPort1)
+
+			By("Switching the namespace profile's default rules to deny.")
+			// Grab two copies: one to mutate and one to restore afterwards.
+			profile, err := calicoctl.GetNamespaceProfile(ns.Name)
+			Expect(err).NotTo(HaveOccurred())
+			original, err := calicoctl.GetNamespaceProfile(ns.Name)
+			Expect(err).NotTo(HaveOccurred())
+			spec, ok := profile["spec"].(map[string]interface{})
+			Expect(ok).To(BeTrue(), "namespace profile has no spec: %v", profile)
+			spec["ingress"] = []map[string]interface{}{{"action": "Deny"}}
+			spec["egress"] = []map[string]interface{}{{"action": "Deny"}}
+			calicoctl.ApplyFromMap(profile)
+			// Restore the default-allow profile so namespace teardown and other
+			// tests aren't affected if an assertion below fails.
+			defer calicoctl.ApplyFromMap(original)
+
+			By("Verifying a pod selected by zero policies falls through to the deny default.")
+			testCannotConnect(f, ns, clientName, service, serverPort1)
+
+			By("Restoring the default-allow profile and verifying connectivity returns.")
+			calicoctl.ApplyFromMap(original)
+			testCanConnect(f, ns, clientName, service, serverPort1)
+		})
+	})
+
+	Context("headless services", func() {
+		It("should enforce egress policy for traffic to a headless service's pod IPs", func() {
+			ns := f.Namespace
+			clientName := "headless-client"
+
+			By("Creating a server pod with a headless service.")
+			podServer, service := createServerPodAndServiceX(f, ns, "headless-server", []int{serverPort1},
+				func(pod *v1.Pod) {},
+				func(svc *v1.Service) { svc.Spec.ClusterIP = v1.ClusterIPNone })
+			defer cleanupServerPodAndService(f, podServer, service)
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Verifying the headless name resolves to the pod IP and connects with no policy.")
+			testCanConnect(f, ns, clientName, service, serverPort1)
+
+			By("Creating an egress policy that only allows the client DNS.")
+			protocolUDP := v1.ProtocolUDP
+			port53 := intstr.FromInt(53)
+			dnsOnly := &networkingv1.NetworkPolicy{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "headless-client-dns-only",
+				},
+				Spec: networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{
+						MatchLabels: map[string]string{"pod-name": clientName},
+					},
+					PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+					// Allow DNS so the headless name still resolves; everything
+					// else is denied.
+					Egress: []networkingv1.NetworkPolicyEgressRule{{
+						Ports: []networkingv1.NetworkPolicyPort{{
+							Protocol: &protocolUDP,
+							Port:     &port53,
+						}},
+					}},
+				},
+			}
+			dnsOnly, err = f.ClientSet.NetworkingV1().NetworkPolicies(ns.Name).Create(dnsOnly)
+			Expect(err).NotTo(HaveOccurred())
+			defer cleanupNetworkPolicy(f, dnsOnly)
+
+			By("Verifying the client cannot reach the resolved pod IP with only DNS allowed.")
+			testCannotConnect(f, ns, clientName, service, serverPort1)
+
+			By("Allowing egress to the backend pods by label.")
+			toBackends := &networkingv1.NetworkPolicy{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "headless-client-to-backends",
+				},
+				Spec: networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{
+						MatchLabels: map[string]string{"pod-name": clientName},
+					},
+					PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+					Egress: []networkingv1.NetworkPolicyEgressRule{{
+						To: []networkingv1.NetworkPolicyPeer{{
+							PodSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{"pod-name": podServer.Name},
+							},
+						}},
+					}},
+				},
+			}
+			toBackends, err = f.ClientSet.NetworkingV1().NetworkPolicies(ns.Name).Create(toBackends)
+			Expect(err).NotTo(HaveOccurred())
+			defer cleanupNetworkPolicy(f, toBackends)
+
+			By("Verifying the client can reach the headless service's pod IPs.")
+			testCanConnect(f, ns, clientName, service, serverPort1)
+		})
+	})
+
+	Context("long-lived connections", func() {
+		It("should keep established connections alive when a deny policy is applied mid-flow", func() {
+			ns := f.Namespace
+			const port = 8080
+			outFile := "/tmp/persist_out"
+
+			By("Creating a server pod that heartbeats on every accepted connection.")
+			serverCmd := fmt.Sprintf(
+				"while true; do (while true; do echo beat; sleep 2; done) | nc -l -p %d; done", port)
+			serverPod := calico.CreateBusyboxPodOnNode(f, "persist-server", "", serverCmd)
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(serverPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", serverPod.Name, err)
+				}
+			}()
+
+			By("Creating a long-running client pod.")
+			clientPod := calico.CreateBusyboxPodOnNode(f, "persist-client", "", "sleep 3600")
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(clientPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", clientPod.Name, err)
+				}
+			}()
+
+			countHeartbeats := func() int {
+				out, err := framework.RunHostCmd(ns.Name, clientPod.Name, fmt.Sprintf("wc -l < %s", outFile))
+				if err != nil {
+					framework.Logf("Failed to count received heartbeats: %v", err)
+					return -1
+				}
+				n, err := strconv.Atoi(strings.TrimSpace(out))
+				if err != nil {
+					return -1
+				}
+				return n
+			}
+
+			By("Opening a persistent connection from the client to the server.")
+			openCmd := fmt.Sprintf("touch %s; nohup sh -c 'nc %s %d > %s' >/dev/null 2>&1 &",
+				outFile, serverPod.Status.PodIP, port, outFile)
+			_, err := framework.RunHostCmd(ns.Name, clientPod.Name, openCmd)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(countHeartbeats, 30*time.Second, 2*time.Second).Should(BeNumerically(">", 0),
+				"the persistent connection should be receiving heartbeats")
+
+			By("Applying a deny-all-ingress policy to the server mid-flow.")
+			policy := &networkingv1.NetworkPolicy{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "persist-server-deny-ingress",
+				},
+				Spec: networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"pod-name": serverPod.Name,
+						},
+					},
+					// An ingress policy with no allowed sources denies all new
+					// inbound connections.
+					PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				},
+			}
+			policy, err = f.ClientSet.NetworkingV1().NetworkPolicies(ns.Name).Create(policy)
+			Expect(err).NotTo(HaveOccurred())
+			defer cleanupNetworkPolicy(f, policy)
+
+			By("Verifying new connections to the server are blocked.")
+			newConnCmd := fmt.Sprintf("sleep 3 | nc -w 5 %s %d | head -n 1 | grep beat", serverPod.Status.PodIP, port)
+			Eventually(func() error {
+				_, err := framework.RunHostCmd(ns.Name, clientPod.Name, newConnCmd)
+				if err == nil {
+					return fmt.Errorf("new connection to %s:%d unexpectedly succeeded", serverPod.Status.PodIP, port)
+				}
+				return nil
+			}, 60*time.Second, 5*time.Second).ShouldNot(HaveOccurred())
+
+			By("Verifying the established connection keeps receiving data.")
+			before := countHeartbeats()
+			Expect(before).To(BeNumerically(">", 0))
+			Eventually(countHeartbeats, 30*time.Second, 2*time.Second).Should(BeNumerically(">", before),
+				"the established connection should survive the deny policy")
+		})
+	})
+
+	Context("path MTU discovery", func() {
+		It("should keep large cross-node transfers working when ICMP is denied", func() {
+			ns := f.Namespace
+			const port = 8080
+
+			jig := framework.NewServiceTestJig(f.ClientSet, "pmtud")
+			nodes := jig.GetNodes(2)
+			if len(nodes.Items) < 2 {
+				framework.Skipf("Less than two schedulable nodes exist, can't test an overlay path.")
+			}
+
+			By("Creating a sink server and a client on different nodes.")
+			serverCmd := fmt.Sprintf("while true; do nc -l -p %d > /dev/null; done", port)
+			serverPod := calico.CreateBusyboxPodOnNode(f, "pmtud-server", nodes.Items[0].Name, serverCmd)
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(serverPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", serverPod.Name, err)
+				}
+			}()
+			clientPod := calico.CreateBusyboxPodOnNode(f, "pmtud-client", nodes.Items[1].Name, "sleep 3600")
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(clientPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", clientPod.Name, err)
+				}
+			}()
+
+			sendLargePayload := func() error {
+				// A 512KB upload forces full-MTU segments across the overlay;
+				// if path MTU discovery is broken (frag-needed blocked) the
+				// transfer hangs and nc's timeout fails the command.
+				cmd := fmt.Sprintf("head -c 524288 /dev/zero | nc -w 20 %s %d && echo sent",
+					serverPod.Status.PodIP, port)
+				out, err := framework.RunHostCmd(ns.Name, clientPod.Name, cmd)
+				if err != nil {
+					return err
+				}
+				if !strings.Contains(out, "sent") {
+					return fmt.Errorf("large payload was not fully sent: %q", out)
+				}
+				return nil
+			}
+
+			By("Verifying a large payload crosses the overlay with no policy.")
+			framework.ExpectNoError(sendLargePayload())
+
+			By("Denying all ICMP to and from the test pods.")
+			policyStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: deny-icmp-100
+spec:
+  order: 100
+  selector: has(pod-name) && projectcalico.org/namespace == "%s"
+  ingress:
+  - action: Deny
+    protocol: ICMP
+  - action: Allow
+  egress:
+  - action: Deny
+    protocol: ICMP
+  - action: Allow
+`,
+				ns.Name)
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("deny-icmp-100")
+
+			By("Verifying the large payload still completes with ICMP denied.")
+			// The frag-needed/packet-too-big messages that drive PMTUD are
+			// generated and consumed by the hosts, which the workload ICMP
+			// deny must not touch; a hang here means the essential ICMP types
+			// are being dropped along with the rest.
+			framework.ExpectNoError(sendLargePayload())
+		})
+	})
+
+	Context("overlay encapsulation", func() {
+		It("should capture encapsulated packets for cross-node pod traffic [Feature:CalicoDiags]", func() {
+			ns := f.Namespace
+			const port = 8080
+
+			jig := framework.NewServiceTestJig(f.ClientSet, "encap")
+			nodes := jig.GetNodes(2)
+			if len(nodes.Items) < 2 {
+				framework.Skipf("Less than two schedulable nodes exist, can't generate cross-node traffic.")
+			}
+			serverNode := nodes.Items[0]
+			clientNode := nodes.Items[1]
+			clientAddrs := framework.GetNodeAddresses(&clientNode, v1.NodeInternalIP)
+			if len(clientAddrs) == 0 {
+				framework.Failf("node %s failed to report a valid ip address", clientNode.Name)
+			}
+
+			By("Creating a server and a client on different nodes.")
+			serverCmd := fmt.Sprintf("while true; do nc -l -p %d > /dev/null; done", port)
+			serverPod := calico.CreateBusyboxPodOnNode(f, "encap-server", serverNode.Name, serverCmd)
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(serverPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", serverPod.Name, err)
+				}
+			}()
+			clientCmd := fmt.Sprintf("while true; do wget -q -T 2 -O /dev/null http://%s:%d 2>/dev/null; sleep 1; done",
+				serverPod.Status.PodIP, port)
+			clientPod := calico.CreateBusyboxPodOnNode(f, "encap-client", clientNode.Name, clientCmd)
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(clientPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", clientPod.Name, err)
+				}
+			}()
+
+			By("Capturing traffic from the client's node on the server's node.")
+			// On an overlay the pod-to-pod flow arrives wrapped in IPIP or
+			// VXLAN from the client's node address.
+			filter := fmt.Sprintf("host %s and (ip proto 4 or udp port 4789)", clientAddrs[0])
+			pcap, err := calico.CapturePackets(f, serverNode.Name, filter, 10*time.Second)
+			if err != nil {
+				framework.Skipf("Unable to capture packets on node %v: %v", serverNode.Name, err)
+			}
+
+			ipip, vxlan, err := calico.CountEncapsulatedPackets(pcap)
+			Expect(err).NotTo(HaveOccurred())
+			framework.Logf("Captured %v IPIP packets and %v VXLAN packets (%v bytes of pcap)", ipip, vxlan, len(pcap))
+			Expect(ipip+vxlan).To(BeNumerically(">", 0),
+				"expected cross-node pod traffic to be IPIP or VXLAN encapsulated")
+		})
+
+		It("should carry cross-node pod traffic over UDP 4789 on a VXLAN cluster [Disruptive]", func() {
+			ns := f.Namespace
+			const port = 8080
+
+			jig := framework.NewServiceTestJig(f.ClientSet, "vxlan-transport")
+			nodes := jig.GetNodes(2)
+			if len(nodes.Items) < 2 {
+				framework.Skipf("Less than two schedulable nodes exist, can't generate cross-node traffic.")
+			}
+			serverNode := nodes.Items[0]
+			clientNode := nodes.Items[1]
+			clientAddrs := framework.GetNodeAddresses(&clientNode, v1.NodeInternalIP)
+			if len(clientAddrs) == 0 {
+				framework.Failf("node %s failed to report a valid ip address", clientNode.Name)
+			}
+
+			By("Checking the cluster actually uses VXLAN encapsulation.")
+			pools, err := calicoctl.GetList("ippool", "")
+			Expect(err).NotTo(HaveOccurred())
+			if len(pools) == 0 {
+				framework.Skipf("No IPPool exists, can't determine the encapsulation mode.")
+			}
+			_, vxlanMode := calicoctl.GetIPPoolEncap(pools[0])
+			if vxlanMode == "Never" {
+				framework.Skipf("IPPool %v has vxlanMode Never; this test only applies to VXLAN clusters.", pools[0])
+			}
+
+			// The overlay flow shows up in the server node's conntrack table
+			// as UDP to the VXLAN port from the client's node address.
+			conntrackFilter := fmt.Sprintf("src=%s .*dport=4789", clientAddrs[0])
+			if _, err := calico.CountConntrackEntries(&serverNode, conntrackFilter); err != nil {
+				framework.Skipf("Can't read conntrack table on node %s: %v", serverNode.Name, err)
+			}
+
+			By("Creating a cross-node server and client pair.")
+			serverCmd := fmt.Sprintf("while true; do echo ok | nc -l -p %d; done", port)
+			serverPod := calico.CreateBusyboxPodOnNode(f, "vxlan-server", serverNode.Name, serverCmd)
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(serverPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", serverPod.Name, err)
+				}
+			}()
+			clientPod := calico.CreateBusyboxPodOnNode(f, "vxlan-client", clientNode.Name, "sleep 3600")
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(clientPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", clientPod.Name, err)
+				}
+			}()
+			connect := func() error {
+				_, err := framework.RunHostCmd(ns.Name, clientPod.Name,
+					fmt.Sprintf("wget -q -T 5 -O /dev/null http://%s:%d", serverPod.Status.PodIP, port))
+				return err
+			}
+			Eventually(connect, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"cross-node baseline connectivity never came up")
+
+			By("Verifying the probe rides a UDP 4789 flow from the client's node.")
+			count, err := calico.CountConntrackEntries(&serverNode, conntrackFilter)
+			Expect(err).NotTo(HaveOccurred())
+			framework.Logf("Found %v conntrack entries matching %q", count, conntrackFilter)
+			Expect(count).To(BeNumerically(">", 0),
+				"no VXLAN conntrack entry from the client node; cross-node traffic is not using UDP 4789")
+
+			By("Applying a host endpoint default deny that leaves the VXLAN port uncovered.")
+			serverAddrs := framework.GetNodeAddresses(&serverNode, v1.NodeInternalIP)
+			serverHostNames := framework.GetNodeAddresses(&serverNode, v1.NodeHostName)
+			Expect(serverAddrs).NotTo(BeEmpty())
+			Expect(serverHostNames).NotTo(BeEmpty())
+			// The failsafe policy keeps control-plane traffic alive but
+			// deliberately does not cover UDP 4789, so the default deny below
+			// should cut the overlay while leaving the node manageable.
+			calico.ApplyHostEndpointFailsafes(calicoctl, "vxlan-test == 'server'")
+			defer calicoctl.DeleteGNP(calico.HostEndpointFailsafeName)
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: HostEndpoint
+metadata:
+  name: vxlan-test-hep
+  labels:
+    vxlan-test: "server"
+spec:
+  node: %s
+  expectedIPs:
+  - %s
+`,
+				serverHostNames[0], serverAddrs[0]))
+			defer calicoctl.DeleteHE("vxlan-test-hep")
+
+			By("Verifying overlay connectivity breaks without a 4789 allow.")
+			Eventually(connect, 2*time.Minute, 5*time.Second).ShouldNot(Succeed(),
+				"cross-node traffic survived a host endpoint deny of the VXLAN port")
+
+			By("Allowing UDP 4789 on the host endpoint and verifying recovery.")
+			calicoctl.Apply(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-vxlan-4789
+spec:
+  applyOnForward: false
+  selector: vxlan-test == 'server'
+  order: 700
+  ingress:
+  - action: Allow
+    protocol: UDP
+    destination:
+      ports:
+      - 4789
+  egress:
+  - action: Allow
+    protocol: UDP
+    destination:
+      ports:
+      - 4789
+`)
+			defer calicoctl.DeleteGNP("allow-vxlan-4789")
+			Eventually(connect, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"cross-node traffic did not recover once UDP 4789 was allowed")
+		})
+
+		It("should preserve DSCP markings on cross-node pod traffic [Feature:CalicoDiags]", func() {
+			// DSCP 46 (expedited forwarding), as a ToS byte value for ping -Q.
+			const dscp = 46
+			const tos = dscp << 2
+
+			jig := framework.NewServiceTestJig(f.ClientSet, "dscp")
+			nodes := jig.GetNodes(2)
+			if len(nodes.Items) < 2 {
+				framework.Skipf("Less than two schedulable nodes exist, can't generate cross-node traffic.")
+			}
+
+			By("Creating a client and a ping target on different nodes.")
+			serverPod := createExecPodOrFail(f, &source{nodes.Items[0].Name, "dscp-server", false})
+			defer cleanupExecPodOrFail(f, serverPod)
+			clientPod := createExecPodOrFail(f, &source{nodes.Items[1].Name, "dscp-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+			if !calico.CanSetToS(f, clientPod) {
+				framework.Skipf("the probe image's ping cannot set the ToS byte")
+			}
+
+			By("Applying a policy so the marked traffic crosses an explicit verdict.")
+			calicoctl.Apply(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: dscp-allow
+spec:
+  order: 400
+  selector: pod-name == 'dscp-server'
+  types:
+  - Ingress
+  ingress:
+  - action: Allow
+    protocol: ICMP
+`)
+			defer calicoctl.DeleteGNP("dscp-allow")
+
+			serverIP := serverPod.Status.PodIP
+			Eventually(func() error {
+				return calico.ProbeWithToS(f, clientPod, serverIP, tos, 1)
+			}, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"marked pings never got through to the target pod")
+
+			By("Capturing on the target's node while the client pings with DSCP set.")
+			pingDone := make(chan error, 1)
+			go func() {
+				// Roughly one probe per second, comfortably outlasting the
+				// capture below.
+				pingDone <- calico.ProbeWithToS(f, clientPod, serverIP, tos, 20)
+			}()
+			filter := fmt.Sprintf("icmp and src host %s", clientPod.Status.PodIP)
+			pcap, err := calico.CapturePackets(f, nodes.Items[0].Name, filter, 10*time.Second)
+			if err != nil {
+				framework.Skipf("Unable to capture packets on node %v: %v", nodes.Items[0].Name, err)
+			}
+			framework.ExpectNoError(<-pingDone, "the marked ping loop failed mid-capture")
+
+			By("Verifying the capture contains the client's packets still marked.")
+			// The capture runs on "any", so the decapsulated packet is seen
+			// with the pod's own source IP even when the overlay wraps it in
+			// IPIP or VXLAN on the wire.
+			marked, err := calico.CountPacketsWithDSCP(pcap, clientPod.Status.PodIP, dscp)
+			Expect(err).NotTo(HaveOccurred())
+			unmarked, err := calico.CountPacketsWithDSCP(pcap, clientPod.Status.PodIP, 0)
+			Expect(err).NotTo(HaveOccurred())
+			framework.Logf("Captured %v marked and %v unmarked packets from the client (%v bytes of pcap)",
+				marked, unmarked, len(pcap))
+			Expect(marked).To(BeNumerically(">", 0),
+				"the DSCP marking did not survive the path to the target's node")
+		})
+	})
+
+	Context("encapsulation modes", func() {
+		It("should give identical policy outcomes under IPIP, VXLAN and no-encap [Disruptive] [Slow]", func() {
+			ns := f.Namespace
+			const port = 8080
+
+			jig := framework.NewServiceTestJig(f.ClientSet, "encap-modes")
+			nodes := jig.GetNodes(2)
+			if len(nodes.Items) < 2 {
+				framework.Skipf("Less than two schedulable nodes exist, can't generate cross-node traffic.")
+			}
+
+			pools, err := calicoctl.GetList("ippool", "")
+			Expect(err).NotTo(HaveOccurred())
+			if len(pools) == 0 {
+				framework.Skipf("No IPPool exists, can't patch the encapsulation mode.")
+			}
+			poolName := pools[0]
+
+			By("Creating a cross-node server and client pair.")
+			serverCmd := fmt.Sprintf("while true; do echo ok | nc -l -p %d; done", port)
+			serverPod := calico.CreateBusyboxPodOnNode(f, "encap-mode-server", nodes.Items[0].Name, serverCmd)
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(serverPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", serverPod.Name, err)
+				}
+			}()
+			clientPod := calico.CreateBusyboxPodOnNode(f, "encap-mode-client", nodes.Items[1].Name, "sleep 3600")
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(clientPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", clientPod.Name, err)
+				}
+			}()
+			connect := func() error {
+				_, err := framework.RunHostCmd(ns.Name, clientPod.Name,
+					fmt.Sprintf("wget -q -T 5 -O /dev/null http://%s:%d", serverPod.Status.PodIP, port))
+				return err
+			}
+
+			modes := []struct {
+				name      string
+				ipipMode  string
+				vxlanMode string
+			}{
+				{"ipip", "Always", "Never"},
+				{"vxlan", "Never", "Always"},
+				{"no-encap", "Never", "Never"},
+			}
+
+			By("Remembering the pool's current encapsulation so it can be restored.")
+			origIPIP, origVXLAN := calicoctl.SetIPPoolEncap(poolName, modes[0].ipipMode, modes[0].vxlanMode)
+			defer calicoctl.SetIPPoolEncap(poolName, origIPIP, origVXLAN)
+
+			for _, mode := range modes {
+				By(fmt.Sprintf("Switching pool %v to %v.", poolName, mode.name))
+				calicoctl.SetIPPoolEncap(poolName, mode.ipipMode, mode.vxlanMode)
+
+				// Route reprogramming takes a while; use the baseline probe
+				// both as the reconvergence wait and as the capability check
+				// for this mode.
+				baselineErr := wait.PollImmediate(5*time.Second, 3*time.Minute, func() (bool, error) {
+					return connect() == nil, nil
+				})
+				if baselineErr != nil {
+					framework.Logf("Skipping %v: cross-node traffic does not work in this environment (%v)", mode.name, baselineErr)
+					continue
+				}
+
+				By(fmt.Sprintf("Verifying a deny policy is enforced under %v.", mode.name))
+				calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: encap-mode-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+					serverPod.Name))
+				Eventually(connect, 2*time.Minute, 5*time.Second).ShouldNot(Succeed(),
+					"the deny should be enforced under %v", mode.name)
+
+				By(fmt.Sprintf("Verifying connectivity returns when the deny is removed under %v.", mode.name))
+				calicoctl.DeleteGNP("encap-mode-deny")
+				Eventually(connect, 2*time.Minute, 5*time.Second).Should(Succeed(),
+					"connectivity should return after the deny is removed under %v", mode.name)
+			}
+		})
+	})
+
+	Context("multiple IPPools", func() {
+		It("should enforce ipBlock policy scoped to one pool's CIDR", func() {
+			ns := f.Namespace
+			const port = 8080
+			const poolACIDR = "10.222.111.0/24"
+			const poolBCIDR = "10.222.112.0/24"
+
+			By("Creating two dedicated IPPools.")
+			calicoctl.ApplyIPPool("e2e-pool-a", poolACIDR)
+			defer calicoctl.DeleteIPPool("e2e-pool-a")
+			calicoctl.ApplyIPPool("e2e-pool-b", poolBCIDR)
+			defer calicoctl.DeleteIPPool("e2e-pool-b")
+
+			createPodInPool := func(name, pool, cmd string) *v1.Pod {
+				pod := &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: name,
+						Labels: map[string]string{
+							"pod-name": name,
+						},
+						Annotations: map[string]string{
+							// Ask the CNI plugin to allocate this pod's IP
+							// from a specific pool.
+							"cni.projectcalico.org/ipv4pools": fmt.Sprintf(`["%s"]`, pool),
+						},
+					},
+					Spec: v1.PodSpec{
+						NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+						Containers: []v1.Container{
+							{
+								Name:  fmt.Sprintf("%s-container", name),
+								Image: "busybox",
+								Args:  []string{"/bin/sh", "-c", cmd},
+							},
+						},
+					},
+				}
+				pod, err := f.ClientSet.CoreV1().Pods(ns.Name).Create(pod)
+				Expect(err).NotTo(HaveOccurred())
+				err = framework.WaitForPodRunningInNamespace(f.ClientSet, pod)
+				Expect(err).NotTo(HaveOccurred())
+				pod, err = f.ClientSet.CoreV1().Pods(ns.Name).Get(pod.Name, metav1.GetOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				return pod
+			}
+			deletePod := func(pod *v1.Pod) {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(pod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", pod.Name, err)
+				}
+			}
+			expectPodInPool := func(pod *v1.Pod, cidr string) {
+				inPool, err := calico.IPInCIDR(pod.Status.PodIP, cidr)
+				Expect(err).NotTo(HaveOccurred())
+				if !inPool {
+					framework.Skipf("Pod %v got IP %v outside pool %v; the CNI plugin does not honor the ipv4pools annotation.",
+						pod.Name, pod.Status.PodIP, cidr)
+				}
+			}
+
+			By("Creating a server in pool A and a client in pool B.")
+			serverCmd := fmt.Sprintf("while true; do echo ok | nc -l -p %d; done", port)
+			serverPod := createPodInPool("pool-a-server", "e2e-pool-a", serverCmd)
+			defer deletePod(serverPod)
+			expectPodInPool(serverPod, poolACIDR)
+			clientB := createPodInPool("pool-b-client", "e2e-pool-b", "sleep 3600")
+			defer deletePod(clientB)
+			expectPodInPool(clientB, poolBCIDR)
+
+			connectFrom := func(client *v1.Pod) func() error {
+				return func() error {
+					_, err := framework.RunHostCmd(ns.Name, client.Name,
+						fmt.Sprintf("wget -q -T 5 -O /dev/null http://%s:%d", serverPod.Status.PodIP, port))
+					return err
+				}
+			}
+
+			By("Verifying cross-pool connectivity with no policy.")
+			Eventually(connectFrom(clientB), 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"client in pool B should reach the server in pool A without policy")
+
+			By("Denying ingress to the server from pool B's CIDR only.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: cross-pool-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+    source:
+      nets:
+      - %s
+  - action: Allow
+`,
+				serverPod.Name, poolBCIDR))
+			defer calicoctl.DeleteGNP("cross-pool-deny")
+
+			Eventually(connectFrom(clientB), 2*time.Minute, 5*time.Second).ShouldNot(Succeed(),
+				"client in pool B should be blocked by the pool B CIDR deny")
+
+			By("Verifying a client in pool A is not matched by the pool B CIDR.")
+			clientA := createPodInPool("pool-a-client", "e2e-pool-a", "sleep 3600")
+			defer deletePod(clientA)
+			expectPodInPool(clientA, poolACIDR)
+			Eventually(connectFrom(clientA), 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"client in pool A should not be matched by the pool B CIDR deny")
+		})
+	})
+
+	Context("calicoctl RBAC", func() {
+		It("should work with a least-privilege role and fail with a narrower one", func() {
+			if calicoctl.DatastoreType() != "kubernetes" {
+				framework.Skipf("RBAC only applies to calicoctl on the kubernetes datastore.")
+			}
+			if !framework.IsRBACEnabled(f) {
+				framework.Skipf("RBAC is not enabled in this cluster.")
+			}
+
+			gnpYAML := `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: rbac-probe
+spec:
+  order: 9000
+  selector: pod-name == 'no-such-pod'
+  types:
+  - Ingress
+  ingress:
+  - action: Allow
+`
+
+			By("Applying a policy with only the verbs the operation needs.")
+			narrowCtl := calico.ConfigureCalicoctl(f, calico.CalicoctlOptions{
+				Rules: calico.NarrowCalicoctlRules(
+					[]string{"globalnetworkpolicies"},
+					[]string{"create", "get", "list", "update", "delete"}),
+			})
+			defer narrowCtl.Cleanup()
+			err := narrowCtl.ApplyWithError(gnpYAML)
+			Expect(err).NotTo(HaveOccurred(),
+				"calicoctl should manage GlobalNetworkPolicies with the reduced role")
+			narrowCtl.DeleteGNP("rbac-probe")
+
+			By("Verifying the apply is Forbidden with a read-only role.")
+			readOnlyCtl := calico.ConfigureCalicoctl(f, calico.CalicoctlOptions{
+				Rules: calico.NarrowCalicoctlRules(
+					[]string{"globalnetworkpolicies"},
+					[]string{"get", "list"}),
+			})
+			defer readOnlyCtl.Cleanup()
+			// Use a zero backoff so the Forbidden response fails the job on
+			// the first attempt instead of being retried.
+			err = readOnlyCtl.ApplyWithBackoffError(0, gnpYAML)
+			Expect(err).To(HaveOccurred(),
+				"calicoctl should not be able to apply a GlobalNetworkPolicy with a read-only role")
+		})
+	})
+
+	Context("rolling updates", func() {
+		It("should keep enforcing policy on a Deployment's pods throughout a rolling update", func() {
+			ns := f.Namespace
+			const appLabel = "rolling-server"
+
+			By("Creating a Deployment of servers behind a service.")
+			labels := map[string]string{"app": appLabel}
+			deployment := framework.NewDeployment(appLabel, 2, labels, "porter",
+				imageutils.GetE2EImage(imageutils.Porter), extensions.RollingUpdateDeploymentStrategyType)
+			deployment.Spec.Template.Spec.NodeSelector = map[string]string{"beta.kubernetes.io/os": "linux"}
+			deployment.Spec.Template.Spec.Containers[0].Env = []v1.EnvVar{
+				{Name: "SERVE_PORT_80", Value: "rollout-1"},
+			}
+			deployment.Spec.Template.Spec.Containers[0].Ports = []v1.ContainerPort{
+				{ContainerPort: 80},
+			}
+			deployment, err := f.ClientSet.ExtensionsV1beta1().Deployments(ns.Name).Create(deployment)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.ExtensionsV1beta1().Deployments(ns.Name).Delete(deployment.Name, nil); err != nil {
+					framework.Failf("unable to cleanup deployment %v: %v", deployment.Name, err)
+				}
+			}()
+			framework.ExpectNoError(framework.WaitForDeploymentComplete(f.ClientSet, deployment))
+
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: appLabel,
+				},
+				Spec: v1.ServiceSpec{
+					Selector: labels,
+					Ports: []v1.ServicePort{
+						{
+							Port:       80,
+							TargetPort: intstr.FromInt(80),
+						},
+					},
+				},
+			}
+			svc, err = f.ClientSet.CoreV1().Services(ns.Name).Create(svc)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.CoreV1().Services(ns.Name).Delete(svc.Name, nil); err != nil {
+					framework.Failf("unable to cleanup svc %v: %v", svc.Name, err)
+				}
+			}()
+			framework.ExpectNoError(framework.WaitForEndpoint(f.ClientSet, ns.Name, svc.Name))
+
+			By("Allowing ingress to the servers only from permitted clients.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: rolling-ingress-policy
+spec:
+  order: 200
+  selector: app == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Allow
+    source:
+      selector: probe-role == 'allowed'
+  - action: Deny
+`,
+				appLabel))
+			defer calicoctl.DeleteGNP("rolling-ingress-policy")
+
+			createClient := func(name, role string) *v1.Pod {
+				pod := &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: name,
+						Labels: map[string]string{
+							"pod-name":   name,
+							"probe-role": role,
+						},
+					},
+					Spec: v1.PodSpec{
+						NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+						Containers: []v1.Container{
+							{
+								Name:  fmt.Sprintf("%s-container", name),
+								Image: "busybox",
+								Args:  []string{"/bin/sh", "-c", "sleep 3600"},
+							},
+						},
+					},
+				}
+				pod, err := f.ClientSet.CoreV1().Pods(ns.Name).Create(pod)
+				Expect(err).NotTo(HaveOccurred())
+				framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, pod))
+				return pod
+			}
+			deleteClient := func(pod *v1.Pod) {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(pod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", pod.Name, err)
+				}
+			}
+			allowedClient := createClient("rolling-client-allowed", "allowed")
+			defer deleteClient(allowedClient)
+			blockedClient := createClient("rolling-client-blocked", "blocked")
+			defer deleteClient(blockedClient)
+			probe := func(client *v1.Pod) error {
+				_, err := framework.RunHostCmd(ns.Name, client.Name,
+					fmt.Sprintf("wget -q -T 2 -O /dev/null http://%s:80", svc.Spec.ClusterIP))
+				return err
+			}
+
+			By("Verifying the baseline before the rollout.")
+			Eventually(func() error { return probe(allowedClient) }, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"the permitted client should reach the servers")
+			Eventually(func() error { return probe(blockedClient) }, 2*time.Minute, 5*time.Second).ShouldNot(Succeed(),
+				"the denied client should be blocked before the rollout")
+
+			By("Triggering a rolling update and probing continuously while it runs.")
+			deployment, err = framework.UpdateDeploymentWithRetries(f.ClientSet, ns.Name, deployment.Name,
+				func(update *extensions.Deployment) {
+					update.Spec.Template.Spec.Containers[0].Env = []v1.EnvVar{
+						{Name: "SERVE_PORT_80", Value: "rollout-2"},
+					}
+				})
+			Expect(err).NotTo(HaveOccurred())
+
+			done := make(chan error, 1)
+			go func() {
+				done <- framework.WaitForDeploymentComplete(f.ClientSet, deployment)
+			}()
+			attempts, allowed := 0, 0
+		rollout:
+			for {
+				select {
+				case err := <-done:
+					framework.ExpectNoError(err, "the rolling update did not complete")
+					break rollout
+				default:
+					if probe(blockedClient) == nil {
+						allowed++
+					}
+					attempts++
+					time.Sleep(1 * time.Second)
+				}
+			}
+			framework.Logf("Made %d denied-client probes during the rollout", attempts)
+			Expect(allowed).To(BeZero(),
+				"%d of %d denied-client probes got through during the rolling update", allowed, attempts)
+
+			By("Verifying enforcement on the replacement pods.")
+			// The new pods have new IPs but the same labels, so the policy
+			// must apply to them as soon as they serve.
+			Eventually(func() error { return probe(allowedClient) }, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"the permitted client should reach the new pods")
+			for i := 0; i < 3; i++ {
+				Expect(probe(blockedClient)).To(HaveOccurred(),
+					"the denied client should stay blocked on the new pods")
+				time.Sleep(2 * time.Second)
+			}
+		})
+	})
+
+	Context("felix availability", func() {
+		It("should keep enforcing programmed policy while felix is paused [Disruptive]", func() {
+			ns := f.Namespace
+
+			By("Creating a server pod and a long-running client.")
+			serverPod, service := createServerPodAndService(f, ns, "felix-pause-server", []int{serverPort1})
+			defer cleanupServerPodAndService(f, serverPod, service)
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, serverPod))
+			serverPod, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(serverPod.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			clientName := "felix-pause-client"
+			clientPod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: clientName,
+					Labels: map[string]string{
+						"pod-name": clientName,
+					},
+				},
+				Spec: v1.PodSpec{
+					NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+					Containers: []v1.Container{
+						{
+							Name:  fmt.Sprintf("%s-container", clientName),
+							Image: "busybox",
+							Args:  []string{"/bin/sh", "-c", "sleep 3600"},
+						},
+					},
+				},
+			}
+			clientPod, err = f.ClientSet.CoreV1().Pods(ns.Name).Create(clientPod)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(clientPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", clientPod.Name, err)
+				}
+			}()
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, clientPod))
+
+			connect := func() error {
+				_, err := framework.RunHostCmd(ns.Name, clientPod.Name,
+					fmt.Sprintf("wget -q -T 5 -O /dev/null http://%s:%d", service.Spec.ClusterIP, serverPort1))
+				return err
+			}
+
+			By("Programming a deny and waiting for it to take effect.")
+			Eventually(connect, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"client should reach the server before any policy exists")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: felix-pause-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				serverPod.Name))
+			gnpDeleted := false
+			defer func() {
+				if !gnpDeleted {
+					calicoctl.DeleteGNP("felix-pause-deny")
+				}
+			}()
+			Eventually(connect, 2*time.Minute, 5*time.Second).ShouldNot(Succeed(),
+				"deny should be programmed before felix is paused")
+
+			By("Pausing felix on the server's node.")
+			if err := calico.PauseFelix(f, serverPod.Spec.NodeName); err != nil {
+				framework.Skipf("Cannot safely pause felix on node %v: %v", serverPod.Spec.NodeName, err)
+			}
+			felixPaused := true
+			defer func() {
+				if felixPaused {
+					framework.ExpectNoError(calico.ResumeFelix(f, serverPod.Spec.NodeName))
+				}
+			}()
+
+			By("Verifying the programmed deny persists while felix is paused.")
+			for i := 0; i < 3; i++ {
+				Expect(connect()).To(HaveOccurred(),
+					"the already-programmed deny should keep enforcing without felix")
+				time.Sleep(5 * time.Second)
+			}
+
+			By("Deleting the policy and verifying the change is not applied while felix is paused.")
+			calicoctl.DeleteGNP("felix-pause-deny")
+			gnpDeleted = true
+			for i := 0; i < 3; i++ {
+				Expect(connect()).To(HaveOccurred(),
+					"the policy removal should not reach the dataplane while felix is paused")
+				time.Sleep(5 * time.Second)
+			}
+
+			By("Resuming felix and verifying the dataplane converges.")
+			framework.ExpectNoError(calico.ResumeFelix(f, serverPod.Spec.NodeName))
+			felixPaused = false
+			Eventually(connect, 3*time.Minute, 5*time.Second).Should(Succeed(),
+				"felix should apply the pending policy removal once resumed")
+		})
+	})
+
+	Context("Calico specific network policy", func() {
+		BeforeEach(func() {
+			// Create Server with Service
+			By("Creating a simple server.")
+			podServer, service = createServerPodAndService(f, f.Namespace, "server", []int{80})
+			framework.Logf("Waiting for Server to come up.")
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Creating client which will be able to contact the server since no policies are present.")
+			testCanConnect(f, f.Namespace, "client-can-connect", service, 80)
+			calicoctl = calico.ConfigureCalicoctl(f)
+
+		})
+
+		AfterEach(func() {
+			cleanupServerPodAndService(f, podServer, service)
+			calicoctl.Cleanup()
+		})
+
+		It("should support applying a templated policy manifest file", func() {
+			type gnpConfig struct {
+				Name     string
+				Selector string
+				Action   string
+				Order    int
+				Port     int
+			}
+			selector := fmt.Sprintf("pod-name == '%s'", podServer.Name)
+
+			By("Applying the templated manifest with an allow data set.")
+			allowName := "templated-allow"
+			calicoctl.ApplyTemplateFile("templated-gnp-1.yaml", gnpConfig{
+				Name:     allowName,
+				Selector: selector,
+				Action:   "Allow",
+				Order:    500,
+				Port:     serverPort1,
+			})
+			defer calicoctl.DeleteGNP(allowName)
+
+			By("Verifying the server is still reachable with the allow policy in place.")
+			testCanConnect(f, f.Namespace, "client-tpl-allow", service, serverPort1)
+
+			By("Applying the same manifest with a deny data set.")
+			denyName := "templated-deny"
+			calicoctl.ApplyTemplateFile("templated-gnp-1.yaml", gnpConfig{
+				Name:     denyName,
+				Selector: selector,
+				Action:   "Deny",
+				Order:    200,
+				Port:     serverPort1,
+			})
+			defer calicoctl.DeleteGNP(denyName)
+
+			By("Verifying the lower-order deny rendered from the same file blocks the server.")
+			testCannotConnect(f, f.Namespace, "client-tpl-deny", service, serverPort1)
+		})
+
+		It("should break order ties between policies by name", func() {
+			type gnpConfig struct {
+				Name     string
+				Selector string
+				Action   string
+				Order    int
+				Port     int
+			}
+			selector := fmt.Sprintf("pod-name == '%s'", podServer.Name)
+
+			By("Creating two same-order policies where the deny sorts first by name.")
+			calicoctl.ApplyTemplateFile("templated-gnp-1.yaml", gnpConfig{
+				Name:     "tie-a-deny",
+				Selector: selector,
+				Action:   "Deny",
+				Order:    500,
+				Port:     serverPort1,
+			})
+			defer calicoctl.DeleteGNP("tie-a-deny")
+			calicoctl.ApplyTemplateFile("templated-gnp-1.yaml", gnpConfig{
+				Name:     "tie-b-allow",
+				Selector: selector,
+				Action:   "Allow",
+				Order:    500,
+				Port:     serverPort1,
+			})
+			defer calicoctl.DeleteGNP("tie-b-allow")
+
+			By("Verifying the first policy in name order (the deny) wins the tie.")
+			testCannotConnect(f, f.Namespace, "client-tie-deny", service, serverPort1)
+
+			By("Recreating the allow under a name that sorts before the deny.")
+			calicoctl.ApplyTemplateFile("templated-gnp-1.yaml", gnpConfig{
+				Name:     "tie-0-allow",
+				Selector: selector,
+				Action:   "Allow",
+				Order:    500,
+				Port:     serverPort1,
+			})
+			defer calicoctl.DeleteGNP("tie-0-allow")
+
+			By("Verifying the allow policy now wins the tie.")
+			testCanConnect(f, f.Namespace, "client-tie-allow", service, serverPort1)
+		})
+
+		It("should limit enforcement to the directions listed in the policy's types", func() {
+			type gnpTypesConfig struct {
+				Name          string
+				Selector      string
+				Order         int
+				Types         []string
+				IngressAction string
+				EgressAction  string
+			}
+
+			By("Applying an ingress-only deny to a client and verifying its egress is unaffected.")
+			// types: [Ingress] means the policy governs only the client's
+			// inbound traffic; its outbound connections keep falling through
+			// to the namespace profile, which allows them.
+			calicoctl.ApplyTemplateFile("templated-gnp-types.yaml", gnpTypesConfig{
+				Name:          "types-ingress-only",
+				Selector:      "pod-name == 'types-client-a'",
+				Order:         300,
+				Types:         []string{"Ingress"},
+				IngressAction: "Deny",
+			})
+			defer calicoctl.DeleteGNP("types-ingress-only")
+			testCanConnect(f, f.Namespace, "types-client-a", service, serverPort1)
+
+			By("Applying an egress-only deny to the server and verifying its ingress is unaffected.")
+			serverSelector := fmt.Sprintf("pod-name == '%s'", podServer.Name)
+			calicoctl.ApplyTemplateFile("templated-gnp-types.yaml", gnpTypesConfig{
+				Name:         "types-egress-only",
+				Selector:     serverSelector,
+				Order:        300,
+				Types:        []string{"Egress"},
+				EgressAction: "Deny",
+			})
+			defer calicoctl.DeleteGNP("types-egress-only")
+			// Reply packets ride the established conntrack entry rather than
+			// the server's egress policy, so inbound connections still work.
+			testCanConnect(f, f.Namespace, "types-client-b", service, serverPort1)
+
+			By("Listing Ingress in types without ingress rules and verifying ingress hits default deny.")
+			// This is the sharp edge: naming a direction in types makes the
+			// policy govern it, and with no rules in that direction the
+			// traffic ends in deny instead of falling through to the profile.
+			calicoctl.ApplyTemplateFile("templated-gnp-types.yaml", gnpTypesConfig{
+				Name:         "types-both-egress-rules",
+				Selector:     serverSelector,
+				Order:        200,
+				Types:        []string{"Ingress", "Egress"},
+				EgressAction: "Allow",
+			})
+			defer calicoctl.DeleteGNP("types-both-egress-rules")
+			testCannotConnect(f, f.Namespace, "types-client-c", service, serverPort1)
+		})
+
+		It("should allow ingress from all sources except those matching a notSelector", func() {
+			ns := f.Namespace
+			type negatedConfig struct {
+				Name        string
+				Selector    string
+				Order       int
+				NotSelector string
+				NotNets     []string
+			}
+
+			By("Allowing ingress to the server from everything except quarantined pods.")
+			// The single allow rule does not match quarantined sources, and an
+			// unmatched flow falls off the end of the policy as a deny since
+			// Ingress is listed in types.
+			calicoctl.ApplyTemplateFile("templated-gnp-negated.yaml", negatedConfig{
+				Name:        "allow-except-quarantine",
+				Selector:    fmt.Sprintf("pod-name == '%s'", podServer.Name),
+				Order:       200,
+				NotSelector: "quarantine == 'true'",
+			})
+			defer calicoctl.DeleteGNP("allow-except-quarantine")
+
+			target := fmt.Sprintf("%s.%s:%d", service.Name, service.Namespace, serverPort1)
+
+			By("Verifying an ordinary client connects.")
+			testCanConnectX(f, ns, "negated-client-ok", service, target, func(pod *v1.Pod) {}, func() {})
+
+			By("Verifying a quarantined client is denied.")
+			testCannotConnectX(f, ns, "negated-client-quarantined", service, target, func(pod *v1.Pod) {
+				pod.Labels["quarantine"] = "true"
+			})
+		})
+
+		It("should apply a network set too large for the here-doc path", func() {
+			const netCount = 4000
+
+			By("Building a GlobalNetworkSet with thousands of CIDRs.")
+			nets := make([]string, 0, netCount)
+			for i := 0; i < netCount; i++ {
+				nets = append(nets, fmt.Sprintf("  - 203.%d.%d.0/24", i/250, i%250))
+			}
+			manifest := fmt.Sprintf(`apiVersion: projectcalico.org/v3
+kind: GlobalNetworkSet
+metadata:
+  name: huge-netset
+  labels:
+    feed: huge
+spec:
+  nets:
+%s
+`,
+				strings.Join(nets, "\n"))
+			framework.Logf("Network set manifest is %d bytes", len(manifest))
+
+			By("Applying the manifest from a file in the calicoctl pod.")
+			err := calicoctl.ApplyFromFile(manifest)
+			Expect(err).NotTo(HaveOccurred())
+			defer calicoctl.DeleteGNS("huge-netset")
+
+			By("Verifying the resource round-trips with all its CIDRs.")
+			m := calicoctl.GetAsMap("globalnetworkset", "huge-netset", "")
+			spec, ok := m["spec"].(map[string]interface{})
+			Expect(ok).To(BeTrue(), "network set has no spec: %v", m)
+			Expect(spec["nets"]).To(HaveLen(netCount))
+		})
+
+		It("should need an explicit DNS allow for name-based connections under egress default-deny", func() {
+			ns := f.Namespace
+			const clientLabel = "egress-locked"
+			target := fmt.Sprintf("%s.%s:%d", service.Name, service.Namespace, serverPort1)
+			lockClient := func(pod *v1.Pod) {
+				pod.Labels[clientLabel] = "true"
+			}
+
+			By("Applying an egress default-deny to locked clients.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: egress-deny-no-dns
+spec:
+  order: 800
+  selector: %s == 'true'
+  types:
+  - Egress
+`,
+				clientLabel))
+			defer calicoctl.DeleteGNP("egress-deny-no-dns")
+
+			By("Allowing locked clients to reach the server, but not DNS.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-egress-to-server
+spec:
+  order: 500
+  selector: %s == 'true'
+  egress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      selector: pod-name == '%s'
+      ports:
+      - %d
+`,
+				clientLabel, podServer.Name, serverPort1))
+			defer calicoctl.DeleteGNP("allow-egress-to-server")
+
+			By("Verifying the name-based connection fails at resolution without a DNS allow.")
+			testCannotConnectX(f, ns, "dns-locked-client", service, target, lockClient)
+
+			By("Adding the DNS allow and verifying the same connection succeeds.")
+			calico.AllowDNSEgress(calicoctl, fmt.Sprintf("%s == 'true'", clientLabel))
+			defer calicoctl.DeleteGNP(calico.AllowDNSEgressName)
+			testCanConnectX(f, ns, "dns-allowed-client", service, target, lockClient, func() {})
+		})
+
+		It("should enforce DNS and egress policy for connections via an ExternalName service", func() {
+			ns := f.Namespace
+			const clientLabel = "extname-locked"
+			lockClient := func(pod *v1.Pod) {
+				pod.Labels[clientLabel] = "true"
+			}
+
+			By("Creating an ExternalName service aliasing the in-cluster server.")
+			// Pointing the CNAME at the backing service's cluster DNS name
+			// gives us a controllable, policy-visible host behind the alias.
+			extSvc, err := f.ClientSet.CoreV1().Services(ns.Name).Create(&v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "extname-server",
+				},
+				Spec: v1.ServiceSpec{
+					Type:         v1.ServiceTypeExternalName,
+					ExternalName: fmt.Sprintf("%s.%s.svc.cluster.local", service.Name, ns.Name),
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer f.ClientSet.CoreV1().Services(ns.Name).Delete(extSvc.Name, nil)
+
+			target := fmt.Sprintf("%s.%s:%d", extSvc.Name, ns.Name, serverPort1)
+
+			By("Verifying the ExternalName resolves and connects with no policy.")
+			testCanConnectX(f, ns, "extname-open-client", extSvc, target, lockClient, func() {})
+
+			By("Applying an egress default-deny with an allow to the resolved backend, but no DNS allow.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: extname-egress-deny
+spec:
+  order: 800
+  selector: %s == 'true'
+  types:
+  - Egress
+`,
+				clientLabel))
+			defer calicoctl.DeleteGNP("extname-egress-deny")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: extname-allow-backend
+spec:
+  order: 500
+  selector: %s == 'true'
+  egress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      selector: pod-name == '%s'
+      ports:
+      - %d
+`,
+				clientLabel, podServer.Name, serverPort1))
+			defer calicoctl.DeleteGNP("extname-allow-backend")
+
+			By("Verifying blocked DNS prevents resolving the ExternalName despite the backend allow.")
+			testCannotConnectX(f, ns, "extname-nodns-client", extSvc, target, lockClient)
+
+			By("Adding the DNS allow and verifying the ExternalName connection succeeds.")
+			calico.AllowDNSEgress(calicoctl, fmt.Sprintf("%s == 'true'", clientLabel))
+			defer calicoctl.DeleteGNP(calico.AllowDNSEgressName)
+			testCanConnectX(f, ns, "extname-dns-client", extSvc, target, lockClient, func() {})
+		})
+
+		It("should select egress destinations by service account across namespaces", func() {
+			ns := f.Namespace
+			const clientLabel = "sa-egress-locked"
+			lockClient := func(pod *v1.Pod) {
+				pod.Labels[clientLabel] = "true"
+			}
+
+			By("Creating a second namespace for the allowed server.")
+			nsB, err := f.CreateNamespace(f.BaseName+"-sa-b", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Creating the allowed and denied server service accounts.")
+			saAllowed := alp.CreateServiceAccount(f, "sa-egress-allowed", nsB.Name, map[string]string{"sa-access": "allowed"})
+			defer alp.DeleteServiceAccount(f, saAllowed)
+			saDenied := alp.CreateServiceAccount(f, "sa-egress-denied", ns.Name, map[string]string{"sa-access": "denied"})
+			defer alp.DeleteServiceAccount(f, saDenied)
+
+			By("Creating a server under each service account.")
+			podServerAllowed, serviceAllowed := createServerPodAndServiceX(f, nsB, "sa-server-allowed", []int{80},
+				func(pod *v1.Pod) {
+					pod.Spec.ServiceAccountName = saAllowed.Name
+				}, func(_ *v1.Service) {})
+			defer cleanupServerPodAndService(f, podServerAllowed, serviceAllowed)
+			podServerDenied, serviceDenied := createServerPodAndServiceX(f, ns, "sa-server-denied", []int{80},
+				func(pod *v1.Pod) {
+					pod.Spec.ServiceAccountName = saDenied.Name
+				}, func(_ *v1.Service) {})
+			defer cleanupServerPodAndService(f, podServerDenied, serviceDenied)
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, podServerAllowed))
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, podServerDenied))
+
+			By("Allowing client egress only to servers running as an allowed service account.")
+			// This is plain L4 enforcement keyed on the destination's service
+			// account; no Istio sidecar is involved, unlike the ALP tests.
+			calicoctl.SetEnv("ALPHA_FEATURES", "serviceaccounts")
+			err = calicoctl.ApplyWithBackoffError(0, fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: sa-egress-allow
+spec:
+  order: 500
+  selector: %s == 'true'
+  types:
+  - Egress
+  egress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      serviceAccounts:
+        selector: sa-access == "allowed"
+      ports:
+      - 80
+`,
+				clientLabel))
+			if err != nil {
+				framework.Skipf("serviceAccounts rule match not supported by this cluster, skipping: %v", err)
+			}
+			defer calicoctl.DeleteGNP("sa-egress-allow")
+			calico.AllowDNSEgress(calicoctl, fmt.Sprintf("%s == 'true'", clientLabel))
+			defer calicoctl.DeleteGNP(calico.AllowDNSEgressName)
+
+			By("Verifying the client can reach the server under the allowed service account.")
+			targetAllowed := fmt.Sprintf("%s.%s:%d", serviceAllowed.Name, nsB.Name, 80)
+			testCanConnectX(f, ns, "sa-client-ok", serviceAllowed, targetAllowed, lockClient, func() {})
+
+			By("Verifying the client cannot reach the server under the denied service account.")
+			targetDenied := fmt.Sprintf("%s.%s:%d", serviceDenied.Name, ns.Name, 80)
+			testCannotConnectX(f, ns, "sa-client-blocked", serviceDenied, targetDenied, lockClient)
+		})
+
+		It("should isolate a namespace except for DNS under the canonical default deny", func() {
+			By("Applying the canonical default deny to the test namespace.")
+			cleanupDefaultDeny := calico.ApplyNamespaceDefaultDeny(calicoctl, f.Namespace.Name)
+			defer cleanupDefaultDeny()
+
+			By("Creating a client pod in the locked-down namespace.")
+			clientPod := createExecPodOrFail(f, &source{"", "ns-deny-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+
+			By("Verifying the client cannot reach the server in its own namespace.")
+			target := fmt.Sprintf("%s.%s:%d", service.Name, service.Namespace, serverPort1)
+			Consistently(func() error {
+				_, err := framework.RunHostCmd(f.Namespace.Name, clientPod.Name,
+					fmt.Sprintf("wget -q -T 3 -t 1 -O - http://%s", target))
+				return err
+			}, 15*time.Second, 5*time.Second).Should(HaveOccurred(),
+				"client reached the server despite the namespace default deny")
+
+			By("Verifying DNS resolution still works from the locked-down namespace.")
+			Eventually(func() error {
+				_, err := framework.RunHostCmd(f.Namespace.Name, clientPod.Name,
+					fmt.Sprintf("nslookup %s.%s", service.Name, service.Namespace))
+				return err
+			}, 30*time.Second, 5*time.Second).ShouldNot(HaveOccurred(),
+				"DNS resolution broke under the namespace default deny")
+		})
+
+		It("should reject a policy with a syntactically invalid selector", func() {
+			badSelector := "has(pod-name && role == "
+
+			By("Catching the invalid selector client-side with ValidateSelector.")
+			err := calico.ValidateSelector(badSelector)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(badSelector),
+				"the validation error should name the offending selector")
+
+			By("Verifying a known-good selector passes the same check.")
+			Expect(calico.ValidateSelector("has(pod-name) && role == 'db'")).NotTo(HaveOccurred())
+
+			By("Verifying the datastore also rejects the invalid selector.")
+			// Zero backoff so the rejection fails the apply job on the first
+			// attempt; the job error doesn't carry calicoctl's message, which
+			// is why the client-side check above matters.
+			err = calicoctl.ApplyWithBackoffError(0, fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: invalid-selector-gnp
+spec:
+  order: 500
+  selector: "%s"
+  types:
+  - Ingress
+`,
+				badSelector))
+			Expect(err).To(HaveOccurred(),
+				"a GlobalNetworkPolicy with an invalid selector was accepted")
+		})
+
+		It("should enforce rules matching on the client source port", func() {
+			serverPod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Get(podServer.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			target := serverPod.Status.PodIP
+
+			By("Allowing ingress to the server only from source ports 30000:30100.")
+			policyStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: source-port-allow
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Allow
+    protocol: TCP
+    source:
+      ports:
+      - 30000:30100
+`,
+				podServer.Name)
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("source-port-allow")
+
+			By("Verifying a client bound to an allowed source port can connect.")
+			out, err := connectFromSourcePort(f, target, serverPort1, 30050)
+			Expect(err).NotTo(HaveOccurred(), "connection from allowed source port failed: %s", out)
+
+			By("Verifying a client bound to a source port outside the range cannot connect.")
+			out, err = connectFromSourcePort(f, target, serverPort1, 31050)
+			Expect(err).To(HaveOccurred(), "connection from denied source port unexpectedly succeeded: %s", out)
+		})
+
+		It("should block egress to CIDRs listed in a threat-feed GlobalNetworkSet", func() {
+			ns := f.Namespace
+			clientName := "netset-client"
+
+			By("Creating two destination server pods with services.")
+			podServerA, serviceA := createServerPodAndService(f, ns, "netset-server-a", []int{serverPort1})
+			defer cleanupServerPodAndService(f, podServerA, serviceA)
+			podServerB, serviceB := createServerPodAndService(f, ns, "netset-server-b", []int{serverPort1})
+			defer cleanupServerPodAndService(f, podServerB, serviceB)
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, podServerA))
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, podServerB))
+			podServerA, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(podServerA.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			podServerB, err = f.ClientSet.CoreV1().Pods(ns.Name).Get(podServerB.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Listing both destinations in a malicious network set.")
+			calicoctl.ApplyGlobalNetworkSet("threat-feed", map[string]string{"threat-feed": "malicious"},
+				[]string{podServerA.Status.PodIP + "/32", podServerB.Status.PodIP + "/32"})
+			defer calicoctl.DeleteGNS("threat-feed")
+
+			By("Denying client egress to the network set.")
+			policyStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: deny-threat-feed
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Egress
+  egress:
+  - action: Deny
+    destination:
+      selector: threat-feed == "malicious"
+  - action: Allow
+`,
+				clientName)
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("deny-threat-feed")
+
+			By("Verifying the client cannot reach either listed destination.")
+			testCannotConnect(f, ns, clientName, serviceA, serverPort1)
+			testCannotConnect(f, ns, clientName, serviceB, serverPort1)
+
+			By("Removing one destination from the network set.")
+			calicoctl.ApplyGlobalNetworkSet("threat-feed", map[string]string{"threat-feed": "malicious"},
+				[]string{podServerA.Status.PodIP + "/32"})
+
+			By("Verifying the delisted destination becomes reachable while the other stays blocked.")
+			testCanConnect(f, ns, clientName, serviceB, serverPort1)
+			testCannotConnect(f, ns, clientName, serviceA, serverPort1)
+		})
+
+		It("should program a bulk network set update within a bounded time", func() {
+			const (
+				netCount             = 2000
+				enforcementThreshold = 2 * time.Minute
+			)
+			ns := f.Namespace
+
+			By("Creating a host-networked target that owns the probed address.")
+			node := framework.GetReadySchedulableNodesOrDie(f.ClientSet).Items[0]
+			jig := framework.NewServiceTestJig(f.ClientSet, "bulk-netset")
+			targetPod := jig.LaunchEchoserverPodOnNode(f, node.Name, "bulk-netset-target", true)
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(targetPod.Name, nil); err != nil {
+					framework.Logf("unable to cleanup pod %v: %v", targetPod.Name, err)
+				}
+			}()
+			target := fmt.Sprintf("%s:8091", targetPod.Status.PodIP)
+
+			By("Creating a client whose egress is only allowed to the network set.")
+			clientPod := createExecPodOrFail(f, &source{"", "bulk-netset-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+			canConnect := func() bool {
+				_, err := framework.RunHostCmd(ns.Name, clientPod.Name,
+					fmt.Sprintf("wget -q -T 3 -t 1 -O - http://%s/hostName", target))
+				return err == nil
+			}
+
+			// buildNetset renders a GlobalNetworkSet with netCount synthetic
+			// CIDRs drawn from the given offset, so two offsets give a bulk
+			// delta, plus optionally a /32 covering the probe target.
+			buildNetset := func(offset int, includeTarget bool) string {
+				nets := make([]string, 0, netCount+1)
+				for i := offset; i < offset+netCount; i++ {
+					nets = append(nets, fmt.Sprintf("  - 203.%d.%d.0/24", i/250, i%250))
+				}
+				if includeTarget {
+					nets = append(nets, fmt.Sprintf("  - %s/32", targetPod.Status.PodIP))
+				}
+				return fmt.Sprintf(`apiVersion: projectcalico.org/v3
+kind: GlobalNetworkSet
+metadata:
+  name: bulk-netset
+  labels:
+    feed: bulk
+spec:
+  nets:
+%s
+`,
+					strings.Join(nets, "\n"))
+			}
+
+			By("Applying the initial network set, target address included.")
+			framework.ExpectNoError(calicoctl.ApplyFromFile(buildNetset(0, true)))
+			defer calicoctl.DeleteGNS("bulk-netset")
+
+			calicoctl.Apply(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: bulk-netset-allow
+spec:
+  order: 200
+  selector: pod-name == 'bulk-netset-client'
+  types:
+  - Egress
+  egress:
+  - action: Allow
+    destination:
+      selector: feed == "bulk"
+`)
+			defer calicoctl.DeleteGNP("bulk-netset-allow")
+
+			By("Waiting for the initial allow to be enforced.")
+			Eventually(canConnect, 2*time.Minute, 5*time.Second).Should(BeTrue(),
+				"client never reached the target while its address was in the network set")
+
+			By("Swapping the bulk of the CIDRs and dropping the target address.")
+			latency, err := calicoctl.ApplyAndMeasureEnforcement(buildNetset(netCount, false),
+				func() bool { return !canConnect() }, enforcementThreshold)
+			framework.Logf("Bulk network set update enforced after %v", latency)
+			Expect(err).NotTo(HaveOccurred(),
+				"removal of the target CIDR was not enforced within %v", enforcementThreshold)
+		})
+
+		It("should enforce per-backend policy for a multi-backend service", func() {
+			ns := f.Namespace
+			const backendCount = 3
+
+			// Newer clusters publish backends as EndpointSlices as well as
+			// legacy Endpoints; policy enforcement and service programming
+			// must agree on the backend set either way.  The assertions below
+			// are representation-agnostic, so just record which source this
+			// cluster serves for comparison across runs.
+			if groups, err := f.ClientSet.Discovery().ServerGroups(); err == nil {
+				hasSlices := false
+				for _, g := range groups.Groups {
+					if g.Name == "discovery.k8s.io" {
+						hasSlices = true
+					}
+				}
+				framework.Logf("Cluster serves the EndpointSlice API: %v", hasSlices)
+			}
+
+			By("Creating several backends behind one shared service.")
+			var backendPods []*v1.Pod
+			var backendSvcs []*v1.Service
+			for i := 0; i < backendCount; i++ {
+				pod, svc := createServerPodAndServiceX(f, ns, fmt.Sprintf("slice-backend-%d", i), []int{80},
+					func(pod *v1.Pod) {
+						pod.Labels["multi-backend"] = "true"
+					}, func(_ *v1.Service) {})
+				defer cleanupServerPodAndService(f, pod, svc)
+				framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, pod))
+				backendPods = append(backendPods, pod)
+				backendSvcs = append(backendSvcs, svc)
+			}
+			sharedSvc, err := f.ClientSet.CoreV1().Services(ns.Name).Create(&v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "multi-backend-svc",
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{
+						Port:       80,
+						TargetPort: intstr.FromInt(80),
+					}},
+					Selector: map[string]string{
+						"multi-backend": "true",
+					},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.CoreV1().Services(ns.Name).Delete(sharedSvc.Name, nil); err != nil {
+					framework.Logf("unable to cleanup svc %v: %v", sharedSvc.Name, err)
+				}
+			}()
+			framework.ExpectNoError(framework.WaitForServiceEndpointsNum(
+				f.ClientSet, ns.Name, sharedSvc.Name, backendCount, time.Second, 2*time.Minute),
+				"the shared service never advertised all of its backends")
+
+			By("Denying ingress to one backend only.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: deny-one-backend
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				backendPods[1].Name))
+			defer calicoctl.DeleteGNP("deny-one-backend")
+
+			By("Probing each backend individually.")
+			testCanConnect(f, ns, "backend-probe-0", backendSvcs[0], 80)
+			testCannotConnect(f, ns, "backend-probe-1", backendSvcs[1], 80)
+			testCanConnect(f, ns, "backend-probe-2", backendSvcs[2], 80)
+
+			By("Verifying the shared service still serves from the allowed backends.")
+			clientPod := createExecPodOrFail(f, &source{"", "multi-backend-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+			// Load balancing may pick the denied backend on any given attempt,
+			// so let the probe retry until it lands on an allowed one.
+			Eventually(func() error {
+				_, err := framework.RunHostCmd(ns.Name, clientPod.Name,
+					fmt.Sprintf("wget -q -T 3 -t 1 -O - http://%s.%s:80", sharedSvc.Name, ns.Name))
+				return err
+			}, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"the shared service stopped serving entirely when one backend was denied")
+		})
+
+		It("should serve and enforce policy for a recreated service reusing its clusterIP", func() {
+			ns := f.Namespace
+
+			By("Creating the original backend and service.")
+			oldPod, oldSvc := createServerPodAndService(f, ns, "reuse-server-old", []int{80})
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, oldPod))
+			testCanConnect(f, ns, "reuse-baseline-client", oldSvc, 80)
+			oldSvc, err := f.ClientSet.CoreV1().Services(ns.Name).Get(oldSvc.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			clusterIP := oldSvc.Spec.ClusterIP
+
+			By("Deleting the original backend and service.")
+			cleanupServerPodAndService(f, oldPod, oldSvc)
+
+			By(fmt.Sprintf("Recreating the service on the same clusterIP %s with a new backend.", clusterIP))
+			newPod, newSvc := createServerPodAndServiceX(f, ns, "reuse-server-new", []int{80},
+				func(pod *v1.Pod) {}, func(svc *v1.Service) {
+					svc.Spec.ClusterIP = clusterIP
+				})
+			defer cleanupServerPodAndService(f, newPod, newSvc)
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, newPod))
+
+			// On an IPVS cluster, wait for kube-proxy to reprogram the reused
+			// virtual server before probing; on other proxy modes the table
+			// isn't readable and the probes below carry the whole check.
+			node := framework.GetReadySchedulableNodesOrDie(f.ClientSet).Items[0]
+			if err := calico.WaitForIPVSService(&node, clusterIP, 80, true, 2*time.Minute); err != nil {
+				framework.Logf("Skipping the IPVS table wait: %v", err)
+			}
+
+			By("Verifying the reused clusterIP reaches the new backend with no stale state.")
+			testCanConnect(f, ns, "reuse-client", newSvc, 80)
+
+			By("Verifying policy applies to the new backend behind the reused clusterIP.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: reuse-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				newPod.Name))
+			defer calicoctl.DeleteGNP("reuse-deny")
+			testCannotConnect(f, ns, "reuse-denied-client", newSvc, 80)
+		})
+
+		It("should keep kubelet liveness and readiness probes working under default deny", func() {
+			ns := f.Namespace
+
+			By("Creating a server pod with HTTP liveness and readiness probes.")
+			probedPod, probedSvc := createServerPodAndServiceX(f, ns, "probed-server", []int{80},
+				func(pod *v1.Pod) {
+					// The readiness probe comes with the helper; add a
+					// liveness probe so a blocked kubelet path shows up as
+					// container restarts too, not just unreadiness.
+					pod.Spec.Containers[0].LivenessProbe = &v1.Probe{
+						Handler: v1.Handler{
+							HTTPGet: &v1.HTTPGetAction{
+								Path: "/",
+								Port: intstr.IntOrString{
+									IntVal: int32(80),
+								},
+								Scheme: v1.URISchemeHTTP,
+							},
+						},
+					}
+				}, func(_ *v1.Service) {})
+			defer cleanupServerPodAndService(f, probedPod, probedSvc)
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, probedPod))
+
+			By("Applying an ingress and egress default deny to the pod.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: probed-default-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  - Egress
+`,
+				probedPod.Name))
+			defer calicoctl.DeleteGNP("probed-default-deny")
+
+			By("Verifying the deny is actually enforced for workload traffic.")
+			testCannotConnect(f, ns, "probed-deny-client", probedSvc, 80)
+
+			By("Verifying the pod stays Ready with no restarts while the deny is in force.")
+			// The kubelet probes the pod over the host-to-workload path, which
+			// felix always allows regardless of workload policy; a failure
+			// here means that failsafe path is broken.  The window covers
+			// several probe periods, long enough for a blocked liveness probe
+			// to trigger a restart.
+			Consistently(func() error {
+				pod, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(probedPod.Name, metav1.GetOptions{})
+				if err != nil {
+					return err
+				}
+				for _, cs := range pod.Status.ContainerStatuses {
+					if cs.RestartCount > 0 {
+						return fmt.Errorf("container %s restarted %d times; the liveness probe is being denied",
+							cs.Name, cs.RestartCount)
+					}
+				}
+				for _, cond := range pod.Status.Conditions {
+					if cond.Type == v1.PodReady && cond.Status != v1.ConditionTrue {
+						return fmt.Errorf("pod went unready: %s", cond.Message)
+					}
+				}
+				return nil
+			}, 90*time.Second, 10*time.Second).Should(Succeed(),
+				"kubelet probes must keep passing under a workload default deny")
+		})
+
+		It("should handle concurrent connections consistently under allow and deny", func() {
+			const concurrency = 25
+			target := fmt.Sprintf("%s.%s:%d", service.Name, service.Namespace, serverPort1)
+
+			By("Creating a client to drive the concurrent probes.")
+			clientPod := createExecPodOrFail(f, &source{"", "concurrent-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+
+			By(fmt.Sprintf("Opening %d simultaneous connections with no policy applied.", concurrency))
+			successes, distribution, err := calico.ConcurrentProbe(f, clientPod, target, concurrency)
+			Expect(err).NotTo(HaveOccurred())
+			framework.Logf("Concurrent probe under allow: %d/%d succeeded, distribution %v",
+				successes, concurrency, distribution)
+			Expect(successes).To(Equal(concurrency),
+				"connections were spuriously dropped with no deny in place")
+
+			By("Denying ingress to the server.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: concurrent-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				podServer.Name))
+			defer calicoctl.DeleteGNP("concurrent-deny")
+
+			By(fmt.Sprintf("Verifying all %d concurrent connections are blocked once the deny is programmed.", concurrency))
+			Eventually(func() (int, error) {
+				successes, distribution, err := calico.ConcurrentProbe(f, clientPod, target, concurrency)
+				framework.Logf("Concurrent probe under deny: %d/%d succeeded, distribution %v",
+					successes, concurrency, distribution)
+				return successes, err
+			}, 2*time.Minute, 10*time.Second).Should(BeZero(),
+				"some concurrent connections slipped past the deny")
+		})
+
+		It("should apply overlapping rules within one policy first-match-wins", func() {
+			ns := f.Namespace
+			serverSelector := fmt.Sprintf("pod-name == '%s'", podServer.Name)
+			// Both rules match exactly the same traffic; only their order
+			// inside the policy decides the verdict.
+			rulePair := func(first, second string) []calico.GNPRule {
+				pair := make([]calico.GNPRule, 0, 2)
+				for _, action := range []string{first, second} {
+					pair = append(pair, calico.GNPRule{
+						Action:      action,
+						Protocol:    "TCP",
+						SrcSelector: "pod-name == 'ordered-client'",
+						DstPorts:    []int{serverPort1},
+					})
+				}
+				return pair
+			}
+
+			By("Applying a policy with an allow ahead of a deny for the same port.")
+			calicoctl.Apply(calico.RenderGNPWithOrderedRules("ordered-rules", 200, serverSelector,
+				rulePair("Allow", "Deny")))
+			defer calicoctl.DeleteGNP("ordered-rules")
+			testCanConnect(f, ns, "ordered-client", service, serverPort1)
+
+			By("Reordering so the deny comes first and verifying it now wins.")
+			calicoctl.Apply(calico.RenderGNPWithOrderedRules("ordered-rules", 200, serverSelector,
+				rulePair("Deny", "Allow")))
+			testCannotConnect(f, ns, "ordered-client", service, serverPort1)
+		})
+
+		It("should evaluate selectors correctly against a pod with no labels", func() {
+			ns := f.Namespace
+
+			By("Creating a server pod with no labels at all.")
+			// The usual helpers always attach a pod-name label, which is
+			// exactly what this test must avoid; build the pod by hand and
+			// probe it by IP since no service can select it either.
+			barePod, err := f.ClientSet.CoreV1().Pods(ns.Name).Create(&v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "bare-server",
+				},
+				Spec: v1.PodSpec{
+					NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+					Containers: []v1.Container{
+						{
+							Name:  "bare-server-container",
+							Image: imageutils.GetE2EImage(imageutils.Porter),
+							Env: []v1.EnvVar{
+								{
+									Name:  "SERVE_PORT_80",
+									Value: "foo",
+								},
+							},
+							Ports: []v1.ContainerPort{{ContainerPort: 80}},
+						},
+					},
+					RestartPolicy: v1.RestartPolicyNever,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(barePod.Name, nil); err != nil {
+					framework.Logf("unable to cleanup pod %v: %v", barePod.Name, err)
+				}
+			}()
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, barePod))
+			barePod, err = f.ClientSet.CoreV1().Pods(ns.Name).Get(barePod.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			target := fmt.Sprintf("%s:80", barePod.Status.PodIP)
+
+			clientPod := createExecPodOrFail(f, &source{"", "bare-probe-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+			connect := func() error {
+				_, err := framework.RunHostCmd(ns.Name, clientPod.Name,
+					fmt.Sprintf("wget -q -T 3 -t 1 -O - http://%s", target))
+				return err
+			}
+			Eventually(connect, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"baseline connectivity to the label-less pod never came up")
+
+			By("Applying a has(pod-name) deny and verifying the label-less pod is unaffected.")
+			calicoctl.Apply(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: haskey-deny
+spec:
+  order: 200
+  selector: has(pod-name)
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`)
+			defer calicoctl.DeleteGNP("haskey-deny")
+			Consistently(connect, 20*time.Second, 5*time.Second).Should(Succeed(),
+				"a has(pod-name) selector must not match a pod with no labels")
+
+			By("Applying an all() default deny in the namespace and verifying it does apply.")
+			// A namespaced policy keeps the all() blast radius inside the
+			// test namespace.
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: NetworkPolicy
+metadata:
+  name: all-deny
+  namespace: %s
+spec:
+  order: 300
+  selector: all()
+  types:
+  - Ingress
+`,
+				ns.Name))
+			defer calicoctl.DeleteNP(ns.Name, "all-deny")
+			Eventually(connect, 2*time.Minute, 5*time.Second).ShouldNot(Succeed(),
+				"an all() selector must match a pod with no labels")
+		})
+
+		It("should keep enforcing policy for a pod rescheduled off a cordoned node [Disruptive]", func() {
+			ns := f.Namespace
+
+			nodes := framework.GetReadySchedulableNodesOrDie(f.ClientSet)
+			if len(nodes.Items) < 2 {
+				framework.Skipf("Less than two schedulable nodes exist, can't reschedule the server elsewhere.")
+			}
+
+			By("Creating the server and applying a deny policy to it.")
+			serverPod, serverSvc := createServerPodAndService(f, ns, "cordon-server", []int{80})
+			defer cleanupServerPodAndService(f, serverPod, serverSvc)
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, serverPod))
+			serverPod, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(serverPod.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			originalNode := serverPod.Spec.NodeName
+
+			testCanConnect(f, ns, "cordon-baseline-client", serverSvc, 80)
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: cordon-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				serverPod.Name))
+			denyDeleted := false
+			defer func() {
+				if !denyDeleted {
+					calicoctl.DeleteGNP("cordon-deny")
+				}
+			}()
+			testCannotConnect(f, ns, "cordon-denied-client", serverSvc, 80)
+
+			By(fmt.Sprintf("Cordoning node %v and deleting the server pod.", originalNode))
+			// This simulates the interesting part of a reboot or drain: the
+			// pod leaves the node and comes back somewhere else, so felix on
+			// the new node has to program policy for it from scratch.
+			_, err = framework.RunKubectl("cordon", originalNode)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if _, err := framework.RunKubectl("uncordon", originalNode); err != nil {
+					framework.Failf("unable to uncordon node %v: %v", originalNode, err)
+				}
+			}()
+			framework.ExpectNoError(f.ClientSet.CoreV1().Pods(ns.Name).Delete(serverPod.Name, metav1.NewDeleteOptions(0)))
+			framework.ExpectNoError(framework.WaitForPodToDisappear(f.ClientSet, ns.Name, serverPod.Name,
+				labels.Everything(), framework.Poll, 2*time.Minute))
+
+			By("Recreating the server pod so it lands on another node.")
+			newPod, err := f.ClientSet.CoreV1().Pods(ns.Name).Create(&v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: serverPod.Name,
+					Labels: map[string]string{
+						"pod-name": serverPod.Name,
+					},
+				},
+				Spec: v1.PodSpec{
+					NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+					Containers: []v1.Container{
+						{
+							Name:  fmt.Sprintf("%s-container-80", serverPod.Name),
+							Image: imageutils.GetE2EImage(imageutils.Porter),
+							Env: []v1.EnvVar{
+								{
+									Name:  "SERVE_PORT_80",
+									Value: "foo",
+								},
+							},
+							Ports: []v1.ContainerPort{{ContainerPort: 80}},
+						},
+					},
+					RestartPolicy: v1.RestartPolicyNever,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, newPod))
+			newPod, err = f.ClientSet.CoreV1().Pods(ns.Name).Get(newPod.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(newPod.Spec.NodeName).NotTo(Equal(originalNode),
+				"the rescheduled server should not land on the cordoned node")
+
+			By("Verifying the deny followed the pod to its new node.")
+			testCannotConnect(f, ns, "cordon-moved-denied-client", serverSvc, 80)
+
+			By("Removing the deny and verifying connectivity to the new node returns.")
+			calicoctl.DeleteGNP("cordon-deny")
+			denyDeleted = true
+			testCanConnect(f, ns, "cordon-moved-client", serverSvc, 80)
+		})
+
+		It("should drop denied traffic rather than reject it", func() {
+			ns := f.Namespace
+			const probeTimeout = 5 * time.Second
+
+			serverPod, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(podServer.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			serverIP := serverPod.Status.PodIP
+
+			clientPod := createExecPodOrFail(f, &source{"", "outcome-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+
+			By("Classifying a connection to the open port as connected.")
+			Eventually(func() (string, error) {
+				return calico.ProbeConnectionOutcome(f, clientPod, serverIP, serverPort1, probeTimeout)
+			}, 2*time.Minute, 5*time.Second).Should(Equal(calico.ProbeOutcomeConnected))
+
+			By("Classifying a connection to a port with no listener as refused.")
+			// No policy is involved here; the server's kernel answers with a
+			// RST, which is what an active reject looks like to the client.
+			outcome, err := calico.ProbeConnectionOutcome(f, clientPod, serverIP, serverPort1+1, probeTimeout)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(outcome).To(Equal(calico.ProbeOutcomeRefused))
+
+			By("Applying a deny and verifying the denied connection times out instead.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: outcome-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				podServer.Name))
+			defer calicoctl.DeleteGNP("outcome-deny")
+			Eventually(func() (string, error) {
+				return calico.ProbeConnectionOutcome(f, clientPod, serverIP, serverPort1, probeTimeout)
+			}, 2*time.Minute, 10*time.Second).Should(Equal(calico.ProbeOutcomeTimeout),
+				"a Calico Deny should silently drop, leaving the client to hang until its timeout")
+		})
+
+		It("should apply policy to service backends rather than service VIPs", func() {
+			ns := f.Namespace
+
+			By("Creating a backend pod with two services selecting it.")
+			backendPod, svcA := createServerPodAndService(f, ns, "shared-backend", []int{80})
+			defer cleanupServerPodAndService(f, backendPod, svcA)
+			framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, backendPod))
+			backendPod, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(backendPod.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			svcB, err := f.ClientSet.CoreV1().Services(ns.Name).Create(&v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "svc-shared-backend-b",
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{
+						Port:       80,
+						TargetPort: intstr.FromInt(80),
+					}},
+					Selector: map[string]string{
+						"pod-name": backendPod.Name,
+					},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.CoreV1().Services(ns.Name).Delete(svcB.Name, nil); err != nil {
+					framework.Logf("unable to cleanup svc %v: %v", svcB.Name, err)
+				}
+			}()
+			svcA, err = f.ClientSet.CoreV1().Services(ns.Name).Get(svcA.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			clientPod := createExecPodOrFail(f, &source{"", "vip-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+			connectTo := func(ip string) func() error {
+				return func() error {
+					_, err := framework.RunHostCmd(ns.Name, clientPod.Name,
+						fmt.Sprintf("wget -q -T 3 -t 1 -O - http://%s:80", ip))
+					return err
+				}
+			}
+			targets := map[string]string{
+				"service A VIP":   svcA.Spec.ClusterIP,
+				"service B VIP":   svcB.Spec.ClusterIP,
+				"pod IP directly": backendPod.Status.PodIP,
+			}
+
+			By("Verifying the backend is reachable via both VIPs and its pod IP.")
+			for name, ip := range targets {
+				Eventually(connectTo(ip), 2*time.Minute, 5*time.Second).Should(Succeed(),
+					"baseline connectivity via %v never came up", name)
+			}
+
+			By("Allowing client egress only to service A's VIP and verifying nothing matches.")
+			// kube-proxy rewrites the VIP to a backend pod IP before felix
+			// evaluates the client's egress rules, so a rule written against
+			// the VIP silently matches no traffic at all — every path below
+			// is expected to be blocked, including the "allowed" VIP.
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: vip-allow
+spec:
+  order: 200
+  selector: pod-name == 'vip-client'
+  types:
+  - Egress
+  egress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      nets:
+      - %s/32
+`,
+				svcA.Spec.ClusterIP))
+			defer calicoctl.DeleteGNP("vip-allow")
+			for name, ip := range targets {
+				Eventually(connectTo(ip), 2*time.Minute, 5*time.Second).ShouldNot(Succeed(),
+					"a VIP-based allow should not match post-DNAT traffic via %v", name)
+			}
+
+			By("Rewriting the allow against the backend pod and verifying every path works.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: vip-allow
+spec:
+  order: 200
+  selector: pod-name == 'vip-client'
+  types:
+  - Egress
+  egress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      selector: pod-name == '%s'
+`,
+				backendPod.Name))
+			for name, ip := range targets {
+				Eventually(connectTo(ip), 2*time.Minute, 5*time.Second).Should(Succeed(),
+					"an endpoint-based allow should cover access via %v", name)
+			}
+		})
+
+		It("should need the DNS allow ordered ahead of a global egress deny", func() {
+			ns := f.Namespace
+			const clientSelector = "pod-name == 'dns-order-client'"
+
+			clientPod := createExecPodOrFail(f, &source{"", "dns-order-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+
+			resolve := func() error {
+				_, err := framework.RunHostCmd(ns.Name, clientPod.Name,
+					fmt.Sprintf("nslookup %s.%s", service.Name, service.Namespace))
+				return err
+			}
+			Eventually(resolve, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"baseline DNS resolution never came up")
+
+			By("Applying a global egress default deny to the locked client.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: egress-lockdown-800
+spec:
+  order: 800
+  selector: %s
+  types:
+  - Egress
+  egress:
+  - action: Deny
+`,
+				clientSelector))
+			defer calicoctl.DeleteGNP("egress-lockdown-800")
+
+			// A namespaced DNS allow rendered at the given order; the rules
+			// mirror calico.AllowDNSEgress.
+			dnsAllow := func(order int) string {
+				return fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: NetworkPolicy
+metadata:
+  name: allow-dns-ordered
+  namespace: %s
+spec:
+  order: %d
+  selector: %s
+  egress:
+  - action: Allow
+    protocol: UDP
+    destination:
+      selector: projectcalico.org/namespace == "kube-system" && k8s-app == "kube-dns"
+      ports:
+      - 53
+  - action: Allow
+    protocol: TCP
+    destination:
+      selector: projectcalico.org/namespace == "kube-system" && k8s-app == "kube-dns"
+      ports:
+      - 53
+`,
+					ns.Name, order, clientSelector)
+			}
+
+			By("Adding the DNS allow ordered after the deny and verifying it is dead policy.")
+			// The explicit Deny at order 800 matches first, so the allow at
+			// 900 is never evaluated — the common misconfiguration this test
+			// encodes.
+			calicoctl.Apply(dnsAllow(900))
+			defer calicoctl.DeleteNP(ns.Name, "allow-dns-ordered")
+			Eventually(resolve, 2*time.Minute, 5*time.Second).ShouldNot(Succeed(),
+				"the egress deny was never enforced")
+			Consistently(resolve, 20*time.Second, 5*time.Second).ShouldNot(Succeed(),
+				"a DNS allow ordered after the deny should have no effect")
+
+			By("Reordering the DNS allow ahead of the deny and verifying resolution returns.")
+			calicoctl.Apply(dnsAllow(400))
+			Eventually(resolve, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"a DNS allow ordered before the deny should restore resolution")
+		})
+
+		It("should enforce a namespace-scoped allow for probes from multiple namespaces", func() {
+			nsA := f.Namespace
+			nsB, err := f.CreateNamespace("ns-probe-b", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			target := fmt.Sprintf("%s.%s:80", service.Name, service.Namespace)
+
+			By("Verifying the server is reachable from both namespaces with no policy.")
+			calico.ProbeFromNamespaces(f, []*v1.Namespace{nsA, nsB}, target,
+				map[string]calico.Reachability{
+					nsA.Name: calico.Reachable,
+					nsB.Name: calico.Reachable,
+				})
+
+			By("Allowing ingress to the server only from its own namespace.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: ns-probe-allow
+spec:
+  order: 500
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Allow
+    source:
+      selector: projectcalico.org/namespace == "%s"
+`,
+				podServer.Name, nsA.Name))
+			defer calicoctl.DeleteGNP("ns-probe-allow")
+
+			By("Verifying each namespace sees its expected reachability.")
+			calico.ProbeFromNamespaces(f, []*v1.Namespace{nsA, nsB}, target,
+				map[string]calico.Reachability{
+					nsA.Name: calico.Reachable,
+					nsB.Name: calico.Unreachable,
+				})
+		})
+
+		It("should enforce each policy replacement atomically during allow/deny flips", func() {
+			ns := f.Namespace
+			const probeTimeout = 2 * time.Second
+			// How long felix is given to converge after each replacement;
+			// probes taken while a change may still be programming are not
+			// assessed.
+			const grace = 10 * time.Second
+
+			clientPod := createExecPodOrFail(f, &source{"", "flip-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+
+			flipPolicy := func(action string) string {
+				return fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: flip-policy
+spec:
+  order: 400
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: %s
+`,
+					podServer.Name, action)
+			}
+
+			By("Applying the policy in its allow form and waiting for the baseline.")
+			calicoctl.Apply(flipPolicy("Allow"))
+			defer calicoctl.DeleteGNP("flip-policy")
+			probe := func() bool {
+				_, err := framework.RunHostCmd(ns.Name, clientPod.Name,
+					fmt.Sprintf("wget -q -T %d -t 1 -O /dev/null http://%s:80", int(probeTimeout.Seconds()), service.Spec.ClusterIP))
+				return err == nil
+			}
+			Eventually(probe, 2*time.Minute, 5*time.Second).Should(BeTrue(),
+				"the client should connect under the initial allow")
+
+			By("Probing continuously while flipping the policy between allow and deny.")
+			type sample struct {
+				when      time.Time
+				connected bool
+			}
+			type transition struct {
+				when   time.Time
+				action string
+			}
+			var (
+				mu      sync.Mutex
+				samples []sample
+			)
+			stop := make(chan struct{})
+			proberDone := make(chan struct{})
+			go func() {
+				defer close(proberDone)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					start := time.Now()
+					connected := probe()
+					mu.Lock()
+					samples = append(samples, sample{start, connected})
+					mu.Unlock()
+					time.Sleep(time.Second)
+				}
+			}()
+
+			// Timestamps are taken after each apply returns, i.e. once the
+			// change has committed to the datastore.
+			transitions := []transition{{time.Now(), "Allow"}}
+			for _, action := range []string{"Deny", "Allow", "Deny", "Allow", "Deny"} {
+				calicoctl.Apply(flipPolicy(action))
+				transitions = append(transitions, transition{time.Now(), action})
+				time.Sleep(15 * time.Second)
+			}
+			close(stop)
+			<-proberDone
+
+			By("Checking no assessable probe violated the policy in effect.")
+			assessed := 0
+			var violations []string
+			for _, s := range samples {
+				// The action stably in effect for this probe: the last
+				// transition at least grace before the probe started, with
+				// no further transition before the probe could finish.
+				expected := ""
+				inFlux := false
+				for _, t := range transitions {
+					if !t.when.After(s.when.Add(-grace)) {
+						expected = t.action
+					} else if t.when.Before(s.when.Add(probeTimeout)) {
+						inFlux = true
+					}
+				}
+				if expected == "" || inFlux {
+					continue
+				}
+				assessed++
+				if (expected == "Allow") != s.connected {
+					violations = append(violations, fmt.Sprintf(
+						"probe at %v connected=%v while the policy had been %s for over %v",
+						s.when.Format(time.RFC3339), s.connected, expected, grace))
+				}
+			}
+			framework.Logf("Assessed %d of %d probes across %d policy replacements",
+				assessed, len(samples), len(transitions)-1)
+			Expect(assessed).NotTo(BeZero(), "the probe loop produced no assessable samples")
+			Expect(violations).To(BeEmpty(),
+				"policy replacements must never be observed partially applied: %v", violations)
+		})
+
+		It("should actively refuse connections matched by a Reject rule", func() {
+			ns := f.Namespace
+			const probeTimeout = 5 * time.Second
+
+			serverPod, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(podServer.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			serverIP := serverPod.Status.PodIP
+
+			clientPod := createExecPodOrFail(f, &source{"", "reject-client", false})
+			defer cleanupExecPodOrFail(f, clientPod)
+
+			By("Verifying the client connects before any policy.")
+			Eventually(func() (string, error) {
+				return calico.ProbeConnectionOutcome(f, clientPod, serverIP, serverPort1, probeTimeout)
+			}, 2*time.Minute, 5*time.Second).Should(Equal(calico.ProbeOutcomeConnected))
+
+			By("Applying a Reject rule, or skipping if the datastore refuses it.")
+			rejectYaml := calico.RenderGNPWithOrderedRules("reject-policy", 200,
+				fmt.Sprintf("pod-name == '%s'", podServer.Name),
+				[]calico.GNPRule{{Action: "Reject", Protocol: "TCP", DstPorts: []int{serverPort1}}})
+			if err := calicoctl.ApplyWithError(rejectYaml); err != nil {
+				framework.Skipf("this datastore/felix does not accept the Reject action: %v", err)
+			}
+			defer calicoctl.DeleteGNP("reject-policy")
+
+			By("Verifying rejected connections fail fast with a refusal, not a timeout.")
+			// Reject answers with an RST/ICMP, so the client sees the same
+			// immediate refusal as a closed port rather than hanging until
+			// its timeout the way a Deny leaves it.
+			Eventually(func() (string, error) {
+				return calico.ProbeConnectionOutcome(f, clientPod, serverIP, serverPort1, probeTimeout)
+			}, 2*time.Minute, 10*time.Second).Should(Equal(calico.ProbeOutcomeRefused),
+				"a Reject should cause an immediate connection refused")
 
+			By("Replacing the Reject with a Deny and verifying the outcome becomes a timeout.")
+			calicoctl.Apply(calico.RenderGNPWithOrderedRules("reject-policy", 200,
+				fmt.Sprintf("pod-name == '%s'", podServer.Name),
+				[]calico.GNPRule{{Action: "Deny", Protocol: "TCP", DstPorts: []int{serverPort1}}}))
+			Eventually(func() (string, error) {
+				return calico.ProbeConnectionOutcome(f, clientPod, serverIP, serverPort1, probeTimeout)
+			}, 2*time.Minute, 10*time.Second).Should(Equal(calico.ProbeOutcomeTimeout),
+				"the same rule with Deny should silently drop instead")
 		})
 
-		AfterEach(func() {
-			cleanupServerPodAndService(f, podServer, service)
-			calicoctl.Cleanup()
+		It("should record every client source a tracking server observes", func() {
+			ns := f.Namespace
+			const trackPort = 8080
+
+			By("Creating a source-tracking server and two differently-sourced clients.")
+			tracker := calico.CreateSourceTrackingServerPod(f, "source-tracker", trackPort)
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(tracker.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", tracker.Name, err)
+				}
+			}()
+			podClient := createExecPodOrFail(f, &source{"", "track-pod-client", false})
+			defer cleanupExecPodOrFail(f, podClient)
+			hostClient := createExecPodOrFail(f, &source{"", "track-host-client", true})
+			defer cleanupExecPodOrFail(f, hostClient)
+
+			probe := func(client *v1.Pod) error {
+				_, err := framework.RunHostCmd(ns.Name, client.Name,
+					fmt.Sprintf("wget -q -T 5 -t 1 -O /dev/null http://%s:%d", tracker.Status.PodIP, trackPort))
+				return err
+			}
+			Eventually(func() error { return probe(podClient) }, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"the pod-network client never reached the tracking server")
+			Eventually(func() error { return probe(hostClient) }, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"the host-networked client never reached the tracking server")
+
+			By("Probing repeatedly from both clients.")
+			for i := 0; i < 25; i++ {
+				framework.ExpectNoError(probe(podClient))
+				framework.ExpectNoError(probe(hostClient))
+			}
+
+			By("Verifying the server's history holds exactly the expected sources.")
+			// The pod-network client must arrive with its own pod IP.  The
+			// host-networked client arrives as a host-side address - the node
+			// or tunnel IP, depending on encapsulation - so assert on the
+			// count rather than its literal value.
+			Eventually(func() []string {
+				return calico.GetObservedSources(f, tracker)
+			}, time.Minute, 5*time.Second).Should(ContainElement(podClient.Status.PodIP),
+				"the pod client's probes should be attributed to its pod IP")
+			sources := calico.GetObservedSources(f, tracker)
+			framework.Logf("Tracking server observed sources: %v", sources)
+			Expect(sources).To(HaveLen(2),
+				"across all probes the server should only ever have seen the two clients, got %v", sources)
+		})
+
+		It("should enforce a policy rendered for the detected API version", func() {
+			version := calico.DetectPolicyAPIVersion(calicoctl)
+
+			By(fmt.Sprintf("Applying a deny policy rendered in the %v schema.", version))
+			policyStr := calico.RenderPolicy(version, "rendered-deny", 200,
+				fmt.Sprintf("pod-name == '%s'", podServer.Name), "Deny", "")
+			calicoctl.Apply(policyStr)
+			defer calico.DeleteRenderedPolicy(calicoctl, version, "rendered-deny")
+
+			testCannotConnect(f, f.Namespace, "rendered-deny-client", service, serverPort1)
+		})
+
+		It("should enforce policy on whichever dataplane backend is active", func() {
+			ns := f.Namespace
+
+			serverPod, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(podServer.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			serverNode := serverPod.Spec.NodeName
+
+			By("Detecting the active dataplane backend on the server's node.")
+			backend, err := calico.GetDataplaneBackend(f, serverNode)
+			Expect(err).NotTo(HaveOccurred())
+			framework.Logf("Node %v is using the %v dataplane", serverNode, backend)
+
+			By("Applying a deny policy and verifying it is enforced.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: backend-smoke-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				podServer.Name))
+			defer calicoctl.DeleteGNP("backend-smoke-deny")
+			testCannotConnect(f, ns, "backend-smoke-client", service, serverPort1)
+
+			By("Reading the policy rule counters from the active backend.")
+			counters, err := calico.GetPolicyRuleCounters(f, serverNode)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counters).NotTo(BeEmpty(),
+				"expected calico policy rules in the %v ruleset on node %v", backend, serverNode)
+		})
+
+		It("should combine overlapping policies matching different labels on one pod", func() {
+			ns := f.Namespace
+			type gnpConfig struct {
+				Name     string
+				Selector string
+				Action   string
+				Order    int
+				Port     int
+			}
+
+			By("Creating a two-port server carrying two policy-relevant labels.")
+			multiServer, multiService := createServerPodAndServiceX(f, ns, "multi-label-server", []int{80, 81},
+				func(pod *v1.Pod) {
+					pod.ObjectMeta.Labels["role"] = "multi"
+				}, func(_ *v1.Service) {})
+			defer cleanupServerPodAndService(f, multiServer, multiService)
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, multiServer)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Applying an allow for port 80 and a deny for port 81 via different labels.")
+			// Both policies select the pod, one by each label.  Calico walks
+			// them in order: the port 80 allow matches first for port 80
+			// traffic; port 81 traffic falls past it to the deny.  Traffic
+			// matching neither rule would end in default deny, because once
+			// any policy selects a pod's ingress, unmatched traffic is
+			// denied rather than passed to the profile.
+			calicoctl.ApplyTemplateFile("templated-gnp-1.yaml", gnpConfig{
+				Name:     "overlap-allow-80",
+				Selector: "role == 'multi'",
+				Action:   "Allow",
+				Order:    300,
+				Port:     80,
+			})
+			defer calicoctl.DeleteGNP("overlap-allow-80")
+			calicoctl.ApplyTemplateFile("templated-gnp-1.yaml", gnpConfig{
+				Name:     "overlap-deny-81",
+				Selector: fmt.Sprintf("pod-name == '%s'", multiServer.Name),
+				Action:   "Deny",
+				Order:    400,
+				Port:     81,
+			})
+			defer calicoctl.DeleteGNP("overlap-deny-81")
+
+			By("Verifying port 80 is allowed and port 81 is denied.")
+			testCanConnect(f, ns, "overlap-client-80", multiService, 80)
+			testCannotConnect(f, ns, "overlap-client-81", multiService, 81)
+		})
+
+		It("should enforce per-backend policy behind a shared service", func() {
+			ns := f.Namespace
+			const numBackends = 3
+			const groupLabel = "lb-backends"
+
+			By("Creating distinctly-labeled backends that each echo their own name.")
+			backendNames := []string{}
+			for i := 0; i < numBackends; i++ {
+				name := fmt.Sprintf("lb-backend-%d", i)
+				backendNames = append(backendNames, name)
+				pod := &v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: name,
+						Labels: map[string]string{
+							"pod-name": name,
+							"lb-group": groupLabel,
+						},
+					},
+					Spec: v1.PodSpec{
+						NodeSelector:  map[string]string{"beta.kubernetes.io/os": "linux"},
+						RestartPolicy: v1.RestartPolicyNever,
+						Containers: []v1.Container{
+							{
+								Name:  fmt.Sprintf("%s-container", name),
+								Image: imageutils.GetE2EImage(imageutils.Porter),
+								Env: []v1.EnvVar{
+									{
+										// Porter serves this value, so each
+										// backend identifies itself in the
+										// response body.
+										Name:  "SERVE_PORT_80",
+										Value: name,
+									},
+								},
+								Ports: []v1.ContainerPort{
+									{
+										ContainerPort: 80,
+									},
+								},
+							},
+						},
+					},
+				}
+				pod, err := f.ClientSet.CoreV1().Pods(ns.Name).Create(pod)
+				Expect(err).NotTo(HaveOccurred())
+				defer func() {
+					if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(pod.Name, nil); err != nil {
+						framework.Failf("unable to cleanup pod %v: %v", pod.Name, err)
+					}
+				}()
+				err = framework.WaitForPodRunningInNamespace(f.ClientSet, pod)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			By("Creating a service in front of all the backends.")
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: groupLabel,
+				},
+				Spec: v1.ServiceSpec{
+					Selector: map[string]string{"lb-group": groupLabel},
+					Ports: []v1.ServicePort{
+						{
+							Port:       80,
+							TargetPort: intstr.FromInt(80),
+						},
+					},
+				},
+			}
+			svc, err := f.ClientSet.CoreV1().Services(ns.Name).Create(svc)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.CoreV1().Services(ns.Name).Delete(svc.Name, nil); err != nil {
+					framework.Failf("unable to cleanup svc %v: %v", svc.Name, err)
+				}
+			}()
+			framework.ExpectNoError(framework.WaitForEndpoint(f.ClientSet, ns.Name, svc.Name))
+
+			By("Creating a long-running client pod.")
+			clientName := "lb-client"
+			clientPod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: clientName,
+					Labels: map[string]string{
+						"pod-name": clientName,
+					},
+				},
+				Spec: v1.PodSpec{
+					NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+					Containers: []v1.Container{
+						{
+							Name:  fmt.Sprintf("%s-container", clientName),
+							Image: "busybox",
+							Args:  []string{"/bin/sh", "-c", "sleep 3600"},
+						},
+					},
+				},
+			}
+			clientPod, err = f.ClientSet.CoreV1().Pods(ns.Name).Create(clientPod)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(clientPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", clientPod.Name, err)
+				}
+			}()
+			err = framework.WaitForPodRunningInNamespace(f.ClientSet, clientPod)
+			Expect(err).NotTo(HaveOccurred())
+
+			target := fmt.Sprintf("%s.%s:%d", svc.Name, ns.Name, 80)
+
+			By("Verifying every backend is reachable through the service.")
+			seen := probeServiceBackends(f, clientPod, target, backendNames, 60)
+			for _, name := range backendNames {
+				Expect(seen).To(HaveKey(name), "backend %v was never hit through the service", name)
+			}
+
+			By("Denying ingress to one backend only.")
+			deniedBackend := backendNames[numBackends-1]
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: deny-one-backend
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				deniedBackend))
+			defer calicoctl.DeleteGNP("deny-one-backend")
+
+			By("Verifying the allowed backends are still hit and the denied one never is.")
+			allowedBackends := backendNames[:numBackends-1]
+			seen = probeServiceBackends(f, clientPod, target, allowedBackends, 60)
+			for _, name := range allowedBackends {
+				Expect(seen).To(HaveKey(name), "allowed backend %v was never hit under the policy", name)
+			}
+			Expect(seen).NotTo(HaveKey(deniedBackend),
+				"denied backend %v should not answer through the service", deniedBackend)
+		})
+
+		It("should evaluate both egress and ingress policy on a hairpin connection to self", func() {
+			ns := f.Namespace
+
+			By("Creating a pod that serves on 8080 and can connect to itself.")
+			podName := "hairpin-pod"
+			pod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: podName,
+					Labels: map[string]string{
+						"pod-name": podName,
+					},
+				},
+				Spec: v1.PodSpec{
+					NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+					Containers: []v1.Container{
+						{
+							Name:  fmt.Sprintf("%s-container", podName),
+							Image: "busybox",
+							Args: []string{"/bin/sh", "-c",
+								"while true; do echo ok | nc -l -p 8080; done"},
+							Ports: []v1.ContainerPort{
+								{
+									ContainerPort: 8080,
+								},
+							},
+						},
+					},
+				},
+			}
+			pod, err := f.ClientSet.CoreV1().Pods(ns.Name).Create(pod)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(pod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", pod.Name, err)
+				}
+			}()
+			err = framework.WaitForPodRunningInNamespace(f.ClientSet, pod)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Creating a service in front of the pod.")
+			svc := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: podName,
+				},
+				Spec: v1.ServiceSpec{
+					Selector: map[string]string{"pod-name": podName},
+					Ports: []v1.ServicePort{
+						{
+							Port:       8080,
+							TargetPort: intstr.FromInt(8080),
+						},
+					},
+				},
+			}
+			svc, err = f.ClientSet.CoreV1().Services(ns.Name).Create(svc)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.CoreV1().Services(ns.Name).Delete(svc.Name, nil); err != nil {
+					framework.Failf("unable to cleanup svc %v: %v", svc.Name, err)
+				}
+			}()
+			framework.ExpectNoError(framework.WaitForEndpoint(f.ClientSet, ns.Name, svc.Name))
+
+			// The hairpin flow leaves the pod, is DNATed back to the same pod
+			// and SNATed by the dataplane so the reply is not martian.  Policy
+			// still sees a normal workload flow: the pod's egress rules apply
+			// on the way out and its ingress rules on the way back in.
+			connectToSelf := func() error {
+				_, err := framework.RunHostCmd(ns.Name, pod.Name,
+					fmt.Sprintf("wget -q -T 5 -O /dev/null http://%s:8080", svc.Spec.ClusterIP))
+				return err
+			}
+
+			By("Verifying the pod can reach itself through the service with no policy.")
+			Eventually(connectToSelf, 2*time.Minute, 5*time.Second).Should(Succeed(),
+				"hairpin connection to self via %v should work without policy", svc.Spec.ClusterIP)
+
+			By("Verifying an ingress deny on the pod breaks the hairpin flow.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: hairpin-ingress-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				podName))
+			Eventually(connectToSelf, 2*time.Minute, 5*time.Second).ShouldNot(Succeed(),
+				"hairpin connection should be cut by the pod's own ingress deny")
+			calicoctl.DeleteGNP("hairpin-ingress-deny")
+
+			By("Verifying an egress deny on the pod also breaks the hairpin flow.")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: hairpin-egress-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Egress
+  egress:
+  - action: Deny
+`,
+				podName))
+			defer calicoctl.DeleteGNP("hairpin-egress-deny")
+			Eventually(connectToSelf, 2*time.Minute, 5*time.Second).ShouldNot(Succeed(),
+				"hairpin connection should be cut by the pod's own egress deny")
+		})
+
+		It("should keep enforcing a label-based policy after the server pod is recreated", func() {
+			ns := f.Namespace
+
+			By("Creating a long-running client pod.")
+			clientName := "recreate-client"
+			clientPod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: clientName,
+					Labels: map[string]string{
+						"pod-name": clientName,
+					},
+				},
+				Spec: v1.PodSpec{
+					NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+					Containers: []v1.Container{
+						{
+							Name:  fmt.Sprintf("%s-container", clientName),
+							Image: "busybox",
+							Args:  []string{"/bin/sh", "-c", "sleep 3600"},
+						},
+					},
+				},
+			}
+			clientPod, err := f.ClientSet.CoreV1().Pods(ns.Name).Create(clientPod)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(clientPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", clientPod.Name, err)
+				}
+			}()
+			err = framework.WaitForPodRunningInNamespace(f.ClientSet, clientPod)
+			Expect(err).NotTo(HaveOccurred())
+
+			canReachIP := func(ip string) bool {
+				_, err := framework.RunHostCmd(ns.Name, clientPod.Name,
+					fmt.Sprintf("wget -q -T 3 -O /dev/null http://%s:%d", ip, serverPort1))
+				return err == nil
+			}
+
+			serverPod, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(podServer.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			oldIP := serverPod.Status.PodIP
+
+			By("Verifying the client can reach the server pod IP with no policy.")
+			Eventually(func() bool { return canReachIP(oldIP) }, 1*time.Minute, 2*time.Second).Should(BeTrue())
+
+			By("Denying client egress to pods matching the server's label.")
+			// Selecting the destination by label means felix tracks the
+			// server's IP in an ipset; recreating the pod below exercises the
+			// ipset reprogramming path.
+			policyStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: recreate-egress-deny-100
+spec:
+  order: 100
+  selector: pod-name == '%s' && projectcalico.org/namespace == '%s'
+  types:
+  - Egress
+  egress:
+  - action: Deny
+    destination:
+      selector: pod-name == '%s' && projectcalico.org/namespace == '%s'
+  - action: Allow
+`,
+				clientName, ns.Name, podServer.Name, ns.Name)
+			calicoctl.Apply(policyStr)
+			defer calicoctl.DeleteGNP("recreate-egress-deny-100")
+
+			By("Verifying the policy blocks traffic to the current server IP.")
+			Eventually(func() bool { return canReachIP(oldIP) }, 1*time.Minute, 2*time.Second).Should(BeFalse())
+
+			By("Deleting and recreating the server pod with the same labels.")
+			recreated := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   serverPod.Name,
+					Labels: serverPod.Labels,
+				},
+				Spec: *serverPod.Spec.DeepCopy(),
+			}
+			recreated.Spec.NodeName = ""
+			err = f.ClientSet.CoreV1().Pods(ns.Name).Delete(serverPod.Name, metav1.NewDeleteOptions(0))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() error {
+				_, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(serverPod.Name, metav1.GetOptions{})
+				return err
+			}, 2*time.Minute, 2*time.Second).ShouldNot(Succeed())
+			recreated, err = f.ClientSet.CoreV1().Pods(ns.Name).Create(recreated)
+			Expect(err).NotTo(HaveOccurred())
+			err = framework.WaitForPodRunningInNamespace(f.ClientSet, recreated)
+			Expect(err).NotTo(HaveOccurred())
+			recreated, err = f.ClientSet.CoreV1().Pods(ns.Name).Get(recreated.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			newIP := recreated.Status.PodIP
+			framework.Logf("Server pod recreated: old IP %v, new IP %v", oldIP, newIP)
+			if newIP == oldIP {
+				framework.Logf("Recreated pod reused the old IP; the reprogramming check below is weaker than intended.")
+			}
+
+			By("Waiting for enforcement to re-converge to the new server IP.")
+			// Stale ipset membership would leave the new IP unmatched by the
+			// deny rule, so traffic to it would succeed.
+			Eventually(func() bool { return canReachIP(newIP) }, 2*time.Minute, 5*time.Second).Should(BeFalse())
+		})
+
+		It("should subject pods in a brand-new namespace to an existing global deny", func() {
+			By("Applying a global default deny for all labelled pods.")
+			calicoctl.Apply(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: global-hasname-deny
+spec:
+  order: 3000
+  selector: has(pod-name)
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`)
+			defer calicoctl.DeleteGNP("global-hasname-deny")
+
+			By("Creating a brand-new namespace with a client pod.")
+			freshNsName := f.BaseName + "-fresh"
+			freshNs, err := f.CreateNamespace(freshNsName, map[string]string{
+				"ns-name": freshNsName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			clientName := "fresh-client"
+			clientPod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: clientName,
+					Labels: map[string]string{
+						"pod-name": clientName,
+					},
+				},
+				Spec: v1.PodSpec{
+					NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+					Containers: []v1.Container{
+						{
+							Name:  fmt.Sprintf("%s-container", clientName),
+							Image: "busybox",
+							Args:  []string{"/bin/sh", "-c", "sleep 3600"},
+						},
+					},
+				},
+			}
+			clientPod, err = f.ClientSet.CoreV1().Pods(freshNs.Name).Create(clientPod)
+			Expect(err).NotTo(HaveOccurred())
+			err = framework.WaitForPodRunningInNamespace(f.ClientSet, clientPod)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Creating a server pod and probing it from the moment it has an IP.")
+			freshServer, freshService := createServerPodAndService(f, freshNs, "fresh-server", []int{80})
+			defer cleanupServerPodAndService(f, freshServer, freshService)
+			var podIP string
+			Eventually(func() string {
+				p, err := f.ClientSet.CoreV1().Pods(freshNs.Name).Get(freshServer.Name, metav1.GetOptions{})
+				if err != nil {
+					return ""
+				}
+				podIP = p.Status.PodIP
+				return podIP
+			}, 2*time.Minute, 1*time.Second).ShouldNot(BeEmpty())
+
+			// The global policy must cover the endpoint from the instant it
+			// exists: if any attempt in this window succeeds, the pod came up
+			// with a default-allow gap before felix enforced the deny.
+			attempts, allowed := 0, 0
+			for start := time.Now(); time.Since(start) < 20*time.Second; {
+				_, err := framework.RunHostCmd(freshNs.Name, clientPod.Name,
+					fmt.Sprintf("wget -q -T 2 -O /dev/null http://%s:80", podIP))
+				attempts++
+				if err == nil {
+					allowed++
+				}
+				time.Sleep(1 * time.Second)
+			}
+			Expect(allowed).To(BeZero(),
+				"%d of %d probes reached the new pod before the global deny was enforced", allowed, attempts)
+		})
+
+		It("should isolate workloads under an all() default deny without breaking the control plane", func() {
+			ns := f.Namespace
+
+			By("Applying the safety allows before the global deny.")
+			calico.ApplyGlobalDefaultDenySafetyAllows(calicoctl)
+			defer calicoctl.DeleteGNP(calico.GlobalDefaultDenySafetyName)
+
+			By("Applying a cluster-wide default deny.")
+			calicoctl.Apply(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: global-default-deny-8000
+spec:
+  order: 8000
+  selector: all()
+  types:
+  - Ingress
+  - Egress
+  ingress:
+  - action: Deny
+  egress:
+  - action: Deny
+`)
+			defer calicoctl.DeleteGNP("global-default-deny-8000")
+
+			By("Verifying workload traffic is now denied.")
+			testCannotConnect(f, ns, "global-deny-client", service, serverPort1)
+
+			By("Verifying the API server is still reachable.")
+			_, err := f.ClientSet.CoreV1().Pods("kube-system").List(metav1.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Verifying pods can still resolve names via cluster DNS.")
+			dnsPod, dnsOut, dnsErr := calico.ExecuteCmdInPodX(f, "nslookup kubernetes.default", func(pod *v1.Pod) {
+				pod.Name = calico.GenerateRandomName("global-deny-dns")
+				pod.Spec.HostNetwork = false
+			})
+			defer func() {
+				if err := f.PodClient().Delete(dnsPod.Name, metav1.NewDeleteOptions(0)); err != nil {
+					framework.Logf("unable to cleanup pod %v: %v", dnsPod.Name, err)
+				}
+			}()
+			framework.Logf("nslookup output: %v", dnsOut)
+			Expect(dnsErr).NotTo(HaveOccurred())
+			Expect(dnsOut).To(ContainSubstring("kubernetes.default"))
+		})
+
+		It("should combine a cluster-wide pod selector with a namespaceSelector ingress rule", func() {
+			nsA := f.Namespace
+			nsBName := f.BaseName + "-gnp-b"
+			nsB, err := f.CreateNamespace(nsBName, map[string]string{
+				"ns-name": nsBName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			framework.Logf("Created a new namespace %s.", nsB.Name)
+
+			// Both policies select test pods cluster-wide but explicitly spare
+			// kube-system, so system components can never be caught by them.
+			gnpSelector := `has(pod-name) && projectcalico.org/namespace != "kube-system"`
+
+			By("Creating a cluster-wide default-deny ingress policy that excludes kube-system.")
+			denyStr := fmt.Sprintf(`
+- apiVersion: projectcalico.org/v3
+  kind: GlobalNetworkPolicy
+  metadata:
+    name: global-deny-non-system
+  spec:
+    order: 5000
+    selector: %s
+    types:
+    - Ingress
+`,
+				gnpSelector)
+			calicoctl.Apply(denyStr)
+			defer calicoctl.DeleteGNP("global-deny-non-system")
+
+			By("Creating a cluster-wide allow policy restricted to sources in namespace B.")
+			allowStr := fmt.Sprintf(`
+- apiVersion: projectcalico.org/v3
+  kind: GlobalNetworkPolicy
+  metadata:
+    name: global-allow-from-b
+  spec:
+    order: 1000
+    selector: %s
+    ingress:
+    - action: Allow
+      source:
+        namespaceSelector: ns-name == "%s"
+    types:
+    - Ingress
+`,
+				gnpSelector, nsBName)
+			calicoctl.Apply(allowStr)
+			defer calicoctl.DeleteGNP("global-allow-from-b")
+
+			By("Verifying a client in namespace B can reach the server.")
+			testCanConnect(f, nsB, "client-b", service, 80)
+
+			By("Verifying a client in the server's own namespace is denied.")
+			testCannotConnect(f, nsA, "client-a", service, 80)
+
+			By("Verifying kube-system components are unaffected (DNS still resolves).")
+			dnsCheckPod := createExecPodOrFail(f, &source{"", "dns-check", false})
+			defer cleanupExecPodOrFail(f, dnsCheckPod)
+			stdout, err := framework.RunHostCmd(nsA.Name, dnsCheckPod.Name, "nslookup kubernetes.default")
+			framework.Logf("nslookup kubernetes.default: %v", stdout)
+			Expect(err).NotTo(HaveOccurred(),
+				"the global policy should not break DNS served from kube-system")
 		})
 
 		It("should correctly isolate namespaces by ingress and egress policies [Feature:WindowsPolicy]", func() {
@@ -220,18 +3639,8 @@ spec:
 			// TODO (mattl): remove this and rework these policies. Currently need to create a default deny since Calico v2.6.0
 			// defaults to allow for any non matching policies while 2.5.1 and earlier default to deny.
 			By("Creating a namespace-wide default-deny policy")
-			denyPolicyStr := fmt.Sprintf(`
-- apiVersion: projectcalico.org/v3
-  kind: NetworkPolicy
-  metadata:
-    name: default-deny
-    namespace: %s
-  spec:
-    order: 5000
-`,
-				nsA.Name)
-			calicoctl.Apply(denyPolicyStr)
-			defer calicoctl.DeleteNP(nsA.Name, "default-deny")
+			cleanupDefaultDeny := calico.ApplyNamespaceDefaultDeny(calicoctl, nsA.Name)
+			defer cleanupDefaultDeny()
 
 			By("Creating calico allow egress in namespace A.")
 			policyName := fmt.Sprintf("%s", "allow-egress")
@@ -947,66 +4356,122 @@ spec:
 		v2CheckPolicyDoesntExist(calicoctl, policyName, "")
 	})
 
-	// TODO: re-enable when we've got a minute to figure out how to grab these logs
-	//       in a more universal manner.
-	//	It("should support a 'log' rule", func() {
-	//		ns := f.Namespace
-	//
-	//		By("Create a simple server pod.")
-	//		serverPod, service := createServerPodAndService(f, ns, "server", []int{serverPort1})
-	//		defer cleanupServerPodAndService(f, serverPod, service)
-	//		framework.Logf("Waiting for server pod to come up.")
-	//		err := framework.WaitForPodRunningInNamespace(f.ClientSet, serverPod)
-	//		Expect(err).NotTo(HaveOccurred())
-	//
-	//		By("Creating a client which should be able to connect to the server since no policies are present.")
-	//		testCanConnect(f, ns, "client", service, serverPort1)
-	//
-	//		By("Verifying that initially there are no logs present in the node running the server pod")
-	//		serverPodNow, err := f.ClientSet.Core().Pods(ns.Name).Get(serverPod.Name, metav1.GetOptions{})
-	//		Expect(err).NotTo(HaveOccurred())
-	//		serverNodeName := serverPodNow.Spec.NodeName
-	//		serverNode, err := f.ClientSet.Core().Nodes().Get(serverNodeName, metav1.GetOptions{})
-	//		Expect(err).NotTo(HaveOccurred())
-	//		framework.Logf("Server is running on %v", serverNodeName)
-	//		serverSyslogCount := calico.CountSyslogLines(serverNode)
-	//
-	//		By("Applying a policy that logs traffic from client then drops the same traffic.")
-	//		calico.CalicoctlApply(
-	//			fmt.Sprintf(`
-	//- apiVersion: projectcalico.org/v3
-	//  kind: NetworkPolicy
-	//  metadata:
-	//    name: policy-log-then-deny
-	//    namespace: %s
-	//  spec:
-	//    order: 100
-	//    ingress:
-	//      - action: Log
-	//        protocol: TCP
-	//        source:
-	//          selector: pod-name=="client"
-	//        destination:
-	//          ports: [%d]
-	//      - action: Deny
-	//        protocol: TCP
-	//        source:
-	//          selector: pod-name=="client"
-	//        destination:
-	//          ports: [%d]
-	//    selector: pod-name=="%s"
-	//`, ns.Name, serverPort1, serverPort1, serverPod.Name),
-	//	)
-	//		defer func() {
-	//			calico.Calicoctl("delete", "-n", ns.Name, "policy", "policy-log-then-deny")
-	//		}()
-	//		By("Creating a client that should not be able to connect to the server")
-	//		testCannotConnect(f, ns, "client", service, serverPort1)
-	//
-	//		newDropLogs := calico.GetNewCalicoDropLogs(f, serverNode, serverSyslogCount, "calico-packet")
-	//		framework.Logf("New drop logs: %#v", newDropLogs)
-	//		Expect(len(newDropLogs)).NotTo(BeZero())
-	//	})
+	It("should support a 'log' rule", func() {
+		ns := f.Namespace
+		calicoctl := calico.ConfigureCalicoctl(f)
+
+		By("Create a simple server pod.")
+		serverPod, service := createServerPodAndService(f, ns, "server", []int{serverPort1})
+		defer cleanupServerPodAndService(f, serverPod, service)
+		framework.Logf("Waiting for server pod to come up.")
+		err := framework.WaitForPodRunningInNamespace(f.ClientSet, serverPod)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Creating a client which should be able to connect to the server since no policies are present.")
+		testCanConnect(f, ns, "client", service, serverPort1)
+
+		By("Counting the log lines present on the node running the server pod")
+		serverPodNow, err := f.ClientSet.Core().Pods(ns.Name).Get(serverPod.Name, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		serverNodeName := serverPodNow.Spec.NodeName
+		serverNode, err := f.ClientSet.Core().Nodes().Get(serverNodeName, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		framework.Logf("Server is running on %v", serverNodeName)
+		serverSyslogCount := calico.CountSyslogLines(f, serverNode)
+
+		By("Applying a policy that logs traffic to the server then drops the same traffic.")
+		policyName := "policy-log-then-deny"
+		fetchLogs := calico.ApplyLogThenAction(f, calicoctl, policyName,
+			fmt.Sprintf(`pod-name == "%s"`, serverPod.Name), "Deny", serverPort1)
+		defer calicoctl.ResetFelixLogPrefix()
+		defer calicoctl.DeleteGNP(policyName)
+
+		By("Creating a client that should not be able to connect to the server")
+		testCannotConnect(f, ns, "client", service, serverPort1)
+
+		By("Verifying that the flow was logged on the server's node")
+		newDropLogs := fetchLogs(serverNode, serverSyslogCount)
+		framework.Logf("New drop logs: %#v", newDropLogs)
+		Expect(len(newDropLogs)).NotTo(BeZero())
+	})
+
+	It("should enforce a default-deny egress policy on init containers", func() {
+		ns := f.Namespace
+
+		By("Create a simple server pod.")
+		serverPod, service := createServerPodAndService(f, ns, "server", []int{serverPort1})
+		defer cleanupServerPodAndService(f, serverPod, service)
+		framework.Logf("Waiting for server pod to come up.")
+		err := framework.WaitForPodRunningInNamespace(f.ClientSet, serverPod)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Creating a default-deny egress policy that applies to the client pod.")
+		policy := &networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "init-client-default-deny-egress",
+			},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"pod-name": "init-client",
+					},
+				},
+				// An egress policy with no allowed destinations denies all egress.
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			},
+		}
+		policy, err = f.ClientSet.NetworkingV1().NetworkPolicies(ns.Name).Create(policy)
+		Expect(err).NotTo(HaveOccurred())
+		defer cleanupNetworkPolicy(f, policy)
+
+		// Policy must be enforced from the moment the pod gets an IP: the init
+		// container connects as soon as it starts, which races CNI ADD and the
+		// first dataplane programming for the pod.
+		By("Creating a pod whose init container immediately connects to the server.")
+		target := fmt.Sprintf("%s:%d", service.Spec.ClusterIP, serverPort1)
+		podName := calico.GenerateRandomName("init-client")
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: podName,
+				Labels: map[string]string{
+					"pod-name": "init-client",
+				},
+			},
+			Spec: v1.PodSpec{
+				RestartPolicy: v1.RestartPolicyNever,
+				NodeSelector:  map[string]string{"beta.kubernetes.io/os": "linux"},
+				InitContainers: []v1.Container{
+					{
+						Name:  fmt.Sprintf("%s-init", podName),
+						Image: "busybox",
+						Args: []string{
+							"/bin/sh", "-c",
+							fmt.Sprintf("wget -T 5 %s -O - && exit 0 || exit 1", target),
+						},
+					},
+				},
+				Containers: []v1.Container{
+					{
+						Name:  fmt.Sprintf("%s-container", podName),
+						Image: "busybox",
+						Args:  []string{"/bin/sh", "-c", "exit 0"},
+					},
+				},
+			},
+		}
+		pod, err = f.ClientSet.CoreV1().Pods(ns.Name).Create(pod)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			if err := f.ClientSet.CoreV1().Pods(ns.Name).Delete(pod.Name, nil); err != nil {
+				framework.Failf("unable to cleanup pod %v: %v", pod.Name, err)
+			}
+		}()
+
+		By("Verifying the init container's connection is blocked.")
+		err = framework.WaitForPodSuccessInNamespace(f.ClientSet, pod.Name, ns.Name)
+		Expect(err).To(HaveOccurred(),
+			"init container connected to the server despite the default-deny egress policy")
+	})
 
 	It("should support 'DefaultEndpointToHostAction'", func() {
 		// TODO(doublek): Doesn't do DefaultEndpointToHostAction 'RETURN' yet.
@@ -1159,3 +4624,53 @@ func v2CheckPolicyExists(c *calico.Calicoctl, policyName, ns string) {
 func v2CheckPolicyDoesntExist(c *calico.Calicoctl, policyName, ns string) {
 	Expect(v2SearchPolicy(c, policyName, ns)).NotTo(BeTrue())
 }
+
+// connectFromSourcePort issues an HTTP GET to target:targetPort from a client
+// pod bound to the given TCP source port, and returns the server's response.
+// It retries a few times with a pause so an attempt does not fail just because
+// the kernel still holds the port in TIME_WAIT from a previous connection.
+func connectFromSourcePort(f *framework.Framework, target string, targetPort, sourcePort int) (string, error) {
+	cmd := fmt.Sprintf(
+		"for i in $(seq 1 5); do "+
+			"out=$(curl --local-port %d -s -m 5 http://%s:%d/) && [ -n \"$out\" ] && echo \"$out\" && exit 0; "+
+			"sleep 3; "+
+			"done; exit 1",
+		sourcePort, target, targetPort)
+	pod, out, err := calico.ExecuteCmdInPodX(f, cmd, func(pod *v1.Pod) {
+		pod.Name = calico.GenerateRandomName("srcport")
+		pod.Spec.HostNetwork = false
+		pod.Spec.RestartPolicy = v1.RestartPolicyNever
+	})
+	if pod != nil {
+		defer f.PodClient().Delete(pod.Name, metav1.NewDeleteOptions(0))
+	}
+	return out, err
+}
+
+// probeServiceBackends wgets the target from the client pod until it has seen
+// every backend ID in expected or the attempt budget runs out, and returns the
+// set of IDs observed.  Service load balancing picks a backend per connection,
+// so covering all backends takes repeated attempts; attempts to a backend that
+// policy denies simply time out and contribute nothing to the result.
+func probeServiceBackends(f *framework.Framework, client *v1.Pod, target string, expected []string, attempts int) map[string]bool {
+	seen := map[string]bool{}
+	for i := 0; i < attempts; i++ {
+		out, err := framework.RunHostCmd(client.Namespace, client.Name,
+			fmt.Sprintf("wget -q -T 2 -O - http://%s", target))
+		if err == nil {
+			seen[strings.TrimSpace(out)] = true
+		}
+		allSeen := true
+		for _, id := range expected {
+			if !seen[id] {
+				allSeen = false
+				break
+			}
+		}
+		if allSeen {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return seen
+}
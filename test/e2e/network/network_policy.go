@@ -44,6 +44,7 @@ failed or successfully connected as expected.
 */
 
 var egressVersion = utilversion.MustParseSemantic("v1.8.0")
+var endPortVersion = utilversion.MustParseSemantic("v1.21.0")
 
 var _ = SIGDescribe("[Feature:NetworkPolicy]", func() {
 	var service *v1.Service
@@ -359,6 +360,39 @@ var _ = SIGDescribe("[Feature:NetworkPolicy]", func() {
 				testCannotConnect(f, f.Namespace, clientPodName, service, 81)
 			})
 		})
+
+		It("should enforce a port range specified with endPort [Feature:NetworkPolicy]", func() {
+			framework.SkipUnlessServerVersionGTE(endPortVersion, f.ClientSet.Discovery())
+			// The vendored networking types predate endPort, so the policy is
+			// applied as YAML; servers new enough to pass the version check
+			// above accept and enforce the range.
+			policyYaml := fmt.Sprintf(`
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: allow-ingress-port-range
+  namespace: %s
+spec:
+  podSelector:
+    matchLabels:
+      pod-name: %s
+  ingress:
+  - ports:
+    - protocol: TCP
+      port: 78
+      endPort: 80
+`,
+				f.Namespace.Name, podServer.Name)
+			framework.RunKubectlOrDieInput(policyYaml, "create", "-f", "-", fmt.Sprintf("--namespace=%v", f.Namespace.Name))
+			defer framework.RunKubectlOrDie("delete", "networkpolicy", "allow-ingress-port-range", fmt.Sprintf("--namespace=%v", f.Namespace.Name))
+
+			By("Creating client-a which should reach the in-range port 80.", func() {
+				testCanConnect(f, f.Namespace, "client-a", service, 80)
+			})
+			By("Creating client-b which should not reach the out-of-range port 81.", func() {
+				testCannotConnect(f, f.Namespace, "client-b", service, 81)
+			})
+		})
 	})
 })
 
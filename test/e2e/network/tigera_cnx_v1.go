@@ -3,14 +3,14 @@
 package network
 
 import (
-	"bufio"
-	"io/ioutil"
-	"strconv"
+	"fmt"
+	"os"
 	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -29,23 +29,7 @@ var _ = framework.KubeDescribe("[Feature:CNX-v1]", func() {
 			calico.RestartCalicoNodePods(f.ClientSet, "")
 			felixConfigNeeded = false
 		}
-		if calico.DatastoreType == "" {
-			// Infer datastore type by reading /etc/calico/calicoctl.cfg.
-			b, err := ioutil.ReadFile("/etc/calico/calicoctl.cfg")
-			Expect(err).NotTo(HaveOccurred())
-			for _, line := range strings.Split(string(b), "\n") {
-				if strings.Contains(line, "datastoreType") {
-					if strings.Contains(line, "kubernetes") {
-						calico.DatastoreType = "kdd"
-					}
-					if strings.Contains(line, "etcd") {
-						calico.DatastoreType = "etcd"
-					}
-				}
-			}
-			framework.Logf("datastoreType = %v", calico.DatastoreType)
-			Expect(calico.DatastoreType).NotTo(Equal(""))
-		}
+		calico.DetectLocalDatastoreType()
 	})
 
 	Context("DropActionOverride", func() {
@@ -321,6 +305,101 @@ var _ = framework.KubeDescribe("[Feature:CNX-v1]", func() {
 			"policyDeny",
 		))
 	})
+
+	Context("Felix denied packet metrics", func() {
+		It("should increment calico_denied_packets after a blocked connection", func() {
+			ns := f.Namespace
+			serverPod, service := createServerPodAndService(f, ns, "server", []int{80})
+			defer func() {
+				By("Cleaning up the server.")
+				if err := f.ClientSet.Core().Pods(ns.Name).Delete(serverPod.Name, nil); err != nil {
+					framework.Failf("unable to cleanup pod %v: %v", serverPod.Name, err)
+				}
+			}()
+			defer func() {
+				By("Cleaning up the server's service.")
+				if err := f.ClientSet.Core().Services(ns.Name).Delete(service.Name, nil); err != nil {
+					framework.Failf("unable to cleanup svc %v: %v", service.Name, err)
+				}
+			}()
+			framework.Logf("Waiting for Server to come up.")
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, serverPod)
+			Expect(err).NotTo(HaveOccurred())
+
+			serverPodNow, err := f.ClientSet.Core().Pods(ns.Name).Get(serverPod.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			felixIP := serverPodNow.Status.HostIP
+
+			By("Reading the baseline denied packet count.")
+			before, err := calico.GetFelixMetric(f, felixIP, "calico_denied_packets", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Creating a default-deny ingress policy for the server.")
+			policy := &networkingv1.NetworkPolicy{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "server-default-deny-ingress",
+				},
+				Spec: networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"pod-name": serverPod.Name,
+						},
+					},
+					PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				},
+			}
+			policy, err = f.ClientSet.NetworkingV1().NetworkPolicies(ns.Name).Create(policy)
+			Expect(err).NotTo(HaveOccurred())
+			defer cleanupNetworkPolicy(f, policy)
+
+			By("Creating a client whose connection should be denied.")
+			testCannotConnect(f, ns, "client-a", service, 80)
+
+			By("Verifying the denied packet metric increased.")
+			Eventually(func() float64 {
+				now, err := calico.GetFelixMetric(f, felixIP, "calico_denied_packets", nil)
+				if err != nil {
+					framework.Logf("Failed to scrape felix metrics: %v", err)
+					return before
+				}
+				return now
+			}, 60*time.Second, 5*time.Second).Should(BeNumerically(">", before))
+		})
+	})
+
+	Context("Felix metrics endpoint authentication", func() {
+		It("should reject unauthenticated scrapes when the endpoint is secured", func() {
+			// A secured endpoint is deployment-specific: the test harness
+			// provides the scrape credentials when the cluster is set up with
+			// TLS/auth on the felix Prometheus reporter.
+			token := os.Getenv("FELIX_METRICS_TOKEN")
+			if token == "" {
+				framework.Skipf("FELIX_METRICS_TOKEN is not set; the felix metrics endpoint is not secured in this cluster.")
+			}
+
+			nodes := framework.GetReadySchedulableNodesOrDie(f.ClientSet)
+			if len(nodes.Items) == 0 {
+				framework.Skipf("No schedulable nodes exist, can't scrape felix metrics.")
+			}
+			addrs := framework.GetNodeAddresses(&nodes.Items[0], v1.NodeInternalIP)
+			if len(addrs) == 0 {
+				framework.Failf("node %s failed to report a valid ip address", nodes.Items[0].Name)
+			}
+			felixIP := addrs[0]
+
+			By("Verifying an unauthenticated scrape is rejected.")
+			_, err := calico.GetFelixMetric(f, felixIP, "felix_active_local_endpoints", nil)
+			Expect(err).To(HaveOccurred(), "a plain HTTP scrape should be rejected by the secured endpoint")
+
+			By("Verifying an authenticated scrape succeeds.")
+			auth := &calico.FelixMetricAuth{
+				Token:  token,
+				CAFile: os.Getenv("FELIX_METRICS_CA"),
+			}
+			_, err = calico.GetFelixMetricWithAuth(f, felixIP, "felix_active_local_endpoints", nil, auth)
+			Expect(err).NotTo(HaveOccurred(), "an authenticated scrape should succeed")
+		})
+	})
 })
 
 var _ = framework.KubeDescribe("[Product: CNX] CalicoQ", func() {
@@ -337,37 +416,144 @@ var _ = framework.KubeDescribe("[Product: CNX] CalicoQ", func() {
 	})
 })
 
-func getFelixMetrics(f *framework.Framework, felixIP, name string) (metrics []string, err error) {
-	By("Getting metrics through kubectl exec curl")
-	output, err := calico.ExecuteCmdInPod(f, "curl http://"+felixIP+":9081/metrics --fail")
-	if err != nil {
-		return
-	}
-	framework.Logf("Curl Metric response %#v", output)
-
-	metrics = []string{}
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	for scanner.Scan() {
-		line := scanner.Text()
-		framework.Logf("Line: %v", line)
-		if strings.HasPrefix(line, name) {
-			metrics = append(metrics, strings.TrimSpace(strings.TrimPrefix(line, name)))
+var _ = framework.KubeDescribe("[Product: CNX] CalicoQ policy evaluation", func() {
+	f := framework.NewDefaultFramework("calicoq-eval")
+
+	It("should reflect policy creation and deletion in eval output", func() {
+		if _, _, err := calico.Calicoq("version"); err != nil {
+			framework.Skipf("calicoq is not available locally: %v", err)
+		}
+
+		ns := f.Namespace
+		serverPod, service := createServerPodAndService(f, ns, "calicoq-server", []int{80})
+		defer cleanupServerPodAndService(f, serverPod, service)
+		framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, serverPod))
+
+		calicoctl := calico.ConfigureCalicoctl(f)
+		defer calicoctl.Cleanup()
+
+		selector := fmt.Sprintf("pod-name == '%s'", serverPod.Name)
+
+		By("Verifying calicoq eval reports the server's workload endpoint.")
+		endpoints, err := calico.CalicoqEval(selector)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(endpoints).To(HaveLen(1), "expected exactly one endpoint to match %v, got %v", selector, endpoints)
+		Expect(endpoints[0]).To(ContainSubstring(serverPod.Name))
+
+		By("Applying a policy that selects the endpoint.")
+		calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: calicoq-eval-policy
+spec:
+  order: 100
+  selector: %s
+  ingress:
+  - action: Allow
+`,
+			selector))
+		policyDeleted := false
+		defer func() {
+			if !policyDeleted {
+				calicoctl.DeleteGNP("calicoq-eval-policy")
+			}
+		}()
+
+		By("Verifying calicoq reports the policy applying to the endpoint.")
+		// calicoq reads the datastore directly, so the update is visible as
+		// soon as the apply commits; the retry just covers datastore lag.
+		Eventually(func() string {
+			stdout, _, _ := calico.Calicoq("policy", "calicoq-eval-policy")
+			return stdout
+		}, 30*time.Second, 5*time.Second).Should(ContainSubstring(serverPod.Name),
+			"calicoq should list the endpoint under the applied policy")
+
+		By("Deleting the policy and verifying calicoq no longer reports it.")
+		calicoctl.DeleteGNP("calicoq-eval-policy")
+		policyDeleted = true
+		Eventually(func() string {
+			stdout, stderr, _ := calico.Calicoq("endpoint", serverPod.Name)
+			return stdout + stderr
+		}, 30*time.Second, 5*time.Second).ShouldNot(ContainSubstring("calicoq-eval-policy"),
+			"calicoq should stop reporting a deleted policy")
+	})
+
+	It("should show an applied policy in the endpoint's policy trace", func() {
+		if _, _, err := calico.Calicoq("version"); err != nil {
+			framework.Skipf("calicoq is not available locally: %v", err)
 		}
-	}
-	err = scanner.Err()
-	return
-}
+
+		ns := f.Namespace
+		serverPod, service := createServerPodAndService(f, ns, "trace-server", []int{80})
+		defer cleanupServerPodAndService(f, serverPod, service)
+		framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, serverPod))
+		serverPod, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(serverPod.Name, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		node, err := f.ClientSet.CoreV1().Nodes().Get(serverPod.Spec.NodeName, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		calicoctl := calico.ConfigureCalicoctl(f)
+		defer calicoctl.Cleanup()
+
+		By("Collecting the baseline trace for the endpoint.")
+		trace, err := calico.GetEndpointPolicyTrace(f, node, serverPod.Name)
+		Expect(err).NotTo(HaveOccurred())
+		// Every workload endpoint carries at least its namespace profile.
+		Expect(trace).To(ContainSubstring("Profile"),
+			"a workload endpoint's trace should always include its profiles")
+		Expect(trace).NotTo(ContainSubstring("trace-policy"))
+
+		By("Applying a policy that selects the endpoint.")
+		calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: trace-policy
+spec:
+  order: 100
+  selector: pod-name == '%s'
+  ingress:
+  - action: Allow
+`,
+			serverPod.Name))
+		policyDeleted := false
+		defer func() {
+			if !policyDeleted {
+				calicoctl.DeleteGNP("trace-policy")
+			}
+		}()
+
+		By("Verifying the policy appears in the endpoint's trace.")
+		Eventually(func() string {
+			trace, err := calico.GetEndpointPolicyTrace(f, node, serverPod.Name)
+			if err != nil {
+				framework.Logf("trace not available yet: %v", err)
+				return ""
+			}
+			return trace
+		}, 30*time.Second, 5*time.Second).Should(ContainSubstring("trace-policy"),
+			"an applied policy should show up in the endpoint's evaluation order")
+
+		By("Deleting the policy and verifying it drops out of the trace.")
+		calicoctl.DeleteGNP("trace-policy")
+		policyDeleted = true
+		Eventually(func() string {
+			trace, err := calico.GetEndpointPolicyTrace(f, node, serverPod.Name)
+			if err != nil {
+				framework.Logf("trace not available yet: %v", err)
+				return "trace-policy"
+			}
+			return trace
+		}, 30*time.Second, 5*time.Second).ShouldNot(ContainSubstring("trace-policy"),
+			"a deleted policy should drop out of the endpoint's evaluation order")
+	})
+})
 
 func sumCalicoDeniedPackets(f *framework.Framework, felixIP string) (sum int64) {
-	metrics, err := getFelixMetrics(f, felixIP, "calico_denied_packets")
+	value, err := calico.GetFelixMetric(f, felixIP, "calico_denied_packets", nil)
 	Expect(err).NotTo(HaveOccurred())
-	sum = 0
-	for _, metric := range metrics {
-		words := strings.Split(metric, " ")
-		count, err := strconv.ParseInt(words[1], 10, 64)
-		Expect(err).NotTo(HaveOccurred())
-		sum += count
-	}
+	sum = int64(value)
 	framework.Logf("Denied packets = %v", sum)
 	return
 }
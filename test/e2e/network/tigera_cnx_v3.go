@@ -5,6 +5,7 @@ package network
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -341,6 +342,32 @@ spec:
 	})
 })
 
+// domainAllowEgressPolicy renders a namespaced policy that allows egress to
+// the given destination domains. Domains are quoted here, so callers can pass
+// wildcards like "*.example.com" directly.
+func domainAllowEgressPolicy(nsName, name string, domains []string) string {
+	quoted := make([]string, len(domains))
+	for i, d := range domains {
+		quoted[i] = fmt.Sprintf("%q", d)
+	}
+	return fmt.Sprintf(`
+  apiVersion: projectcalico.org/v3
+  kind: NetworkPolicy
+  metadata:
+    name: %s
+    namespace: %s
+  spec:
+    order: 1
+    selector: "all()"
+    types:
+    - Egress
+    egress:
+    - action: Allow
+      destination:
+        domains: [%s]
+`, name, nsName, strings.Join(quoted, ", "))
+}
+
 var _ = SIGDescribe("DNS policy", func() {
 
 	f := framework.NewDefaultFramework("calico-policy")
@@ -409,24 +436,7 @@ var _ = SIGDescribe("DNS policy", func() {
 			Eventually(curlService(externalService), "3s", "1s").Should(HaveOccurred())
 
 			By("Allowing egress to external service domains")
-			calicoctl.Apply(
-				fmt.Sprintf(`
-  apiVersion: projectcalico.org/v3
-  kind: NetworkPolicy
-  metadata:
-    name: allow-egress-to-domains
-    namespace: %s
-  spec:
-    order: 1
-    selector: "all()"
-    types:
-    - Egress
-    egress:
-    - action: Allow
-      destination:
-        domains: [%s]
-`, ns.Name, strings.Join(domainsToAllow, ", ")),
-			)
+			calicoctl.Apply(domainAllowEgressPolicy(ns.Name, "allow-egress-to-domains", domainsToAllow))
 			defer func() {
 				calicoctl.Exec("delete", "-n", ns.Name, "policy", "allow-egress-to-domains")
 			}()
@@ -443,5 +453,113 @@ var _ = SIGDescribe("DNS policy", func() {
 		testDNSPolicy("microsoft.com", "yahoo.com", "microsoft.com", "www.microsoft.com"))
 
 	It("[Feature:EE-v2.5] should have connectivity to wildcard domains allowed by DNS policy",
-		testDNSPolicy("microsoft.com", "google.co.uk", "\"*.com\""))
+		testDNSPolicy("microsoft.com", "google.co.uk", "*.com"))
+
+	It("[Feature:EE-v2.5] should keep wildcard domain egress working across subdomains and TTL expiry", func() {
+		ns := f.Namespace
+		calicoctl := calico.ConfigureCalicoctl(f)
+
+		By("Starting a client pod that can curl")
+		framework.RunKubectlOrDie("run",
+			"test-client", "-n", ns.Name,
+			"--generator=run-pod/v1",
+			"--image=laurenceman/alpine")
+
+		By("Waiting for client pod to be ready")
+		framework.RunKubectlOrDie("wait",
+			"--for=condition=ready",
+			"pod/test-client", "-n", ns.Name)
+
+		curlService := func(service string) func() error {
+			return func() error {
+				out, err := framework.RunKubectl("exec",
+					"test-client", "-n", ns.Name,
+					"--",
+					"curl",
+					"--connect-timeout", "3",
+					"-i",
+					"-L",
+					"-v",
+					service)
+				framework.Logf("curl output:\n%v", out)
+				return err
+			}
+		}
+
+		By("Denying all pod egress except for DNS lookups")
+		calicoctl.Apply(
+			fmt.Sprintf(`
+  apiVersion: projectcalico.org/v3
+  kind: NetworkPolicy
+  metadata:
+    name: deny-all-egress-except-dns
+    namespace: %s
+  spec:
+    selector: "all()"
+    types:
+    - Egress
+    egress:
+    - action: Allow
+      protocol: UDP
+      destination:
+        ports:
+        - 53
+    - action: Deny
+`, ns.Name),
+		)
+		defer func() {
+			calicoctl.Exec("delete", "-n", ns.Name, "policy", "deny-all-egress-except-dns")
+		}()
+
+		By("Allowing egress to a wildcard domain")
+		calicoctl.Apply(domainAllowEgressPolicy(ns.Name, "allow-egress-to-wildcard", []string{"*.google.com"}))
+		defer func() {
+			calicoctl.Exec("delete", "-n", ns.Name, "policy", "allow-egress-to-wildcard")
+		}()
+
+		By("Checking multiple subdomains match the wildcard")
+		Eventually(curlService("www.google.com"), "10s", "1s").ShouldNot(HaveOccurred())
+		Eventually(curlService("maps.google.com"), "10s", "1s").ShouldNot(HaveOccurred())
+
+		By("Checking a non-matching domain is still blocked")
+		Eventually(curlService("microsoft.com"), "3s", "1s").Should(HaveOccurred())
+
+		By("Reading the TTL the cluster's resolver hands out for the subdomain")
+		// The domain rule caches resolved IPs for the record's TTL, so the
+		// expiry wait below has to outlive the TTL the resolver actually
+		// returned; a fixed sleep quietly stops testing expiry whenever the
+		// record carries a longer TTL than the sleep.
+		out, err := framework.RunKubectl("exec",
+			"test-client", "-n", ns.Name,
+			"--",
+			"dig", "+noall", "+answer", "www.google.com")
+		if err != nil {
+			framework.Skipf("Unable to read the DNS TTL from the client pod: %v", err)
+		}
+		ttl := -1
+		for _, line := range strings.Split(out, "\n") {
+			// Answer lines look like "www.google.com. 42 IN A 1.2.3.4"; the
+			// shortest TTL across the answers bounds the cache lifetime.
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[2] == "IN" && (fields[3] == "A" || fields[3] == "AAAA") {
+				if t, err := strconv.Atoi(fields[1]); err == nil && (ttl == -1 || t < ttl) {
+					ttl = t
+				}
+			}
+		}
+		if ttl < 0 {
+			framework.Failf("Could not parse a TTL out of the DNS response:\n%v", out)
+		}
+		if ttl > 300 {
+			framework.Skipf("www.google.com resolved with a %vs TTL, too long to wait out in this test.", ttl)
+		}
+
+		By(fmt.Sprintf("Checking the subdomain is still allowed after its %vs DNS TTL expires", ttl))
+		// After the TTL these names typically re-resolve to different IPs
+		// (they sit behind rotating frontends), so a successful connection
+		// here shows the new IPs were learned from the fresh DNS response
+		// rather than served from the expired cache entry.
+		time.Sleep(time.Duration(ttl+10) * time.Second)
+		Eventually(curlService("www.google.com"), "30s", "5s").ShouldNot(HaveOccurred())
+	})
 })
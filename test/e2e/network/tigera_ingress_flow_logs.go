@@ -974,7 +974,7 @@ const (
 var _ = SIGDescribe("[Feature:CNX-v3-IngressFlowLogs][Feature:EE-v2.5]", func() {
 	var (
 		f        = framework.NewDefaultFramework("cnx-ingress-flow-logs")
-		esclient *elastic.Client
+		esclient flowLogSearcher
 	)
 
 	Context("Test ingress flow logs for HTTP traffic", func() {
@@ -1007,6 +1007,31 @@ var _ = SIGDescribe("[Feature:CNX-v3-IngressFlowLogs][Feature:EE-v2.5]", func()
 			})
 		})
 
+		It("Sends HTTP traffic through a multi-proxy chain and validates the full source chain is logged", func() {
+			var start time.Time
+			var x_real_ip_hdr string = "X-Real-IP: 7.7.7.1"
+			//the header lists the original client first, then each proxy that
+			//forwarded the request on its behalf.
+			var xff_chain_hdr string = "X-Forwarded-For: 8.8.1.1, 8.8.2.2"
+			setupHTTPService(f)
+
+			By("Sending HTTP traffic carrying a two-hop forwarding chain", func() {
+				start = time.Now()
+				_ = testForProtocolFlowLogsX(f, "ingress-nginx", clientPodName, ingressServicePort, ingressPath, x_real_ip_hdr, xff_chain_hdr, false)
+			})
+
+			By("Searching for a flow log attributing every hop of the chain", func() {
+				end := start.Add(time.Minute * 2)
+				query := flowLogQuery{
+					start:                 &start,
+					end:                   &end,
+					originalSourceIPChain: []string{"8.8.1.1", "8.8.2.2", "7.7.7.1"},
+				}.build()
+				Expect(waitForFlowLog(esclient, esFlowlogsIndex, query, 5*time.Minute, 3*time.Second)).To(BeTrue(),
+					"expected one flow log attributing the real IP and both forwarded-for hops")
+			})
+		})
+
 		AfterEach(func() {
 			cleanupCurlClientPod(f, clientPodName)
 			resetFelixConfig(f)
@@ -1122,36 +1147,452 @@ var _ = SIGDescribe("[Feature:CNX-v3-IngressFlowLogs][Feature:EE-v2.5]", func()
 			}
 		}, 1)
 	})
+
+	Context("Test flow log aggregation levels", func() {
+		BeforeEach(func() {
+			//cleanup if already resources present and re-create the setup.
+			_, err := f.ClientSet.CoreV1().Namespaces().Get("ingress-nginx", metav1.GetOptions{})
+			if err == nil {
+				cleanupHTTPServiceDeployment()
+			}
+
+			esclient = initializeSetup(f)
+		})
+
+		AfterEach(func() {
+			cleanupCurlClientPod(f, clientPodName)
+			resetFelixConfig(f)
+			framework.Logf("Cleanup flow log aggregation test setup")
+			_, err := f.ClientSet.CoreV1().Namespaces().Get("ingress-nginx", metav1.GetOptions{})
+			if err == nil {
+				cleanupHTTPServiceDeployment()
+			}
+		}, 1)
+
+		It("Aggregation reduces the document count for repeated identical flows", func() {
+			setupHTTPService(f)
+
+			//send the same flow several times and return the time window it used.
+			sendRepeatedFlows := func(realIP string) (time.Time, time.Time) {
+				start := time.Now()
+				for i := 0; i < 3; i++ {
+					_ = testForProtocolFlowLogs(f, "ingress-nginx", clientPodName, ingressServicePort, ingressPath, "X-Real-IP: "+realIP, false)
+					cleanupCurlClientPod(f, clientPodName)
+				}
+				return start, start.Add(time.Minute * 2)
+			}
+
+			By("Sending repeated flows with aggregation disabled")
+			calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFILEAGGREGATIONKINDFORALLOWED", "0")
+			calico.RestartCalicoNodePods(f.ClientSet, "")
+			startA, endA := sendRepeatedFlows("11.11.11.11")
+
+			By("Sending repeated flows with aggregation enabled")
+			calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFILEAGGREGATIONKINDFORALLOWED", "2")
+			calico.RestartCalicoNodePods(f.ClientSet, "")
+			startB, endB := sendRepeatedFlows("12.12.12.12")
+
+			By("Comparing flow log document counts between the two windows")
+			var countA, countB int64
+			Eventually(func() int64 {
+				countA, _ = SearchFlowLogsCount(esclient, esFlowlogsIndex, elastic.NewTermsQuery("original_source_ips", "11.11.11.11"), &startA, &endA)
+				return countA
+			}, 5*time.Minute, 3*time.Second).Should(BeNumerically(">", 0))
+			Eventually(func() int64 {
+				countB, _ = SearchFlowLogsCount(esclient, esFlowlogsIndex, elastic.NewTermsQuery("original_source_ips", "12.12.12.12"), &startB, &endB)
+				return countB
+			}, 5*time.Minute, 3*time.Second).Should(BeNumerically(">", 0))
+			framework.Logf("Unaggregated count %d, aggregated count %d", countA, countB)
+			Expect(countB).To(BeNumerically("<=", countA),
+				"aggregation should not produce more documents than the unaggregated setting")
+		})
+	})
+
+	Context("Test flow log flush interval timing", func() {
+		BeforeEach(func() {
+			esclient = initializeSetup(f)
+		})
+
+		AfterEach(func() {
+			resetFelixConfig(f)
+		}, 1)
+
+		It("Flushes roughly one aggregated document per flow window", func() {
+			flushInterval := 10 * time.Second
+			trafficDuration := 50 * time.Second
+
+			By("Configuring a short flush interval with full aggregation")
+			calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFLUSHINTERVAL", "10")
+			calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFILEAGGREGATIONKINDFORALLOWED", "2")
+			calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFILEINCLUDESERVICE", "true")
+			calico.RestartCalicoNodePods(f.ClientSet, "")
+
+			By("Creating a server pod behind a clusterIP service")
+			podServer, service := createServerPodAndService(f, f.Namespace, "flow-rate-server", []int{80})
+			defer cleanupServerPodAndService(f, podServer, service)
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Creating a client pod to drive the traffic")
+			client := createExecPodOrFail(f, &source{"", "flow-rate-client", false})
+			defer cleanupExecPodOrFail(f, client)
+
+			By("Generating traffic at a controlled rate")
+			start := time.Now()
+			target := fmt.Sprintf("%s.%s:%d", service.Name, service.Namespace, 80)
+			sent := calico.GenerateTrafficAtRate(f, client, target, 2, trafficDuration)
+			end := time.Now().Add(2 * flushInterval)
+			framework.Logf("Sent %d requests between %v and %v", sent, start, end)
+
+			// With full aggregation, each flush interval should produce about
+			// one document for this flow.  Leave generous tolerance for flush
+			// timing skew and per-node reporting.
+			expectedWindows := int64(trafficDuration / flushInterval)
+
+			By("Comparing the flushed document count with the expected flow windows")
+			query := flowLogQuery{
+				start:                &start,
+				end:                  &end,
+				destServiceName:      service.Name,
+				destServiceNamespace: service.Namespace,
+			}.build()
+			var count int64
+			Eventually(func() int64 {
+				count, _ = SearchFlowLogsCount(esclient, esFlowlogsIndex, query, nil, nil)
+				return count
+			}, 5*time.Minute, 3*time.Second).Should(BeNumerically(">=", expectedWindows/2),
+				"expected at least half of the flow windows to be flushed")
+			Expect(count).To(BeNumerically("<=", expectedWindows*4),
+				"expected roughly one document per flow window per reporting node")
+		})
+	})
+
+	Context("Test service attribution in flow logs", func() {
+		BeforeEach(func() {
+			esclient = initializeSetup(f)
+		})
+
+		AfterEach(func() {
+			resetFelixConfig(f)
+		}, 1)
+
+		It("Attributes clusterIP traffic to the destination service", func() {
+			By("Enabling service attribution in the flow logs")
+			calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFILEINCLUDESERVICE", "true")
+			calico.RestartCalicoNodePods(f.ClientSet, "")
+
+			By("Creating a server pod behind a clusterIP service")
+			podServer, service := createServerPodAndService(f, f.Namespace, "flow-svc-server", []int{80})
+			defer cleanupServerPodAndService(f, podServer, service)
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Generating clusterIP traffic from a client pod")
+			start := time.Now()
+			testCanConnect(f, f.Namespace, "flow-svc-client", service, 80)
+
+			By("Searching for a flow log attributed to the service")
+			end := start.Add(time.Minute * 2)
+			query := flowLogQuery{
+				start:                &start,
+				end:                  &end,
+				destServiceName:      service.Name,
+				destServiceNamespace: service.Namespace,
+			}.build()
+			Expect(waitForFlowLog(esclient, esFlowlogsIndex, query, 5*time.Minute, 3*time.Second)).To(BeTrue(),
+				"expected a flow log with dest_service_name %q in namespace %q", service.Name, service.Namespace)
+		})
+	})
+
+	Context("Test denied flow logs for alerting", func() {
+		BeforeEach(func() {
+			if os.Getenv("ELASTIC_HOST") == "" {
+				framework.Skipf("ELASTIC_HOST is not set; flow logs aren't configured, skipping.")
+			}
+			esclient = initializeSetup(f)
+		})
+
+		AfterEach(func() {
+			resetFelixConfig(f)
+		}, 1)
+
+		It("Records a burst of denied connections with a deny action", func() {
+			calicoctl := calico.ConfigureCalicoctl(f)
+			defer calicoctl.Cleanup()
+
+			By("Creating a server pod behind a clusterIP service")
+			podServer, service := createServerPodAndService(f, f.Namespace, "denied-flow-server", []int{80})
+			defer cleanupServerPodAndService(f, podServer, service)
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Denying all ingress to the server")
+			calicoctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: denied-flow-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				podServer.Name))
+			defer calicoctl.DeleteGNP("denied-flow-deny")
+
+			By("Generating a burst of denied connections")
+			client := createExecPodOrFail(f, &source{"", "denied-flow-client", false})
+			defer cleanupExecPodOrFail(f, client)
+			start := time.Now()
+			target := fmt.Sprintf("%s.%s:%d", service.Name, service.Namespace, 80)
+			attempts := calico.GenerateTrafficAtRate(f, client, target, 5, 10*time.Second)
+			end := start.Add(2 * time.Minute)
+
+			By("Waiting for flow documents recording the denied connections")
+			// An alerting pipeline needs the deny action and the flow tuple;
+			// requiring both here means the documents carry enough to key an
+			// alert on.
+			query := flowLogQuery{
+				action:   "deny",
+				destName: podServer.Name,
+			}.build()
+			var count int64
+			Eventually(func() int64 {
+				count, _ = SearchFlowLogsCount(esclient, esFlowlogsIndex, query, &start, &end)
+				return count
+			}, 5*time.Minute, 3*time.Second).Should(BeNumerically(">", 0),
+				"expected denied flow logs after %d denied connection attempts", attempts)
+			framework.Logf("Found %d denied flow documents for %d attempts", count, attempts)
+		})
+	})
+
+	Context("Test flow log suppression for allowed traffic", func() {
+		BeforeEach(func() {
+			if os.Getenv("ELASTIC_HOST") == "" {
+				framework.Skipf("ELASTIC_HOST is not set; flow logs aren't configured, skipping.")
+			}
+			esclient = initializeSetup(f)
+		})
+
+		AfterEach(func() {
+			resetFelixConfig(f)
+		}, 1)
+
+		It("Does not record allowed flows while file logging is disabled", func() {
+			By("Disabling the flow log file output")
+			calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFILEENABLED", "false")
+			calico.RestartCalicoNodePods(f.ClientSet, "")
+			defer func() {
+				// Turn the file output back on before resetFelixConfig runs so
+				// later flow log tests aren't silently starved of documents.
+				calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFILEENABLED", "true")
+				calico.RestartCalicoNodePods(f.ClientSet, "")
+			}()
+
+			By("Creating a server pod behind a clusterIP service")
+			podServer, service := createServerPodAndService(f, f.Namespace, "no-flow-server", []int{80})
+			defer cleanupServerPodAndService(f, podServer, service)
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Generating allowed traffic")
+			start := time.Now()
+			clientName := "no-flow-client"
+			testCanConnect(f, f.Namespace, clientName, service, 80)
+
+			By("Verifying no flow documents appear for the allowed connection")
+			// Let a couple of flush intervals plus shipping latency pass before
+			// concluding nothing was logged; an immediate zero count proves
+			// nothing.
+			time.Sleep(90 * time.Second)
+			end := time.Now()
+			query := flowLogQuery{
+				sourceName: clientName,
+				destName:   podServer.Name,
+			}.build()
+			count, err := SearchFlowLogsCount(esclient, esFlowlogsIndex, query, &start, &end)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeZero(),
+				"flow documents for %v -> %v were exported despite file logging being disabled", clientName, podServer.Name)
+		})
+	})
+
+	Context("Test staged policy verdicts in flow logs", func() {
+		BeforeEach(func() {
+			if os.Getenv("ELASTIC_HOST") == "" {
+				framework.Skipf("ELASTIC_HOST is not set; flow logs aren't configured, skipping.")
+			}
+			esclient = initializeSetup(f)
+		})
+
+		AfterEach(func() {
+			resetFelixConfig(f)
+		}, 1)
+
+		It("Records a would-deny verdict for a staged policy while traffic still flows", func() {
+			calicoctl := calico.ConfigureCalicoctl(f)
+			defer calicoctl.Cleanup()
+
+			By("Including per-policy verdicts in the flow logs")
+			calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFILEINCLUDEPOLICIES", "true")
+			calico.RestartCalicoNodePods(f.ClientSet, "")
+
+			By("Creating a server pod behind a clusterIP service")
+			podServer, service := createServerPodAndService(f, f.Namespace, "staged-flow-server", []int{80})
+			defer cleanupServerPodAndService(f, podServer, service)
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Staging a deny policy for the server")
+			stagedYaml := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: StagedGlobalNetworkPolicy
+metadata:
+  name: staged-flow-deny
+spec:
+  order: 200
+  selector: pod-name == '%s'
+  types:
+  - Ingress
+  ingress:
+  - action: Deny
+`,
+				podServer.Name)
+			if err := calicoctl.ApplyWithBackoffError(0, stagedYaml); err != nil {
+				framework.Skipf("StagedGlobalNetworkPolicy is not supported by this cluster, skipping: %v", err)
+			}
+			defer calicoctl.Delete(stagedYaml)
+
+			By("Verifying the staged deny does not block traffic")
+			start := time.Now()
+			clientName := "staged-flow-client"
+			testCanConnect(f, f.Namespace, clientName, service, 80)
+			end := start.Add(time.Minute * 2)
+
+			By("Waiting for a flow log carrying the staged would-deny verdict")
+			// The flow must be allowed (the policy is only staged) but the
+			// policies field should record what the staged policy would have
+			// done, which is what policy preview is built on.
+			query := flowLogQuery{
+				start:      &start,
+				end:        &end,
+				action:     "allow",
+				sourceName: clientName,
+				destName:   podServer.Name,
+				policy:     "*staged*staged-flow-deny|deny*",
+			}.build()
+			Expect(waitForFlowLog(esclient, esFlowlogsIndex, query, 5*time.Minute, 3*time.Second)).To(BeTrue(),
+				"expected an allowed flow log recording the staged deny verdict for %v -> %v", clientName, podServer.Name)
+		})
+	})
+
+	Context("Test reporter field in flow logs", func() {
+		BeforeEach(func() {
+			esclient = initializeSetup(f)
+		})
+
+		AfterEach(func() {
+			resetFelixConfig(f)
+		}, 1)
+
+		It("Reports a pod-to-pod flow from both endpoint perspectives", func() {
+			By("Disabling aggregation so documents carry exact pod names")
+			calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFILEAGGREGATIONKINDFORALLOWED", "0")
+			calico.RestartCalicoNodePods(f.ClientSet, "")
+
+			By("Creating a server pod behind a clusterIP service")
+			podServer, service := createServerPodAndService(f, f.Namespace, "flow-reporter-server", []int{80})
+			defer cleanupServerPodAndService(f, podServer, service)
+			err := framework.WaitForPodRunningInNamespace(f.ClientSet, podServer)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Generating traffic from a client pod")
+			start := time.Now()
+			clientName := "flow-reporter-client"
+			testCanConnect(f, f.Namespace, clientName, service, 80)
+			end := start.Add(time.Minute * 2)
+
+			// The felix at each end of the flow exports it from its own
+			// perspective, so one connection produces a source-reporter and a
+			// destination-reporter document with the same source/dest names.
+			// Requiring the full tuple in both queries checks the two
+			// documents describe the same flow.
+			for _, reporter := range []string{"src", "dst"} {
+				By(fmt.Sprintf("Searching for the flow reported by the %v endpoint", reporter))
+				query := flowLogQuery{
+					start:      &start,
+					end:        &end,
+					reporter:   reporter,
+					sourceName: clientName,
+					destName:   podServer.Name,
+				}.build()
+				Expect(waitForFlowLog(esclient, esFlowlogsIndex, query, 5*time.Minute, 3*time.Second)).To(BeTrue(),
+					"expected a %v-reporter flow log for %v -> %v", reporter, clientName, podServer.Name)
+			}
+		})
+	})
 })
 
-//query ES for ip until found with timeout
-func searchES(esclient *elastic.Client, index string, start, end *time.Time, original_source_ips string) {
-	queries := buildIngressFlowLogQuery(start, end, original_source_ips)
+//flowLogSearcher is the narrow slice of the elastic client that the flow log
+//tests use.  It exists so the query construction and retry logic below can be
+//exercised against a fake implementation without a real Elasticsearch.
+type flowLogSearcher interface {
+	//Search returns the number of documents in index matching query.
+	Search(index string, query elastic.Query) (int64, error)
+}
 
-	framework.Logf("searchES: client: %+v index: %v start:%v end:%v original_source_ips:%v", esclient, index, start.String(), end.String(), original_source_ips)
-	Eventually(func() bool {
-		return foundInES(esclient, index, start, end, original_source_ips, queries)
-	}, 5*time.Minute, 3*time.Second).Should(BeTrue())
+//elasticSearcher adapts *elastic.Client to the flowLogSearcher interface.
+type elasticSearcher struct {
+	client *elastic.Client
 }
 
-//check if expected original source ip is found in ES
-func foundInES(esclient *elastic.Client, index string, start, end *time.Time, original_source_ips string, queries elastic.Query) bool {
-	searchResult, err := (esclient.Search().
-		Index(esFlowlogsIndex).
+func (s elasticSearcher) Search(index string, query elastic.Query) (int64, error) {
+	searchResult, err := (s.client.Search().
+		Index(index).
 		Size(0).
-		Query(queries).
+		Query(query).
 		Do(context.Background()))
 	if err != nil {
-		framework.Logf("Failed to search: error: %v", err)
+		return 0, err
 	}
-	return searchResult.Hits.TotalHits > 0
+	return searchResult.Hits.TotalHits, nil
 }
 
-//Build a boolean query for ingress flow logs
-func buildIngressFlowLogQuery(start, end *time.Time, original_source_ips string) elastic.Query {
-	queries := []elastic.Query{}
+//query ES for ip until found with timeout
+func searchES(searcher flowLogSearcher, index string, start, end *time.Time, original_source_ips string) {
+	query := buildIngressFlowLogQuery(start, end, original_source_ips)
 
-	if start != nil && end != nil {
+	framework.Logf("searchES: searcher: %+v index: %v start:%v end:%v original_source_ips:%v", searcher, index, start.String(), end.String(), original_source_ips)
+	Expect(waitForFlowLog(searcher, index, query, 5*time.Minute, 3*time.Second)).To(BeTrue())
+}
+
+//waitForFlowLog polls the searcher until the query matches at least one
+//document or the timeout expires, and reports whether a match was found.
+func waitForFlowLog(searcher flowLogSearcher, index string, query elastic.Query, timeout, interval time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if foundInES(searcher, index, query) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(interval)
+	}
+}
+
+//SearchFlowLogsCount returns the number of flow log documents in the index
+//matching the given query within the [start, end] time window.  Callers can
+//compare counts between two windows, e.g. to verify aggregation behaviour.
+func SearchFlowLogsCount(searcher flowLogSearcher, index string, query elastic.Query, start, end *time.Time) (int64, error) {
+	queries := []elastic.Query{}
+	if query != nil {
+		queries = append(queries, query)
+	}
+	if start != nil || end != nil {
 		withinTimeRange := elastic.NewRangeQuery(endTimeField)
 		if start != nil {
 			withinTimeRange = withinTimeRange.From((*start).Unix())
@@ -1162,13 +1603,90 @@ func buildIngressFlowLogQuery(start, end *time.Time, original_source_ips string)
 		queries = append(queries, withinTimeRange)
 	}
 
-	tq := elastic.NewTermsQuery("original_source_ips", original_source_ips)
-	queries = append(queries, tq)
+	return searcher.Search(index, elastic.NewBoolQuery().Must(queries...))
+}
+
+//check if the query matches any document in ES
+func foundInES(searcher flowLogSearcher, index string, query elastic.Query) bool {
+	count, err := searcher.Search(index, query)
+	if err != nil {
+		framework.Logf("Failed to search: error: %v", err)
+	}
+	return count > 0
+}
+
+//flowLogQuery describes the fields a flow log search matches on; zero-valued
+//fields are left out of the generated query.
+type flowLogQuery struct {
+	start, end        *time.Time
+	originalSourceIPs string
+	// originalSourceIPChain requires every listed IP to be attributed to the
+	// same flow document, for multi-hop proxy chains.
+	originalSourceIPChain []string
+	destServiceName       string
+	destServiceNamespace  string
+	reporter              string
+	sourceName            string
+	destName              string
+	action                string
+	policy                string
+}
+
+//build returns a boolean query matching every field set on q.
+func (q flowLogQuery) build() elastic.Query {
+	queries := []elastic.Query{}
+
+	if q.start != nil && q.end != nil {
+		withinTimeRange := elastic.NewRangeQuery(endTimeField)
+		withinTimeRange = withinTimeRange.From((*q.start).Unix())
+		withinTimeRange = withinTimeRange.To((*q.end).Unix())
+		queries = append(queries, withinTimeRange)
+	}
+
+	if q.originalSourceIPs != "" {
+		queries = append(queries, elastic.NewTermsQuery("original_source_ips", q.originalSourceIPs))
+	}
+	// original_source_ips is a keyword array, so one terms query per hop
+	// asserts that the whole chain landed in the same document; hit-count
+	// queries cannot additionally observe the order the array stores.
+	for _, ip := range q.originalSourceIPChain {
+		queries = append(queries, elastic.NewTermsQuery("original_source_ips", ip))
+	}
+	if q.destServiceName != "" {
+		queries = append(queries, elastic.NewTermsQuery("dest_service_name", q.destServiceName))
+	}
+	if q.destServiceNamespace != "" {
+		queries = append(queries, elastic.NewTermsQuery("dest_service_namespace", q.destServiceNamespace))
+	}
+	if q.reporter != "" {
+		queries = append(queries, elastic.NewTermsQuery("reporter", q.reporter))
+	}
+	if q.sourceName != "" {
+		queries = append(queries, elastic.NewTermsQuery("source_name", q.sourceName))
+	}
+	if q.destName != "" {
+		queries = append(queries, elastic.NewTermsQuery("dest_name", q.destName))
+	}
+	if q.action != "" {
+		queries = append(queries, elastic.NewTermsQuery("action", q.action))
+	}
+	if q.policy != "" {
+		// policies is a nested field whose entries look like
+		// "<index>|<tier>|<name>|<verdict>", so matching on a policy needs a
+		// nested wildcard query.
+		queries = append(queries, elastic.NewNestedQuery("policies",
+			elastic.NewWildcardQuery("policies.all_policies", q.policy)))
+	}
 
 	return elastic.NewBoolQuery().Must(queries...)
 }
 
-func initializeSetup(f *framework.Framework)  *elastic.Client {
+//Build a boolean query for ingress flow logs
+func buildIngressFlowLogQuery(start, end *time.Time, original_source_ips string) elastic.Query {
+	return flowLogQuery{start: start, end: end, originalSourceIPs: original_source_ips}.build()
+}
+
+func initializeSetup(f *framework.Framework) flowLogSearcher {
 	if os.Getenv("ELASTIC_HOST") == "" {
 		os.Setenv("ELASTIC_HOST",  "127.0.0.1")
 	}
@@ -1193,7 +1711,7 @@ func initializeSetup(f *framework.Framework)  *elastic.Client {
 	calico.SetCalicoNodeEnvironmentWithRetry(f.ClientSet, "FELIX_FLOWLOGSFILEAGGREGATIONKINDFORALLOWED", "1")
 	calico.RestartCalicoNodePods(f.ClientSet, "")
 
-	return esclient
+	return elasticSearcher{esclient}
 }
 
 func resetFelixConfig(f *framework.Framework) {
@@ -1227,6 +1745,12 @@ func resetFelixConfig(f *framework.Framework) {
 
 //based on isHTTPS flag value - curl http or https to the backend service.
 func testForProtocolFlowLogs(f *framework.Framework, namespace, podName, servicePort, servicePath, x_real_ip_hdr string, isHTTPS bool) string {
+	return testForProtocolFlowLogsX(f, namespace, podName, servicePort, servicePath, x_real_ip_hdr, fwdedIPHeader, isHTTPS)
+}
+
+//testForProtocolFlowLogsX is testForProtocolFlowLogs with the X-Forwarded-For
+//header under the caller's control, for multi-proxy chain tests.
+func testForProtocolFlowLogsX(f *framework.Framework, namespace, podName, servicePort, servicePath, x_real_ip_hdr, xff_hdr string, isHTTPS bool) string {
 	var clientPod *v1.Pod
 
 	//ensure pods are running in the namespace.
@@ -1235,7 +1759,7 @@ func testForProtocolFlowLogs(f *framework.Framework, namespace, podName, service
 		time.Sleep(time.Second * 3)
 	}
 
-	clientPod = createHTTPClientPod(f, podName, servicePort, servicePath, x_real_ip_hdr, isHTTPS)
+	clientPod = createHTTPClientPod(f, podName, servicePort, servicePath, x_real_ip_hdr, xff_hdr, isHTTPS)
 
 	err := framework.WaitForPodSuccessInNamespace(f.ClientSet, clientPod.Name, "default")
 	if err != nil {
@@ -1246,7 +1770,7 @@ func testForProtocolFlowLogs(f *framework.Framework, namespace, podName, service
 	return clientPod.Status.PodIP
 }
 
-func createHTTPClientPod(f *framework.Framework, clientPodName, servicePort, servicePath, x_real_ip_hdr string, isHTTPS bool) *v1.Pod {
+func createHTTPClientPod(f *framework.Framework, clientPodName, servicePort, servicePath, x_real_ip_hdr, xff_hdr string, isHTTPS bool) *v1.Pod {
 	//use IP from internal IPs to build curl command.
 	IPs := getNodeInternalIPs(f)
 	framework.Logf("Private IPs are: %+v", IPs)
@@ -1257,9 +1781,9 @@ func createHTTPClientPod(f *framework.Framework, clientPodName, servicePort, ser
 	cmdArgs := []string{}
 	cmdArgs = append(cmdArgs, "-c")
 	if !isHTTPS {
-		cmdArgs = append(cmdArgs, fmt.Sprintf("curl http://%s:%s/%s -H '%s' -H '%s' -w 1 --retry 100", privateIP, servicePort, servicePath, x_real_ip_hdr, fwdedIPHeader))
+		cmdArgs = append(cmdArgs, fmt.Sprintf("curl http://%s:%s/%s -H '%s' -H '%s' -w 1 --retry 100", privateIP, servicePort, servicePath, x_real_ip_hdr, xff_hdr))
 	} else {
-		cmdArgs = append(cmdArgs, fmt.Sprintf("curl https://%s:%s/%s -H \"%s\" -H \"%s\" --insecure", privateIP, servicePort, servicePath, x_real_ip_hdr, fwdedIPHeader))
+		cmdArgs = append(cmdArgs, fmt.Sprintf("curl https://%s:%s/%s -H \"%s\" -H \"%s\" --insecure", privateIP, servicePort, servicePath, x_real_ip_hdr, xff_hdr))
 	}
 
 	clientPod := createCurlClientPod(f, "default", clientPodName, clientPodImageURL, cmdArgs)
@@ -1336,16 +1860,8 @@ func setupHTTPService(f *framework.Framework) error {
 		framework.Logf("Failed to setup ingress controller: %v", err)
 	}
 	Expect(err).To(BeNil())
-	err = framework.WaitForService(f.ClientSet, "ingress-nginx", "default-backend", true, framework.Poll, framework.ServiceRespondingTimeout)
-	if err != nil {
-		framework.Logf("Failed to see service %v running", "default-backend")
-	}
-	Expect(err).NotTo(HaveOccurred())
-
-	err = framework.WaitForService(f.ClientSet, "ingress-nginx", "nginx-ingress", true, framework.Poll, framework.ServiceRespondingTimeout)
-	if err != nil {
-		framework.Logf("Failed to see service %v running", "nginx-ingress")
-	}
+	err = calico.WaitForServicesReady(f, "ingress-nginx",
+		[]string{"default-backend", "nginx-ingress"}, framework.ServiceRespondingTimeout)
 	Expect(err).NotTo(HaveOccurred())
 	return err
 }
@@ -1433,18 +1949,9 @@ func createHTTPSIngressDeployment(f *framework.Framework) {
 		framework.Logf("Failed to setup ingress controller for HTTPS: %v", err)
 	}
 	Expect(err).To(BeNil())
-	err = framework.WaitForService(f.ClientSet, "ingress-nginx-https", "nginxsvc", true, framework.Poll, framework.ServiceRespondingTimeout)
-	if err != nil {
-		framework.Logf("Failed to see service %v running", "nginxsvc")
-	}
-	Expect(err).NotTo(HaveOccurred())
-
-	err = framework.WaitForService(f.ClientSet, "ingress-nginx-https", "nginx-ingress-https", true, framework.Poll, framework.ServiceRespondingTimeout)
-	if err != nil {
-		framework.Logf("Failed to see service %v running", "nginx-ingress-https")
-	}
+	err = calico.WaitForServicesReady(f, "ingress-nginx-https",
+		[]string{"nginxsvc", "nginx-ingress-https"}, framework.ServiceRespondingTimeout)
 	Expect(err).NotTo(HaveOccurred())
-
 }
 
 func cleanupHTTPSIngressDeployment() {
@@ -1479,24 +1986,10 @@ func createMultipleIngressesScenario(f *framework.Framework)  {
 	}
 	Expect(err).To(BeNil())
 
-	err = framework.WaitForService(f.ClientSet, "ingress-nginx-multiple-ic", "default-backend-multiple-ic", true, framework.Poll, framework.ServiceRespondingTimeout)
-	if err != nil {
-		framework.Logf("Failed to see service %v running", "default-backend-multiple-ic")
-	}
-	Expect(err).NotTo(HaveOccurred())
-
-	err = framework.WaitForService(f.ClientSet, "ingress-nginx-multiple-ic", "nginx-ingress-multiple-ic-1", true, framework.Poll, framework.ServiceRespondingTimeout)
-	if err != nil {
-		framework.Logf("Failed to see service %v running", "ingress-nginx-multiple-ic-1")
-	}
+	err = calico.WaitForServicesReady(f, "ingress-nginx-multiple-ic",
+		[]string{"default-backend-multiple-ic", "nginx-ingress-multiple-ic-1", "nginx-ingress-multiple-ic-2"},
+		framework.ServiceRespondingTimeout)
 	Expect(err).NotTo(HaveOccurred())
-
-	err = framework.WaitForService(f.ClientSet, "ingress-nginx-multiple-ic", "nginx-ingress-multiple-ic-2", true, framework.Poll, framework.ServiceRespondingTimeout)
-	if err != nil {
-		framework.Logf("Failed to see service %v running", "ingress-nginx-multiple-ic-2")
-	}
-	Expect(err).NotTo(HaveOccurred())
-
 }
 
 func cleanupMultipleIngressesScenario() {
@@ -0,0 +1,176 @@
+package network
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// fakeSearcher scripts Search results and records the calls made, so the
+// flow log query construction and retry logic can be tested without an
+// Elasticsearch instance.
+type fakeSearcher struct {
+	// counts holds the hit count to return for each successive call; the
+	// last entry is repeated once the script runs out.
+	counts  []int64
+	calls   int
+	indices []string
+	queries []elastic.Query
+}
+
+func (s *fakeSearcher) Search(index string, query elastic.Query) (int64, error) {
+	s.indices = append(s.indices, index)
+	s.queries = append(s.queries, query)
+	count := int64(0)
+	if s.calls < len(s.counts) {
+		count = s.counts[s.calls]
+	} else if len(s.counts) > 0 {
+		count = s.counts[len(s.counts)-1]
+	}
+	s.calls++
+	return count, nil
+}
+
+// querySource renders a query the way the elastic client would serialize it.
+func querySource(t *testing.T, query elastic.Query) string {
+	src, err := query.Source()
+	if err != nil {
+		t.Fatalf("failed to get query source: %v", err)
+	}
+	b, err := json.Marshal(src)
+	if err != nil {
+		t.Fatalf("failed to marshal query source: %v", err)
+	}
+	return string(b)
+}
+
+func TestBuildIngressFlowLogQuery(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := time.Unix(2000, 0)
+	src := querySource(t, buildIngressFlowLogQuery(&start, &end, "1.2.3.4"))
+	for _, want := range []string{`"original_source_ips"`, `"1.2.3.4"`, `"` + endTimeField + `"`, `"from":1000`, `"to":2000`} {
+		if !strings.Contains(src, want) {
+			t.Errorf("query %v does not contain %v", src, want)
+		}
+	}
+}
+
+func TestBuildIngressFlowLogQueryNoTimeRange(t *testing.T) {
+	src := querySource(t, buildIngressFlowLogQuery(nil, nil, "1.2.3.4"))
+	if strings.Contains(src, endTimeField) {
+		t.Errorf("query %v should not contain a %v range", src, endTimeField)
+	}
+	if !strings.Contains(src, `"1.2.3.4"`) {
+		t.Errorf("query %v does not match on the original source ip", src)
+	}
+}
+
+func TestBuildChainFlowLogQuery(t *testing.T) {
+	src := querySource(t, flowLogQuery{
+		originalSourceIPChain: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"},
+	}.build())
+	for _, want := range []string{`"original_source_ips"`, `"1.1.1.1"`, `"2.2.2.2"`, `"3.3.3.3"`} {
+		if !strings.Contains(src, want) {
+			t.Errorf("query %v does not contain %v", src, want)
+		}
+	}
+	// Each hop must be its own clause so a single document has to match all
+	// of them; one terms query with three values would match any one hop.
+	if strings.Count(src, "original_source_ips") != 3 {
+		t.Errorf("query %v should match each hop with its own clause", src)
+	}
+}
+
+func TestBuildServiceFlowLogQuery(t *testing.T) {
+	src := querySource(t, flowLogQuery{
+		destServiceName:      "frontend",
+		destServiceNamespace: "shop",
+	}.build())
+	for _, want := range []string{`"dest_service_name"`, `"frontend"`, `"dest_service_namespace"`, `"shop"`} {
+		if !strings.Contains(src, want) {
+			t.Errorf("query %v does not contain %v", src, want)
+		}
+	}
+	if strings.Contains(src, "original_source_ips") {
+		t.Errorf("query %v should not match on original_source_ips", src)
+	}
+	if strings.Contains(src, endTimeField) {
+		t.Errorf("query %v should not contain a %v range", src, endTimeField)
+	}
+}
+
+func TestBuildReporterFlowLogQuery(t *testing.T) {
+	src := querySource(t, flowLogQuery{
+		reporter:   "src",
+		sourceName: "client-pod",
+		destName:   "server-pod",
+	}.build())
+	for _, want := range []string{`"reporter"`, `"src"`, `"source_name"`, `"client-pod"`, `"dest_name"`, `"server-pod"`} {
+		if !strings.Contains(src, want) {
+			t.Errorf("query %v does not contain %v", src, want)
+		}
+	}
+	if strings.Contains(src, "dest_service_name") {
+		t.Errorf("query %v should not match on dest_service_name", src)
+	}
+}
+
+func TestBuildDeniedFlowLogQuery(t *testing.T) {
+	src := querySource(t, flowLogQuery{
+		action:   "deny",
+		destName: "server-pod",
+	}.build())
+	for _, want := range []string{`"action"`, `"deny"`, `"dest_name"`, `"server-pod"`} {
+		if !strings.Contains(src, want) {
+			t.Errorf("query %v does not contain %v", src, want)
+		}
+	}
+}
+
+func TestSearchFlowLogsCount(t *testing.T) {
+	fake := &fakeSearcher{counts: []int64{42}}
+	start := time.Unix(1000, 0)
+	end := time.Unix(2000, 0)
+	count, err := SearchFlowLogsCount(fake, "test-index", elastic.NewTermsQuery("original_source_ips", "1.2.3.4"), &start, &end)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 42 {
+		t.Errorf("expected count 42, got %d", count)
+	}
+	if fake.calls != 1 {
+		t.Fatalf("expected 1 search, got %d", fake.calls)
+	}
+	if fake.indices[0] != "test-index" {
+		t.Errorf("expected search against test-index, got %v", fake.indices[0])
+	}
+	src := querySource(t, fake.queries[0])
+	for _, want := range []string{`"original_source_ips"`, `"` + endTimeField + `"`} {
+		if !strings.Contains(src, want) {
+			t.Errorf("query %v does not contain %v", src, want)
+		}
+	}
+}
+
+func TestWaitForFlowLogRetriesUntilFound(t *testing.T) {
+	fake := &fakeSearcher{counts: []int64{0, 0, 1}}
+	if !waitForFlowLog(fake, "test-index", elastic.NewMatchAllQuery(), time.Second, time.Millisecond) {
+		t.Fatal("expected the flow log to be found")
+	}
+	if fake.calls != 3 {
+		t.Errorf("expected 3 searches before the match, got %d", fake.calls)
+	}
+}
+
+func TestWaitForFlowLogTimesOut(t *testing.T) {
+	fake := &fakeSearcher{counts: []int64{0}}
+	if waitForFlowLog(fake, "test-index", elastic.NewMatchAllQuery(), 10*time.Millisecond, time.Millisecond) {
+		t.Fatal("expected the wait to time out without a match")
+	}
+	if fake.calls < 2 {
+		t.Errorf("expected the wait to retry, got %d searches", fake.calls)
+	}
+}
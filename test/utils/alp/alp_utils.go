@@ -98,6 +98,65 @@ func EnableIstioInjectionForNamespace(f *framework.Framework, ns *v1.Namespace)
 	framework.Failf("istio sidecars failed to be injected for namespace %s", ns.Name)
 }
 
+// SetServicePortAppProtocol declares the application protocol carried by each
+// of the service's ports.  This API version predates the ServicePort
+// appProtocol field, so the declaration is made the way Istio and the L7
+// policy pipeline consume it here: by renaming every port to the
+// "<protocol>-<port>" convention.  The updated service is returned.  Sidecars
+// pick the change up asynchronously from pilot, so callers should allow their
+// first probes after a change to retry.
+func SetServicePortAppProtocol(f *framework.Framework, service *v1.Service, protocol string) *v1.Service {
+	svc, err := f.ClientSet.CoreV1().Services(service.Namespace).Get(service.Name, metav1.GetOptions{})
+	Expect(err).NotTo(HaveOccurred())
+	for i := range svc.Spec.Ports {
+		svc.Spec.Ports[i].Name = fmt.Sprintf("%s-%d", protocol, svc.Spec.Ports[i].Port)
+	}
+	svc, err = f.ClientSet.CoreV1().Services(service.Namespace).Update(svc)
+	Expect(err).NotTo(HaveOccurred())
+	framework.Logf("Declared app protocol %q on service %s/%s via the port name convention",
+		protocol, svc.Namespace, svc.Name)
+	return svc
+}
+
+// DisableIstioInjectionForNamespace is the inverse of
+// EnableIstioInjectionForNamespace: it removes the injection label so the
+// Istio Sidecar Injector leaves newly created pods alone.  Pods that already
+// have sidecars keep them; only pods created after the label change are
+// affected.
+func DisableIstioInjectionForNamespace(f *framework.Framework, ns *v1.Namespace) {
+	delete(ns.Labels, "istio-injection")
+	_, err := f.ClientSet.CoreV1().Namespaces().Update(ns)
+	Expect(err).ToNot(HaveOccurred())
+
+	// Wait until the injector stops adding sidecars to new pods.
+	framework.Logf("Verifying istio injector leaves new pods alone.")
+	checkPodFunc := func(f *framework.Framework, ns *v1.Namespace) bool {
+		execPodName := framework.CreateExecPodOrFail(f.ClientSet, ns.Name, "alpexec-", nil)
+		pod, err := f.ClientSet.CoreV1().Pods(ns.Name).Get(execPodName, metav1.GetOptions{})
+		Expect(err).ToNot(HaveOccurred())
+
+		defer func() {
+			framework.DeletePodOrFail(f.ClientSet, ns.Name, execPodName)
+			WaitForPodNotFoundInNamespace(f, ns, execPodName)
+		}()
+
+		return !checkPodSideCars(pod)
+	}
+
+	startTime := time.Now()
+	for time.Since(startTime) < 30*time.Second {
+		if checkPodFunc(f, ns) {
+			return
+		}
+
+		framework.Logf("Retrying sidecar absence check...")
+		time.Sleep(2 * time.Second)
+
+	}
+
+	framework.Failf("istio sidecars are still injected for namespace %s after removing the label", ns.Name)
+}
+
 func GetProbeAndTargetDiags(f *framework.Framework, probePod, targetPod *v1.Pod, probeContainerName string) string {
 	dikastesLogs, logErr := framework.GetPodLogs(f.ClientSet, targetPod.Namespace, targetPod.Name, DikastesContainerName)
 	if logErr != nil {
@@ -20,13 +20,17 @@ package calico
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"text/template"
@@ -91,6 +95,14 @@ func GenerateRandomName(base string) string {
 	return fmt.Sprintf("%s-%s", base, utilrand.String(randomLength))
 }
 
+// UniqueName returns base suffixed with a short random string.  Use it for
+// cluster-scoped resources (policies, host endpoints) that are created with
+// inline names, so specs running concurrently — or resources leaked by an
+// aborted prior run — can't collide.
+func UniqueName(base string) string {
+	return GenerateRandomName(base)
+}
+
 func ReadTestFileOrDie(file string, config ...interface{}) string {
 	v := string(generated.ReadOrDie(path.Join(calicoctlManifestPath, file)))
 	if len(config) == 1 {
@@ -407,6 +419,723 @@ func commandExists(cmd string, node *v1.Node) bool {
 	return true
 }
 
+// FelixMetricAuth holds the credentials for a secured felix metrics endpoint.
+// When felix serves its Prometheus reporter over TLS with authentication, the
+// scrape must present a bearer token and trust the serving certificate.
+type FelixMetricAuth struct {
+	// Token is sent as an Authorization bearer header.
+	Token string
+	// CAFile is the path (inside the scraping pod) of the CA certificate to
+	// verify the endpoint with.  Leave empty to skip verification.
+	CAFile string
+}
+
+// GetFelixMetric scrapes the Prometheus reporter endpoint of the calico-node
+// running on the given node IP (port 9081, enabled through
+// FELIX_PROMETHEUSREPORTERENABLED) and returns the value of the named metric.
+// If labels are supplied, only samples carrying all of those label values are
+// counted; when several samples match their values are summed.  A successful
+// scrape in which no sample matches returns 0, since felix only emits counters
+// such as calico_denied_packets once they first increment.
+func GetFelixMetric(f *framework.Framework, nodeIP, metricName string, labels map[string]string) (float64, error) {
+	return GetFelixMetricWithAuth(f, nodeIP, metricName, labels, nil)
+}
+
+// GetFelixMetricWithAuth is GetFelixMetric for clusters whose felix metrics
+// endpoint is secured; pass nil auth for a plain HTTP scrape.
+func GetFelixMetricWithAuth(f *framework.Framework, nodeIP, metricName string, labels map[string]string, auth *FelixMetricAuth) (float64, error) {
+	cmd := fmt.Sprintf("curl http://%s:9081/metrics --fail", nodeIP)
+	if auth != nil {
+		cmd = fmt.Sprintf("curl https://%s:9081/metrics --fail -H 'Authorization: Bearer %s'", nodeIP, auth.Token)
+		if auth.CAFile != "" {
+			cmd += fmt.Sprintf(" --cacert %s", auth.CAFile)
+		} else {
+			cmd += " -k"
+		}
+	}
+	output, err := ExecuteCmdInPod(f, cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := float64(0)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") || !strings.HasPrefix(line, metricName) {
+			continue
+		}
+		matched := true
+		for k, v := range labels {
+			if !strings.Contains(line, fmt.Sprintf(`%s="%s"`, k, v)) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		fields := strings.Fields(line)
+		value, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse metric line %q: %v", line, err)
+		}
+		sum += value
+	}
+	return sum, nil
+}
+
+// HostEndpointFailsafeName is the name of the GlobalNetworkPolicy installed
+// by ApplyHostEndpointFailsafes; use it with DeleteGNP to clean up.
+const HostEndpointFailsafeName = "allow-failsafe-800"
+
+// ApplyHostEndpointFailsafes installs a GlobalNetworkPolicy keeping the
+// standard control-plane ports (kubelet 10250, apiserver 6443, etcd 2379 and
+// DNS 53) open on host endpoints matching the given selector.  A host
+// endpoint without such a policy hits default deny and cuts off kubelet
+// traffic, so kubectl exec/log against pods on that node stop working.
+func ApplyHostEndpointFailsafes(ctl *Calicoctl, selector string) {
+	policyStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: %s
+spec:
+  applyOnForward: false
+  selector: %s
+  order: 800
+  ingress:
+  - action: Allow
+    protocol: TCP
+    destination:
+      ports:
+      - 10250
+      - 6443
+      - 2379
+      - 53
+  - action: Allow
+    protocol: UDP
+    destination:
+      ports:
+      - 53
+  egress:
+  - action: Allow
+    protocol: TCP
+    source:
+      ports:
+      - 10250
+      - 6443
+      - 2379
+      - 53
+  - action: Allow
+    protocol: UDP
+    source:
+      ports:
+      - 53
+`,
+		HostEndpointFailsafeName, selector)
+	ctl.Apply(policyStr)
+}
+
+// AllowDNSEgressName is the name of the GlobalNetworkPolicy installed by
+// AllowDNSEgress; use it with DeleteGNP to clean up.
+const AllowDNSEgressName = "allow-dns-egress-400"
+
+// AllowDNSEgress installs a GlobalNetworkPolicy that lets pods matching the
+// given selector reach kube-dns on UDP and TCP port 53.  An egress
+// default-deny that forgets DNS makes every connection by name fail at
+// resolution rather than at connect time, which is a common and confusing
+// break; apply this alongside such policies.
+func AllowDNSEgress(ctl *Calicoctl, selector string) {
+	ctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: %s
+spec:
+  order: 400
+  selector: %s
+  egress:
+  - action: Allow
+    protocol: UDP
+    destination:
+      selector: projectcalico.org/namespace == "kube-system" && k8s-app == "kube-dns"
+      ports:
+      - 53
+  - action: Allow
+    protocol: TCP
+    destination:
+      selector: projectcalico.org/namespace == "kube-system" && k8s-app == "kube-dns"
+      ports:
+      - 53
+`,
+		AllowDNSEgressName, selector))
+}
+
+// NamespaceDefaultDenyName is the name of the namespaced NetworkPolicy
+// installed by ApplyNamespaceDefaultDeny.
+const NamespaceDefaultDenyName = "default-deny"
+
+// ApplyNamespaceDefaultDeny installs the canonical default deny for a single
+// namespace: a namespaced NetworkPolicy isolating every pod in it for both
+// ingress and egress, plus the standard DNS egress allow so name resolution
+// keeps working.  This is the policy pair users most commonly write, so tests
+// that lock a namespace down should share this one implementation.  The
+// returned function removes both policies; because the DNS allow is the shared
+// AllowDNSEgress policy, only lock down one namespace at a time.
+func ApplyNamespaceDefaultDeny(ctl *Calicoctl, namespace string) func() {
+	ctl.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: NetworkPolicy
+metadata:
+  name: %s
+  namespace: %s
+spec:
+  order: 5000
+  selector: all()
+  types:
+  - Ingress
+  - Egress
+`,
+		NamespaceDefaultDenyName, namespace))
+	AllowDNSEgress(ctl, fmt.Sprintf("projectcalico.org/namespace == '%s'", namespace))
+	return func() {
+		ctl.DeleteGNP(AllowDNSEgressName)
+		ctl.DeleteNP(namespace, NamespaceDefaultDenyName)
+	}
+}
+
+// GlobalDefaultDenySafetyName is the name of the GlobalNetworkPolicy
+// installed by ApplyGlobalDefaultDenySafetyAllows; use it with DeleteGNP to
+// clean up.
+const GlobalDefaultDenySafetyName = "allow-cluster-essentials-0"
+
+// ApplyGlobalDefaultDenySafetyAllows installs a high-priority
+// GlobalNetworkPolicy that keeps the cluster functional under an all()
+// default deny: traffic to and from kube-system workloads (DNS and friends),
+// DNS lookups, and connections to the API server stay allowed, while
+// everything else falls through to lower-priority policies.  Any test that
+// applies a cluster-wide default deny must apply this first, or it takes the
+// control plane down with it.
+func ApplyGlobalDefaultDenySafetyAllows(ctl *Calicoctl) {
+	policyStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: %s
+spec:
+  order: 0
+  selector: all()
+  types:
+  - Ingress
+  - Egress
+  ingress:
+  - action: Allow
+    source:
+      selector: projectcalico.org/namespace == 'kube-system'
+  egress:
+  - action: Allow
+    destination:
+      selector: projectcalico.org/namespace == 'kube-system'
+  - action: Allow
+    protocol: UDP
+    destination:
+      ports:
+      - 53
+  - action: Allow
+    protocol: TCP
+    destination:
+      ports:
+      - 53
+      - 443
+      - 6443
+`,
+		GlobalDefaultDenySafetyName)
+	ctl.Apply(policyStr)
+}
+
+// TestConnectionFromHost runs a wget as a local process on the given node via
+// SSH, targeting host:port, and returns an error if the connection fails.
+// Unlike pod-sourced probes this exercises traffic originating from the host
+// itself, which host endpoint policy governs even with applyOnForward false.
+func TestConnectionFromHost(node *v1.Node, target string) error {
+	cmd := fmt.Sprintf("wget -q -T 5 -t 1 -O - http://%s", target)
+	result, err := framework.IssueSSHCommandWithResult(cmd, framework.TestContext.Provider, node)
+	if err != nil {
+		return err
+	}
+	if result.Code != 0 {
+		return fmt.Errorf("command %q on node %s failed with code %d: %s",
+			cmd, node.Name, result.Code, result.Stderr)
+	}
+	return nil
+}
+
+var danglingOperatorRegexp = regexp.MustCompile(`(==|!=|&&|\|\|)\s*$`)
+
+// ValidateSelector performs a lightweight client-side syntax check on a
+// Calico selector expression and returns an error describing the first
+// problem found.  It is not a full parser; it catches the common authoring
+// mistakes -- unbalanced parentheses, unterminated quotes and dangling
+// operators -- so tests can reject garbage before round-tripping it through
+// calicoctl, whose job-based error reporting loses the rejection message.
+func ValidateSelector(selector string) error {
+	depth := 0
+	var quote rune
+	for i, r := range selector {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("selector %q: unmatched ')' at position %d", selector, i)
+			}
+		}
+	}
+	if quote != 0 {
+		return fmt.Errorf("selector %q: unterminated %c-quoted string", selector, quote)
+	}
+	if depth != 0 {
+		return fmt.Errorf("selector %q: %d unclosed '('", selector, depth)
+	}
+	if danglingOperatorRegexp.MatchString(selector) {
+		return fmt.Errorf("selector %q: expression ends with an operator", selector)
+	}
+	return nil
+}
+
+// IPInCIDR reports whether the given IP address falls inside the CIDR, e.g.
+// to check which IPPool a pod was allocated from.
+func IPInCIDR(ip, cidr string) (bool, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, fmt.Errorf("bad CIDR %q: %v", cidr, err)
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false, fmt.Errorf("bad IP address %q", ip)
+	}
+	return ipNet.Contains(parsed), nil
+}
+
+// Block describes a single Calico IPAM block, as reported by calicoctl.
+type Block struct {
+	// CIDR of the block, e.g. "192.168.82.0/26".
+	CIDR string
+	// Affinity of the block, e.g. "host:node1".
+	Affinity string
+}
+
+// GetIPAMBlocks returns the IPAM blocks affine to the given Calico node.
+func (c *Calicoctl) GetIPAMBlocks(node string) ([]Block, error) {
+	out, err := c.execReturnError(DefaultCalicoctlBackoffLimit, "get", "ipamblocks", "-o", "json")
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []struct {
+			Spec struct {
+				CIDR     string `json:"cidr"`
+				Affinity string `json:"affinity"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, fmt.Errorf("error unmarshalling ipamblocks: %v\nResponse: %s", err, out)
+	}
+	blocks := []Block{}
+	for _, item := range list.Items {
+		if item.Spec.Affinity == "host:"+node {
+			blocks = append(blocks, Block{CIDR: item.Spec.CIDR, Affinity: item.Spec.Affinity})
+		}
+	}
+	return blocks, nil
+}
+
+// GetWorkloadEndpointIPNATs returns the 1:1 NAT mappings (internal pod IP to
+// external floating IP) on the workload endpoint of the given pod, as
+// programmed from the pod's cni.projectcalico.org/floatingIPs annotation.  An
+// empty result means the CNI plugin did not act on the annotation, i.e. the
+// floating IP feature is not enabled in this cluster.
+func (c *Calicoctl) GetWorkloadEndpointIPNATs(namespace, podName string) (map[string]string, error) {
+	out, err := c.execReturnError(DefaultCalicoctlBackoffLimit, "get", "workloadendpoints", "-n", namespace, "-o", "json")
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []struct {
+			Spec struct {
+				Pod    string `json:"pod"`
+				IPNATs []struct {
+					InternalIP string `json:"internalIP"`
+					ExternalIP string `json:"externalIP"`
+				} `json:"ipNATs"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, fmt.Errorf("error unmarshalling workloadendpoints: %v\nResponse: %s", err, out)
+	}
+	nats := map[string]string{}
+	for _, item := range list.Items {
+		if item.Spec.Pod != podName {
+			continue
+		}
+		for _, nat := range item.Spec.IPNATs {
+			nats[nat.InternalIP] = nat.ExternalIP
+		}
+	}
+	return nats, nil
+}
+
+// WaitForIPAMBlock waits until the given node has at least one affine IPAM
+// block, so pods scheduled there can be assigned IPs.  Scheduling a pod on a
+// node before it has a block is a common source of connectivity flakes.
+func (c *Calicoctl) WaitForIPAMBlock(node string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		blocks, err := c.GetIPAMBlocks(node)
+		if err == nil && len(blocks) > 0 {
+			framework.Logf("Node %s has %d affine IPAM block(s)", node, len(blocks))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("failed to list IPAM blocks for node %s: %v", node, err)
+			}
+			return fmt.Errorf("node %s has no affine IPAM block after %v; it cannot allocate pod IPs", node, timeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// CountConntrackEntries returns the number of conntrack table entries on the
+// given node whose line matches the grep filter (e.g. "dport=8080"), by
+// reading /proc/net/nf_conntrack over SSH.  Untracked (doNotTrack) flows
+// never show up there.
+func CountConntrackEntries(node *v1.Node, filter string) (int, error) {
+	cmd := fmt.Sprintf("sudo cat /proc/net/nf_conntrack | grep -c '%s' || true", filter)
+	result, err := framework.IssueSSHCommandWithResult(cmd, framework.TestContext.Provider, node)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(result.Stdout))
+}
+
+// WaitForIPVSService waits until kube-proxy has programmed (present=true) or
+// removed (present=false) an IPVS virtual service for the given address and
+// port on the node, by reading `ipvsadm -ln` over SSH.  It returns an error
+// straight away if the table can't be read at all — e.g. on an iptables-mode
+// cluster — so callers can tell "no IPVS" apart from "not programmed yet" and
+// skip accordingly.
+func WaitForIPVSService(node *v1.Node, vip string, port int, present bool, timeout time.Duration) error {
+	result, err := framework.IssueSSHCommandWithResult("sudo ipvsadm -ln", framework.TestContext.Provider, node)
+	if err != nil || result.Code != 0 {
+		return fmt.Errorf("cannot read the IPVS table on node %s: %v", node.Name, err)
+	}
+	entry := fmt.Sprintf("%s:%d", vip, port)
+	return wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		result, err := framework.IssueSSHCommandWithResult("sudo ipvsadm -ln", framework.TestContext.Provider, node)
+		if err != nil {
+			return false, err
+		}
+		return strings.Contains(result.Stdout, entry) == present, nil
+	})
+}
+
+// GenerateTrafficAtRate issues HTTP requests from the given client pod to
+// target at roughly rps requests per second for the given duration, and
+// returns the number of requests attempted.  Pacing is done with a shell loop
+// inside the pod, so the achieved rate is approximate; individual request
+// failures do not abort the loop.
+func GenerateTrafficAtRate(f *framework.Framework, pod *v1.Pod, target string, rps int, duration time.Duration) int {
+	count := int(duration.Seconds()) * rps
+	if count < 1 {
+		count = 1
+	}
+	interval := fmt.Sprintf("%.3f", 1.0/float64(rps))
+	cmd := fmt.Sprintf(
+		"for i in $(seq 1 %d); do wget -q -T 2 -O /dev/null http://%s || true; sleep %s; done",
+		count, target, interval)
+	framework.Logf("Generating %d requests to %s at ~%d rps from pod %s", count, target, rps, pod.Name)
+	_, err := framework.RunHostCmd(pod.Namespace, pod.Name, cmd)
+	framework.ExpectNoError(err, "failed to generate traffic from pod %s to %s", pod.Name, target)
+	return count
+}
+
+// Outcomes reported by ProbeConnectionOutcome.
+const (
+	ProbeOutcomeConnected = "connected"
+	ProbeOutcomeTimeout   = "timeout"
+	ProbeOutcomeRefused   = "refused"
+)
+
+// ProbeConnectionOutcome attempts one TCP connection from the client pod to
+// host:port and classifies the result as connected, timeout (packets silently
+// dropped) or refused (actively rejected with a RST or ICMP error).  A Calico
+// Deny drops, so a denied flow should classify as timeout; refused instead
+// points at a missing listener or a rejecting dataplane.  The classification
+// of failures is by elapsed time — an attempt that burns the whole timeout
+// was dropped, one that fails quickly was rejected — which is the same signal
+// a user sees when debugging hang-vs-refuse symptoms.
+func ProbeConnectionOutcome(f *framework.Framework, pod *v1.Pod, host string, port int, timeout time.Duration) (string, error) {
+	timeoutSecs := int(timeout.Seconds())
+	if timeoutSecs < 1 {
+		timeoutSecs = 1
+	}
+	cmd := fmt.Sprintf(
+		"start=$(date +%%s); wget -q -T %d -t 1 -O /dev/null http://%s:%d; rc=$?; end=$(date +%%s); echo RC=$rc ELAPSED=$((end-start))",
+		timeoutSecs, host, port)
+	stdout, err := framework.RunHostCmd(pod.Namespace, pod.Name, cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to run probe in pod %s: %v", pod.Name, err)
+	}
+	var rc, elapsed int
+	if _, err := fmt.Sscanf(strings.TrimSpace(stdout), "RC=%d ELAPSED=%d", &rc, &elapsed); err != nil {
+		return "", fmt.Errorf("could not parse probe output %q: %v", stdout, err)
+	}
+	outcome := ProbeOutcomeRefused
+	if rc == 0 {
+		outcome = ProbeOutcomeConnected
+	} else if elapsed >= timeoutSecs {
+		outcome = ProbeOutcomeTimeout
+	}
+	framework.Logf("Probe from %s to %s:%d: rc=%d after %ds => %s", pod.Name, host, port, rc, elapsed, outcome)
+	return outcome, nil
+}
+
+// ConcurrentProbe opens concurrency simultaneous HTTP connections from the
+// given client pod to target and returns how many succeeded, together with
+// the distribution of first response lines keyed by body.  Against a service
+// whose backends serve distinct bodies the distribution shows which backends
+// were hit.  The fan-out runs as background shell jobs inside one exec, each
+// writing to its own file, so the attempts genuinely overlap and their
+// results can't interleave.
+func ConcurrentProbe(f *framework.Framework, pod *v1.Pod, target string, concurrency int) (int, map[string]int, error) {
+	const failMarker = "__FAIL__"
+	cmd := fmt.Sprintf(
+		"dir=$(mktemp -d); i=0; while [ $i -lt %d ]; do wget -q -T 5 -t 1 -O $dir/$i http://%s & i=$((i+1)); done; wait; "+
+			"i=0; while [ $i -lt %d ]; do if [ -s $dir/$i ]; then head -1 $dir/$i; else echo %s; fi; i=$((i+1)); done; rm -rf $dir",
+		concurrency, target, concurrency, failMarker)
+	framework.Logf("Opening %d concurrent connections from pod %s to %s", concurrency, pod.Name, target)
+	stdout, err := framework.RunHostCmd(pod.Namespace, pod.Name, cmd)
+	if err != nil {
+		return 0, nil, err
+	}
+	successes := 0
+	distribution := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == failMarker {
+			continue
+		}
+		successes++
+		distribution[line]++
+	}
+	return successes, distribution, nil
+}
+
+// Reachability is the outcome a namespace probe expects: whether the target
+// should be reachable from clients in that namespace.
+type Reachability bool
+
+const (
+	Reachable   Reachability = true
+	Unreachable Reachability = false
+)
+
+// ProbeFromNamespaces launches a probe client in each of the given namespaces
+// and probes target (a host:port serving HTTP) from all of them concurrently,
+// failing the test unless every namespace sees the result expected for it.
+// Both directions are given the same convergence window: namespaces expected
+// to be reachable retry until the first success, and namespaces expected to
+// be unreachable wait for the first failed probe and then must fail
+// consecutive probes, so callers can invoke this immediately after a policy
+// change without racing felix.
+func ProbeFromNamespaces(f *framework.Framework, namespaces []*v1.Namespace, target string, expected map[string]Reachability) {
+	type outcome struct {
+		ns  string
+		err error
+	}
+	results := make(chan outcome, len(namespaces))
+	for _, ns := range namespaces {
+		want, ok := expected[ns.Name]
+		if !ok {
+			framework.Failf("no expected reachability given for namespace %v", ns.Name)
+		}
+		// Pod creation calls Failf on error, so keep it out of the
+		// probe goroutines.
+		podName := framework.CreateExecPodOrFail(f.ClientSet, ns.Name, "nsprobe-", nil)
+		defer f.ClientSet.CoreV1().Pods(ns.Name).Delete(podName, metav1.NewDeleteOptions(0))
+		go func(ns, podName string, want Reachability) {
+			results <- outcome{ns, probeForExpectation(ns, podName, target, want)}
+		}(ns.Name, podName, want)
+	}
+	var failures []string
+	for range namespaces {
+		if r := <-results; r.err != nil {
+			failures = append(failures, fmt.Sprintf("namespace %v: %v", r.ns, r.err))
+		}
+	}
+	if len(failures) > 0 {
+		framework.Failf("probe expectations not met: %v", strings.Join(failures, "; "))
+	}
+}
+
+func probeForExpectation(ns, podName, target string, want Reachability) error {
+	probe := func() error {
+		_, err := framework.RunHostCmd(ns, podName,
+			fmt.Sprintf("wget -q -T 5 -t 1 -O /dev/null http://%s", target))
+		return err
+	}
+	if want == Reachable {
+		var lastErr error
+		if err := wait.PollImmediate(5*time.Second, 2*time.Minute, func() (bool, error) {
+			lastErr = probe()
+			return lastErr == nil, nil
+		}); err != nil {
+			return fmt.Errorf("expected %v to be reachable; last attempt: %v", target, lastErr)
+		}
+		return nil
+	}
+	if err := wait.PollImmediate(5*time.Second, 2*time.Minute, func() (bool, error) {
+		return probe() != nil, nil
+	}); err != nil {
+		return fmt.Errorf("expected %v to become unreachable but probes kept connecting", target)
+	}
+	// Require the failure to hold so one dropped packet is not mistaken
+	// for enforcement.
+	for i := 0; i < 2; i++ {
+		if probe() == nil {
+			return fmt.Errorf("expected %v to stay unreachable but a probe connected", target)
+		}
+	}
+	return nil
+}
+
+// CreateBusyboxPodOnNode launches a busybox pod in the framework's namespace
+// running the given shell command, waits for it to reach Running and returns
+// it with its status (and so its pod IP) populated.  An empty nodeName leaves
+// placement to the scheduler; otherwise the pod is pinned to that node, which
+// is how the cross-node tests put their client and server on opposite sides
+// of the overlay.
+func CreateBusyboxPodOnNode(f *framework.Framework, podName, nodeName, cmd string) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: podName,
+			Labels: map[string]string{
+				"pod-name": podName,
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName:     nodeName,
+			NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+			Containers: []v1.Container{
+				{
+					Name:  fmt.Sprintf("%s-container", podName),
+					Image: "busybox",
+					Args:  []string{"/bin/sh", "-c", cmd},
+				},
+			},
+		},
+	}
+	pod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(pod)
+	framework.ExpectNoError(err)
+	framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, pod))
+	pod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Get(pod.Name, metav1.GetOptions{})
+	framework.ExpectNoError(err)
+	return pod
+}
+
+// CreateSourceTrackingServerPod launches a pod serving HTTP on the given port
+// that logs every connection it accepts.  Unlike an echo server, which only
+// reports the current connection back to that client, the history accumulates
+// server-side, so tests can assert on the full set of sources seen across
+// many probes via GetObservedSources.  busybox httpd in verbose mode writes
+// one line per request naming the client address, which is all the tracking
+// needs.
+func CreateSourceTrackingServerPod(f *framework.Framework, podName string, port int) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: podName,
+			Labels: map[string]string{
+				"pod-name": podName,
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+			Containers: []v1.Container{
+				{
+					Name:  fmt.Sprintf("%s-container", podName),
+					Image: "busybox",
+					Args: []string{"/bin/sh", "-c",
+						fmt.Sprintf("mkdir -p /www && echo ok > /www/index.html && exec httpd -f -vv -p %d -h /www", port)},
+				},
+			},
+		},
+	}
+	pod, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(pod)
+	framework.ExpectNoError(err)
+	framework.ExpectNoError(framework.WaitForPodRunningInNamespace(f.ClientSet, pod))
+	pod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Get(pod.Name, metav1.GetOptions{})
+	framework.ExpectNoError(err)
+	return pod
+}
+
+// observedSourceRegexp pulls client IPv4 addresses out of the connection log
+// a source-tracking server pod writes.
+var observedSourceRegexp = regexp.MustCompile(`(?:\d{1,3}\.){3}\d{1,3}`)
+
+// GetObservedSources returns the distinct client IPs the given source-tracking
+// server pod has seen, in order of first appearance.  The history is parsed
+// from the server's own log, so it survives the connections themselves and
+// reflects the source addresses after any SNAT on the path.
+func GetObservedSources(f *framework.Framework, serverPod *v1.Pod) []string {
+	logs, err := framework.GetPodLogs(f.ClientSet, serverPod.Namespace, serverPod.Name, serverPod.Spec.Containers[0].Name)
+	framework.ExpectNoError(err)
+	seen := map[string]bool{}
+	sources := []string{}
+	for _, ip := range observedSourceRegexp.FindAllString(logs, -1) {
+		if ip == serverPod.Status.PodIP || seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		sources = append(sources, ip)
+	}
+	return sources
+}
+
+// WaitForServicesReady waits for all of the named services in the given
+// namespace to appear, sharing a single combined timeout across them.  If any
+// never show up it returns one aggregate error naming the missing services,
+// rather than failing on the first.
+func WaitForServicesReady(f *framework.Framework, namespace string, names []string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var notReady []string
+	for _, name := range names {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			notReady = append(notReady, name)
+			continue
+		}
+		if err := framework.WaitForService(f.ClientSet, namespace, name, true, framework.Poll, remaining); err != nil {
+			framework.Logf("Failed to see service %s/%s running: %v", namespace, name, err)
+			notReady = append(notReady, name)
+		}
+	}
+	if len(notReady) > 0 {
+		return fmt.Errorf("services not ready in namespace %s after %v: %s",
+			namespace, timeout, strings.Join(notReady, ", "))
+	}
+	return nil
+}
+
 func GetNewCalicoDropLogs(f *framework.Framework, node *v1.Node, since int64, logPfx string) (logs []string) {
 	pod, err := CreateLoggingPod(f, node)
 	defer func() {
@@ -437,6 +1166,45 @@ func GetNewCalicoDropLogs(f *framework.Framework, node *v1.Node, since int64, lo
 	return
 }
 
+// ApplyLogThenAction applies a GlobalNetworkPolicy with two ingress rules:
+// the first logs TCP traffic to the given port on endpoints matching the
+// selector, the second applies the given action (Allow or Deny) to the same
+// traffic.  It returns a function which fetches the new packet log lines on
+// the given node since the supplied syslog line count, so that callers can
+// verify the Log rule actually fired for their flow.
+//
+// The Log rule lines are emitted with a prefix unique to this invocation, so
+// that concurrent or back-to-back tests never pick up each other's syslog
+// lines.  Callers should defer ResetFelixLogPrefix alongside deleting the
+// policy.
+func ApplyLogThenAction(f *framework.Framework, ctl *Calicoctl, name, selector, action string, port int) func(node *v1.Node, since int64) []string {
+	logPrefix := GenerateRandomName(name)
+	ctl.SetFelixLogPrefix(logPrefix)
+	policyStr := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: %s
+spec:
+  order: 100
+  selector: %s
+  ingress:
+  - action: Log
+    protocol: TCP
+    destination:
+      ports: [%d]
+  - action: %s
+    protocol: TCP
+    destination:
+      ports: [%d]
+`,
+		name, selector, port, action, port)
+	ctl.Apply(policyStr)
+	return func(node *v1.Node, since int64) []string {
+		return GetNewCalicoDropLogs(f, node, since, logPrefix)
+	}
+}
+
 func CalicoctlExec(args ...string) {
 	cmd := exec.Command("calicoctl", args...)
 	runCommandExpectNoError(cmd)
@@ -451,6 +1219,7 @@ func CalicoctlGet(args ...string) string {
 func runCommandExpectNoError(cmd *exec.Cmd) string {
 	var stdout, stderr bytes.Buffer
 
+	cmd.Env = localCalicoctlEnv()
 	cmd.Stdout, cmd.Stderr = &stdout, &stderr
 
 	framework.Logf("Running '%s %s'", cmd.Path, strings.Join(cmd.Args, " "))
@@ -461,19 +1230,75 @@ func runCommandExpectNoError(cmd *exec.Cmd) string {
 	return stdout.String()
 }
 
-// Deprecated: Use containerized command: calicoctl.Apply().
+// DetectLocalDatastoreType infers the datastore type that the local calicoctl
+// binary is configured against, caching the result in DatastoreType ("kdd" or
+// "etcd").  The DATASTORE_TYPE environment variable takes precedence; failing
+// that we read /etc/calico/calicoctl.cfg.  This mirrors what
+// ConfigureCalicoctl does with the calico ConfigMap for the containerized
+// calicoctl.
+func DetectLocalDatastoreType() string {
+	if DatastoreType != "" {
+		return DatastoreType
+	}
+	if v := os.Getenv("DATASTORE_TYPE"); v != "" {
+		if strings.Contains(v, "kubernetes") {
+			DatastoreType = "kdd"
+		} else {
+			DatastoreType = "etcd"
+		}
+		framework.Logf("datastoreType = %v (from DATASTORE_TYPE)", DatastoreType)
+		return DatastoreType
+	}
+	b, err := ioutil.ReadFile("/etc/calico/calicoctl.cfg")
+	if err != nil {
+		framework.Logf("Unable to read /etc/calico/calicoctl.cfg, assuming etcd: %v", err)
+		DatastoreType = "etcd"
+		return DatastoreType
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.Contains(line, "datastoreType") {
+			if strings.Contains(line, "kubernetes") {
+				DatastoreType = "kdd"
+			}
+			if strings.Contains(line, "etcd") {
+				DatastoreType = "etcd"
+			}
+		}
+	}
+	framework.Logf("datastoreType = %v", DatastoreType)
+	Expect(DatastoreType).NotTo(Equal(""))
+	return DatastoreType
+}
+
+// localCalicoctlEnv returns the environment to use when shelling out to the
+// local calicoctl binary, with DATASTORE_TYPE set to match the detected
+// datastore so that the binary works on KDD clusters as well as etcd ones.
+func localCalicoctlEnv() []string {
+	env := os.Environ()
+	if DetectLocalDatastoreType() == "kdd" {
+		env = append(env, "DATASTORE_TYPE=kubernetes")
+	}
+	return env
+}
+
+// Deprecated: Use containerized command: calicoctl.Apply().  The containerized
+// Calicoctl detects the datastore from the calico ConfigMap and needs no local
+// binary or config file; these shell-out helpers remain only for callers that
+// haven't migrated yet.
 func CalicoctlApply(yaml string, args ...interface{}) {
 	cmd := exec.Command("calicoctl", "apply", "-f", "-")
 	calicoctlCmdWithFile(cmd, yaml, args...)
 }
 
-// Deprecated: Use containerized command: calicoctl.Create().
+// Deprecated: Use containerized command: calicoctl.Create().  See
+// CalicoctlApply for the migration path.
 func CalicoctlCreate(yaml string, args ...interface{}) {
 	cmd := exec.Command("calicoctl", "create", "-f", "-")
 	calicoctlCmdWithFile(cmd, yaml, args...)
 }
 
-// Deprecated: Use containerized command: calicoctl.Replace().
+// Deprecated: Use containerized command: calicoctl.Replace().  See
+// CalicoctlApply for the migration path.
 func CalicoctlReplace(yaml string, args ...interface{}) {
 	cmd := exec.Command("calicoctl", "replace", "-f", "-")
 	calicoctlCmdWithFile(cmd, yaml, args...)
@@ -482,6 +1307,7 @@ func CalicoctlReplace(yaml string, args ...interface{}) {
 func calicoctlCmdWithFile(cmd *exec.Cmd, yaml string, args ...interface{}) {
 	var stdout, stderr bytes.Buffer
 
+	cmd.Env = localCalicoctlEnv()
 	cmd.Stdout, cmd.Stderr = &stdout, &stderr
 	stdin, err := cmd.StdinPipe()
 	Expect(err).NotTo(HaveOccurred())
@@ -514,6 +1340,74 @@ func Calicoq(args ...string) (stdout string, stderr string, err error) {
 	return
 }
 
+// CalicoqEval runs `calicoq eval` for the given selector and returns the
+// endpoints calicoq reports as matching.  calicoq prints a header line
+// followed by one indented endpoint per line; only the indented lines are
+// returned, trimmed.
+func CalicoqEval(selector string) ([]string, error) {
+	stdout, stderr, err := Calicoq("eval", selector)
+	if err != nil {
+		return nil, fmt.Errorf("calicoq eval %q failed: %v (stderr: %s)", selector, err, stderr)
+	}
+	var endpoints []string
+	for _, line := range strings.Split(stdout, "\n") {
+		if !strings.HasPrefix(line, " ") {
+			continue
+		}
+		if trimmed := strings.TrimSpace(line); trimmed != "" {
+			endpoints = append(endpoints, trimmed)
+		}
+	}
+	return endpoints, nil
+}
+
+// GetEndpointPolicyTrace returns the ordered list of policies and profiles
+// felix will evaluate for the named workload endpoint on the given node, as
+// reported by calicoq.  calicoq prints one flush-left header per matching
+// endpoint followed by indented Policy/Profile lines in evaluation order;
+// only the block for the endpoint hosted on the given node is returned, so
+// tests can assert a policy is (or is no longer) part of an endpoint's
+// dataplane without decoding iptables chains.  wepName may be any substring
+// identifying the endpoint, typically the pod name.
+func GetEndpointPolicyTrace(f *framework.Framework, node *v1.Node, wepName string) (string, error) {
+	// Fail early with a clear error if calico is not actually running on
+	// the node the caller thinks hosts the endpoint.
+	if _, err := calicoNodePodOnNode(f, node.Name); err != nil {
+		return "", err
+	}
+	stdout, stderr, err := Calicoq("endpoint", wepName)
+	if err != nil {
+		return "", fmt.Errorf("calicoq endpoint %q failed: %v (stderr: %s)", wepName, err, stderr)
+	}
+	var trace []string
+	collecting := false
+	for _, line := range strings.Split(stdout, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			// A new endpoint block; collect it only if it is our
+			// endpoint on our node.  The query echo in calicoq's
+			// preamble mentions wepName but never the node name, so
+			// requiring both also skips the preamble.
+			collecting = strings.Contains(line, wepName) && strings.Contains(line, node.Name)
+			if collecting {
+				trace = append(trace, trimmed)
+			}
+			continue
+		}
+		if collecting {
+			trace = append(trace, line)
+		}
+	}
+	if len(trace) == 0 {
+		return "", fmt.Errorf("no policy trace for endpoint %q on node %v in calicoq output: %s",
+			wepName, node.Name, stdout)
+	}
+	return strings.Join(trace, "\n"), nil
+}
+
 func SetCalicoNodeEnvironment(clientset clientset.Interface, name string, value string) {
 	_setCalicoNodeEnvironment(clientset, name, value, false)
 }
@@ -913,6 +1807,56 @@ func GetCalicoConfigMapData(f *framework.Framework, cfgNames []string) (*map[str
 
 type CalicoctlOptions struct {
 	Image string
+	// Rules, when non-empty, replaces the broad default ClusterRole rules
+	// granted to the calicoctl service account, so tests can run calicoctl
+	// under reduced RBAC permissions.  Only meaningful on the kubernetes
+	// datastore; etcd tests do not go through RBAC.
+	Rules []rbacv1.PolicyRule
+}
+
+// NarrowCalicoctlRules returns a reduced set of ClusterRole rules for the
+// calicoctl pod: the Kubernetes resource access calicoctl always needs to
+// start up and resolve resources, plus access to only the given
+// crd.projectcalico.org resources with only the given verbs.  This documents
+// the minimum RBAC needed for a given calicoctl operation and is used with
+// CalicoctlOptions.Rules.
+func NarrowCalicoctlRules(crdResources, crdVerbs []string) []rbacv1.PolicyRule {
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{
+				"crd.projectcalico.org",
+			},
+			Resources: crdResources,
+			Verbs:     crdVerbs,
+		},
+		{
+			APIGroups: []string{
+				"",
+			},
+			Resources: []string{
+				"namespaces",
+				"serviceaccounts",
+				"nodes",
+			},
+			Verbs: []string{
+				"get",
+				"list",
+				"watch",
+			},
+		},
+		{
+			APIGroups: []string{
+				"",
+			},
+			Resources: []string{
+				"pods",
+			},
+			Verbs: []string{
+				"get",
+				"list",
+			},
+		},
+	}
 }
 
 type Calicoctl struct {
@@ -929,8 +1873,16 @@ type Calicoctl struct {
 	env             map[string]string
 	node            string
 	nodeToAvoid     string
+	// manifestConfigMap, when set, is mounted into the calicoctl pod at
+	// manifestMountPath so large resources can be applied from a file
+	// instead of a shell here-doc.
+	manifestConfigMap string
 }
 
+// manifestMountPath is where ApplyFromFile mounts its ConfigMap inside the
+// calicoctl pod.
+const manifestMountPath = "/e2e-manifests"
+
 func ConfigureCalicoctl(f *framework.Framework, opts ...CalicoctlOptions) *Calicoctl {
 	var ctl Calicoctl
 	ctl.env = make(map[string]string)
@@ -943,6 +1895,15 @@ func ConfigureCalicoctl(f *framework.Framework, opts ...CalicoctlOptions) *Calic
 	if len(opts) == 1 {
 		ctl.opts = opts[0]
 	}
+
+	// Fail fast with an actionable message if the calicoctl image can't be
+	// pulled, rather than deep inside the first job that tries to use it.
+	image := framework.TestContext.CalicoCtlImage
+	if ctl.opts.Image != "" {
+		image = ctl.opts.Image
+	}
+	verifyCalicoctlImage(f, image)
+
 	cfg, err := GetCalicoConfigMapData(f, []string{"calico-config", "canal-config", "tigera-aws-config"})
 	Expect(err).NotTo(HaveOccurred(), "Unable to get config map: %v", err)
 	if v, ok := (*cfg)["etcd_endpoints"]; ok {
@@ -1117,6 +2078,18 @@ func ConfigureCalicoctl(f *framework.Framework, opts ...CalicoctlOptions) *Calic
 			},
 		},
 	}
+	if len(ctl.opts.Rules) > 0 {
+		r.Rules = ctl.opts.Rules
+		rbeta.Rules = nil
+		for _, rule := range ctl.opts.Rules {
+			rbeta.Rules = append(rbeta.Rules, rbacv1beta1.PolicyRule{
+				APIGroups: rule.APIGroups,
+				Resources: rule.Resources,
+				Verbs:     rule.Verbs,
+			})
+		}
+	}
+
 	var rrbeta rbacv1beta1.ClusterRole
 
 	if framework.IsRBACEnabled(f) {
@@ -1230,6 +2203,50 @@ func (c *Calicoctl) GetAsMap(kind, name, namespace string) map[string]interface{
 	return m
 }
 
+// GetList returns the names of all resources of the given kind, restricted to
+// a namespace for namespaced kinds (pass "" for cluster-scoped kinds).
+func (c *Calicoctl) GetList(kind, namespace string) ([]string, error) {
+	args := []string{"get", kind, "-o", "json"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	out, err := c.execReturnError(DefaultCalicoctlBackoffLimit, args...)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s list: %v\nResponse: %s", kind, err, out)
+	}
+	names := []string{}
+	for _, item := range list.Items {
+		names = append(names, item.Metadata.Name)
+	}
+	return names, nil
+}
+
+// GetNamespaceProfile returns the Calico profile generated for the given
+// namespace (kns.<namespace>) as a map. Policies using namespaceSelectors
+// depend on this profile carrying the namespace's labels in labelsToApply.
+func (c *Calicoctl) GetNamespaceProfile(namespace string) (map[string]interface{}, error) {
+	name := fmt.Sprintf("kns.%s", namespace)
+	out, err := c.execReturnError(DefaultCalicoctlBackoffLimit, "get", "profile", name, "-o", "json", "--export")
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(out), &m); err != nil {
+		return nil, fmt.Errorf("error unmarshalling profile %s: %v\nResponse: %s", name, err, out)
+	}
+	return m, nil
+}
+
 // ApplyFromMap applies the resource as specificed in the map. The map will be
 // marshaled into JSON and applied using calicoctl.
 func (c *Calicoctl) ApplyFromMap(r map[string]interface{}, args ...string) {
@@ -1243,6 +2260,93 @@ func (c *Calicoctl) Apply(yaml string, args ...string) {
 	c.actionCtl(DefaultCalicoctlBackoffLimit, yaml, "apply", args...)
 }
 
+// ApplyGlobalNetworkSet creates or updates a GlobalNetworkSet with the given
+// labels and CIDRs.  Policies can match the set's addresses with a rule
+// selector on the labels, e.g. to model a threat feed as a deny list.
+func (c *Calicoctl) ApplyGlobalNetworkSet(name string, labels map[string]string, nets []string) {
+	labelLines := ""
+	for k, v := range labels {
+		labelLines += fmt.Sprintf("    %s: %q\n", k, v)
+	}
+	netLines := ""
+	for _, n := range nets {
+		netLines += fmt.Sprintf("  - %s\n", n)
+	}
+	yaml := fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkSet
+metadata:
+  name: %s
+  labels:
+%sspec:
+  nets:
+%s`,
+		name, labelLines, netLines)
+	c.Apply(yaml)
+}
+
+// ApplyTemplateFile reads a manifest from the calicoctl testing-manifests
+// directory, renders it as a go template with the supplied data, and applies
+// the result. This lets parameterized or multi-resource policies live in
+// manifest files rather than inline strings.
+func (c *Calicoctl) ApplyTemplateFile(file string, data interface{}, args ...string) {
+	c.Apply(ReadTestFileOrDie(file, data), args...)
+}
+
+// ApplyFromFile applies the given resource YAML from a file instead of the
+// shell here-doc that Apply uses.  The YAML is shipped to the calicoctl pod in
+// a ConfigMap and applied with -f, so it is not subject to the argv size
+// limits that very large payloads (e.g. network sets with thousands of CIDRs)
+// can hit on the here-doc path.
+func (c *Calicoctl) ApplyFromFile(resYaml string) error {
+	f := c.framework
+	name := GenerateRandomName("calicoctl-manifest")
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: f.Namespace.Name,
+		},
+		Data: map[string]string{
+			"resource.yaml": resYaml,
+		},
+	}
+	if _, err := f.ClientSet.CoreV1().ConfigMaps(f.Namespace.Name).Create(cm); err != nil {
+		return fmt.Errorf("failed to create manifest configmap: %v", err)
+	}
+	defer func() {
+		if err := f.ClientSet.CoreV1().ConfigMaps(f.Namespace.Name).Delete(name, &metav1.DeleteOptions{}); err != nil {
+			framework.Logf("unable to cleanup configmap %v: %v", name, err)
+		}
+	}()
+
+	c.manifestConfigMap = name
+	defer func() { c.manifestConfigMap = "" }()
+	_, err := c.executeCalicoctl(DefaultCalicoctlBackoffLimit,
+		"/calicoctl", "apply", "-f", manifestMountPath+"/resource.yaml")
+	return err
+}
+
+// ApplyAndMeasureEnforcement applies the given resource YAML (via the
+// file-based path, so bulk payloads such as large network sets work) and then
+// polls probe until it reports that the dataplane reflects the change,
+// returning how long that took.  The clock starts after the apply returns, so
+// the result approximates felix's programming latency from the datastore
+// commit rather than including the calicoctl job round trip.  If the probe
+// has not flipped within timeout the elapsed time is still returned alongside
+// the error so callers can report it.
+func (c *Calicoctl) ApplyAndMeasureEnforcement(resYaml string, probe func() bool, timeout time.Duration) (time.Duration, error) {
+	if err := c.ApplyFromFile(resYaml); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if err := wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		return probe(), nil
+	}); err != nil {
+		return time.Since(start), fmt.Errorf("dataplane did not reflect the applied change within %v", timeout)
+	}
+	return time.Since(start), nil
+}
+
 func (c *Calicoctl) ApplyWithError(yaml string, args ...string) error {
 	_, err := c.actionCtlWithError(DefaultCalicoctlBackoffLimit, yaml, "apply", args...)
 	return err
@@ -1305,6 +2409,179 @@ func (c *Calicoctl) DeleteGNP(policyName string) {
 	c.execExpectNoError(DefaultCalicoctlBackoffLimit, "delete", "globalnetworkpolicy", policyName)
 }
 
+func (c *Calicoctl) DeleteGNS(name string) {
+	c.execExpectNoError(DefaultCalicoctlBackoffLimit, "delete", "globalnetworkset", name)
+}
+
+func (c *Calicoctl) DeleteIPPool(name string) {
+	c.execExpectNoError(DefaultCalicoctlBackoffLimit, "delete", "ippool", name)
+}
+
+// FailsafePort is one entry of felix's failsafe host port lists.
+type FailsafePort struct {
+	Protocol string
+	Port     int
+}
+
+// DefaultFailsafeOutboundPorts mirrors felix's built-in outbound failsafe
+// list, so tests adding a port can keep the stock entries that protect the
+// cluster's control plane connections.
+var DefaultFailsafeOutboundPorts = []FailsafePort{
+	{"udp", 53},
+	{"udp", 67},
+	{"tcp", 179},
+	{"tcp", 2379},
+	{"tcp", 2380},
+	{"tcp", 5473},
+	{"tcp", 6666},
+	{"tcp", 6667},
+}
+
+// DefaultFailsafeInboundPorts mirrors felix's built-in inbound failsafe list.
+var DefaultFailsafeInboundPorts = []FailsafePort{
+	{"tcp", 22},
+	{"udp", 68},
+	{"tcp", 179},
+	{"tcp", 2379},
+	{"tcp", 2380},
+	{"tcp", 6666},
+	{"tcp", 6667},
+}
+
+// SetFailsafeOutboundHostPorts replaces failsafeOutboundHostPorts in the
+// default FelixConfiguration and returns a function restoring the original
+// value (removing the field again if it was unset, which returns felix to its
+// built-in defaults).
+func (c *Calicoctl) SetFailsafeOutboundHostPorts(ports []FailsafePort) func() {
+	return c.setFailsafePorts("failsafeOutboundHostPorts", ports)
+}
+
+// SetFailsafeInboundHostPorts is SetFailsafeOutboundHostPorts for the inbound
+// list.
+func (c *Calicoctl) SetFailsafeInboundHostPorts(ports []FailsafePort) func() {
+	return c.setFailsafePorts("failsafeInboundHostPorts", ports)
+}
+
+func (c *Calicoctl) setFailsafePorts(field string, ports []FailsafePort) func() {
+	fc := c.GetAsMap("felixconfiguration", "default", "")
+	spec, ok := fc["spec"].(map[string]interface{})
+	Expect(ok).To(BeTrue(), "default FelixConfiguration has no spec: %v", fc)
+	orig, hadOrig := spec[field]
+	entries := []interface{}{}
+	for _, p := range ports {
+		entries = append(entries, map[string]interface{}{
+			"protocol": p.Protocol,
+			"port":     p.Port,
+		})
+	}
+	spec[field] = entries
+	c.ApplyFromMap(fc)
+	return func() {
+		fc := c.GetAsMap("felixconfiguration", "default", "")
+		spec, ok := fc["spec"].(map[string]interface{})
+		Expect(ok).To(BeTrue(), "default FelixConfiguration has no spec: %v", fc)
+		if hadOrig {
+			spec[field] = orig
+		} else {
+			delete(spec, field)
+		}
+		c.ApplyFromMap(fc)
+	}
+}
+
+// GetIPPoolEncap returns the named IPPool's current ipipMode and vxlanMode,
+// normalizing unset fields to "Never".  Tests that only make sense on one
+// overlay transport (e.g. VXLAN port checks) use this to decide whether to
+// skip.
+func (c *Calicoctl) GetIPPoolEncap(name string) (string, string) {
+	pool := c.GetAsMap("ippool", name, "")
+	spec, ok := pool["spec"].(map[string]interface{})
+	Expect(ok).To(BeTrue(), "IPPool %v has no spec: %v", name, pool)
+	ipipMode, _ := spec["ipipMode"].(string)
+	vxlanMode, _ := spec["vxlanMode"].(string)
+	if ipipMode == "" {
+		ipipMode = "Never"
+	}
+	if vxlanMode == "" {
+		vxlanMode = "Never"
+	}
+	return ipipMode, vxlanMode
+}
+
+// SetIPPoolEncap patches the named IPPool's encapsulation modes ("Always",
+// "CrossSubnet" or "Never") and returns the previous ipipMode and vxlanMode so
+// callers can restore them.  Changing the encapsulation of a live pool
+// reprograms routes on every node; give the cluster time to reconverge before
+// asserting on connectivity.
+func (c *Calicoctl) SetIPPoolEncap(name, ipipMode, vxlanMode string) (string, string) {
+	pool := c.GetAsMap("ippool", name, "")
+	spec, ok := pool["spec"].(map[string]interface{})
+	Expect(ok).To(BeTrue(), "IPPool %v has no spec: %v", name, pool)
+	prevIPIP, _ := spec["ipipMode"].(string)
+	prevVXLAN, _ := spec["vxlanMode"].(string)
+	if prevIPIP == "" {
+		prevIPIP = "Never"
+	}
+	if prevVXLAN == "" {
+		prevVXLAN = "Never"
+	}
+	spec["ipipMode"] = ipipMode
+	spec["vxlanMode"] = vxlanMode
+	c.ApplyFromMap(pool)
+	return prevIPIP, prevVXLAN
+}
+
+// ApplyIPPool creates or updates an IPPool with the given CIDR.  Pods can be
+// allocated out of a specific pool with the cni.projectcalico.org/ipv4pools
+// annotation, which lets tests exercise cross-pool traffic and CIDR-scoped
+// policy without touching the cluster's default pool.
+func (c *Calicoctl) ApplyIPPool(name, cidr string) {
+	c.Apply(fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: IPPool
+metadata:
+  name: %s
+spec:
+  cidr: %s
+  ipipMode: Always
+  natOutgoing: true
+`, name, cidr))
+}
+
+// SetFelixLogPrefix sets the prefix felix puts on the iptables LOG lines
+// generated by policy Log rules.  Giving each test a unique prefix (see
+// GenerateRandomName) lets GetNewCalicoDropLogs filter out lines logged by
+// other tests running concurrently or back-to-back.
+func (c *Calicoctl) SetFelixLogPrefix(prefix string) {
+	c.Apply(c.felixConfigWithLogPrefix(prefix))
+}
+
+// ResetFelixLogPrefix reverts felix to its default log prefix.
+func (c *Calicoctl) ResetFelixLogPrefix() {
+	c.Apply(c.felixConfigWithLogPrefix(""))
+}
+
+// felixConfigWithLogPrefix returns the default felixconfiguration with any
+// logPrefix setting replaced by the given one, or removed if it is empty.
+func (c *Calicoctl) felixConfigWithLogPrefix(prefix string) string {
+	result, err := c.ExecReturnError("get", "felixconfiguration", "default", "-o", "yaml", "--export")
+	if err != nil {
+		framework.Failf("Error getting felixconfiguration: %s", result)
+	}
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(result), "\n") {
+		if strings.Contains(line, "logPrefix:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	res := strings.Join(lines, "\n")
+	if prefix != "" {
+		res += fmt.Sprintf("\n  logPrefix: %s", prefix)
+	}
+	return res
+}
+
 func (c *Calicoctl) DeleteNP(namespace, policyName string) {
 	c.execExpectNoError(DefaultCalicoctlBackoffLimit, "delete", "networkpolicy", "-n", namespace, policyName)
 }
@@ -1397,6 +2674,120 @@ spec:
 	c.Apply(license)
 }
 
+// calicoctlImageSecretName is the pull secret created from the
+// --calicoctl-docker-cfg file for pulling the calicoctl image.
+const calicoctlImageSecretName = "calicoctl-image-secret"
+
+// ensureCalicoctlPullSecret creates the calicoctl image pull secret in the
+// test namespace from framework.TestContext.CalicoCtlDockerCfg, if one is
+// configured, and returns its name ("" when no pull secret is needed).
+func ensureCalicoctlPullSecret(f *framework.Framework) string {
+	dockerCfgFile := framework.TestContext.CalicoCtlDockerCfg
+	if dockerCfgFile == "" {
+		return ""
+	}
+
+	dockerCfg, err := ioutil.ReadFile(dockerCfgFile)
+	if err != nil {
+		framework.Failf("unable to read CalicoCtlDockerCfg file %s: %v", dockerCfgFile, err)
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      calicoctlImageSecretName,
+			Namespace: f.Namespace.Name,
+		},
+		Type: v1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			v1.DockerConfigJsonKey: dockerCfg,
+		},
+	}
+	_, err = f.ClientSet.CoreV1().Secrets(f.Namespace.Name).Create(secret)
+	if err != nil && !kerr.IsAlreadyExists(err) {
+		framework.Failf("unable to create calicoctl secret %s in ns %s: %v", calicoctlImageSecretName, f.Namespace.Name, err)
+	}
+	framework.Logf("Image secret is loaded from %s", dockerCfgFile)
+	return calicoctlImageSecretName
+}
+
+// calicoctlImagesVerified records images that already passed the pre-flight
+// check, so each test run pays for at most one probe per image.
+var calicoctlImagesVerified = map[string]bool{}
+
+// VerifyCalicoctlImage checks that the configured calicoctl image can be
+// pulled, by running a trivial "calicoctl version" pod.  An unpullable image
+// otherwise fails deep inside a batch Job with an opaque describe dump;
+// failing here instead names the image and the likely pull secret problem.
+// ConfigureCalicoctl runs this automatically.
+func VerifyCalicoctlImage(f *framework.Framework) {
+	verifyCalicoctlImage(f, framework.TestContext.CalicoCtlImage)
+}
+
+func verifyCalicoctlImage(f *framework.Framework, image string) {
+	if calicoctlImagesVerified[image] {
+		return
+	}
+
+	podName := GenerateRandomName("calicoctl-preflight")
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      podName,
+			Namespace: f.Namespace.Name,
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers: []v1.Container{
+				{
+					Name:    calicoctlContainerName,
+					Image:   image,
+					Command: []string{"/calicoctl"},
+					Args:    []string{"version"},
+				},
+			},
+			NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"},
+		},
+	}
+	if secretName := ensureCalicoctlPullSecret(f); secretName != "" {
+		pod.Spec.ImagePullSecrets = []v1.LocalObjectReference{
+			{
+				Name: secretName,
+			},
+		}
+	}
+	_, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(pod)
+	Expect(err).NotTo(HaveOccurred(), "unable to create calicoctl pre-flight pod")
+	defer f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(podName, deleteImmediately)
+
+	err = wait.PollImmediate(2*time.Second, 2*time.Minute, func() (bool, error) {
+		p, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).Get(podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, cs := range p.Status.ContainerStatuses {
+			// The pre-flight only cares that the image pulled and the
+			// container started; the exit status of "calicoctl version" with
+			// no datastore configured is irrelevant.
+			if cs.State.Running != nil || cs.State.Terminated != nil {
+				return true, nil
+			}
+			if w := cs.State.Waiting; w != nil &&
+				(w.Reason == "ImagePullBackOff" || w.Reason == "ErrImagePull") {
+				msg := fmt.Sprintf("calicoctl image %q cannot be pulled (%s: %s); "+
+					"check --calicoctl-image and, for a private registry, that "+
+					"--calicoctl-docker-cfg points at a valid pull secret",
+					image, w.Reason, w.Message)
+				if framework.TestContext.CalicoCtlDockerCfg == "" {
+					msg += " (no pull secret is configured)"
+				}
+				return false, errors.New(msg)
+			}
+		}
+		return false, nil
+	})
+	Expect(err).NotTo(HaveOccurred(), "calicoctl image pre-flight failed for %q", image)
+	calicoctlImagesVerified[image] = true
+}
+
 func (c *Calicoctl) executeCalicoctl(backoff int32, cmd string, args ...string) (string, error) {
 	framework.Logf("Bringing up calicoctl pod to run: %s %s.", cmd, args)
 
@@ -1468,35 +2859,12 @@ func (c *Calicoctl) executeCalicoctl(backoff int32, cmd string, args ...string)
 			},
 		},
 	}
-	dockerCfgFile := framework.TestContext.CalicoCtlDockerCfg
-	if dockerCfgFile != "" {
-		secretName := "calicoctl-image-secret"
+	if secretName := ensureCalicoctlPullSecret(f); secretName != "" {
 		job.Spec.Template.Spec.ImagePullSecrets = []v1.LocalObjectReference{
 			{
 				Name: secretName,
 			},
 		}
-
-		dockerCfg, err := ioutil.ReadFile(dockerCfgFile)
-		if err != nil {
-			framework.Failf("unable to read CalicoCtlDockerCfg file %s: %v", dockerCfg, err)
-		}
-
-		secret := &v1.Secret{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      secretName,
-				Namespace: f.Namespace.Name,
-			},
-			Type: v1.SecretTypeDockerConfigJson,
-			Data: map[string][]byte{
-				v1.DockerConfigJsonKey: dockerCfg,
-			},
-		}
-		_, err = f.ClientSet.CoreV1().Secrets(f.Namespace.Name).Create(secret)
-		if err != nil && !kerr.IsAlreadyExists(err) {
-			framework.Failf("unable to create calicoctl secret %s in ns %s: %v", secretName, f.Namespace.Name, err)
-		}
-		framework.Logf("Image secret is loaded from %s", dockerCfgFile)
 	}
 	if c.etcdCaFile != "" || c.etcdCertFile != "" || c.etcdKeyFile != "" {
 		framework.Logf("etcd is secured, adding certs to calicoctl pod")
@@ -1539,6 +2907,27 @@ func (c *Calicoctl) executeCalicoctl(backoff int32, cmd string, args ...string)
 		}
 	}
 
+	if c.manifestConfigMap != "" {
+		job.Spec.Template.Spec.Containers[0].VolumeMounts = append(
+			job.Spec.Template.Spec.Containers[0].VolumeMounts,
+			v1.VolumeMount{
+				Name:      "manifest-volume",
+				MountPath: manifestMountPath,
+			})
+		job.Spec.Template.Spec.Volumes = append(
+			job.Spec.Template.Spec.Volumes,
+			v1.Volume{
+				Name: "manifest-volume",
+				VolumeSource: v1.VolumeSource{
+					ConfigMap: &v1.ConfigMapVolumeSource{
+						LocalObjectReference: v1.LocalObjectReference{
+							Name: c.manifestConfigMap,
+						},
+					},
+				},
+			})
+	}
+
 	if c.node != "" {
 		framework.Logf("calicoctl will be running on node %s.", c.node)
 		job.Spec.Template.Spec.NodeName = c.node
@@ -1612,11 +3001,17 @@ func LogCalicoDiagsForNode(f *framework.Framework, nodeName string) error {
 	}
 	for _, calicoNodePod := range calicoNodePodList.Items {
 		if calicoNodePod.Spec.NodeName == nodeName {
+			// Dump the filtering rules from whichever backend felix is
+			// programming on this node.
+			ruleDumpCmd := "sudo iptables-save -c"
+			if backend, err := GetDataplaneBackend(f, nodeName); err == nil && backend == DataplaneNftables {
+				ruleDumpCmd = "nft -a list ruleset"
+			}
 			// Get some diags from the calico-node pod and log them out directly here.
 			for _, cmd := range []string{
 				"ip route",
 				"ipset save",
-				"sudo iptables-save -c",
+				ruleDumpCmd,
 				"/sbin/versions",
 			} {
 				out, err := framework.RunHostCmd("kube-system", calicoNodePod.Name, cmd)
@@ -1655,6 +3050,487 @@ func LogCalicoDiagsForNode(f *framework.Framework, nodeName string) error {
 	return nil
 }
 
+// PolicyAPIVersion identifies which calicoctl resource schema a policy
+// manifest should use: the flat v1 schema that calicoctl 1.x speaks, or the
+// projectcalico.org/v3 schema.
+type PolicyAPIVersion int
+
+const (
+	PolicyAPIV1 PolicyAPIVersion = iota
+	PolicyAPIV3
+)
+
+func (v PolicyAPIVersion) String() string {
+	if v == PolicyAPIV1 {
+		return "v1"
+	}
+	return "v3"
+}
+
+// DetectPolicyAPIVersion reports which policy schema the cluster's calicoctl
+// speaks, based on its reported client version: 1.x and 2.x clients use the
+// v1 schema, anything newer the v3 one.
+func DetectPolicyAPIVersion(ctl *Calicoctl) PolicyAPIVersion {
+	out := ctl.Exec("version")
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, "Version") {
+			continue
+		}
+		fields := strings.Fields(line)
+		version := strings.TrimPrefix(fields[len(fields)-1], "v")
+		if strings.HasPrefix(version, "1.") || strings.HasPrefix(version, "2.") {
+			return PolicyAPIV1
+		}
+		return PolicyAPIV3
+	}
+	framework.Logf("Could not find a version in calicoctl output %q, assuming v3", out)
+	return PolicyAPIV3
+}
+
+// RenderPolicy renders a selector policy with a single ingress rule in the
+// schema for the given API version: a v1 `policy` list document or a v3
+// GlobalNetworkPolicy.  The action is spelled per schema (lowercase for v1),
+// and sourceSelector, when non-empty, restricts the rule to matching sources.
+// Shared test logic can render for DetectPolicyAPIVersion's result instead of
+// duplicating manifests per version.
+func RenderPolicy(v PolicyAPIVersion, name string, order int, selector, action, sourceSelector string) string {
+	if v == PolicyAPIV1 {
+		rule := fmt.Sprintf("    - action: %s\n", strings.ToLower(action))
+		if sourceSelector != "" {
+			rule += fmt.Sprintf("      source:\n        selector: %s\n", sourceSelector)
+		}
+		return fmt.Sprintf(`
+- apiVersion: v1
+  kind: policy
+  metadata:
+    name: %s
+  spec:
+    order: %d
+    selector: %s
+    ingress:
+%s`,
+			name, order, selector, rule)
+	}
+	rule := fmt.Sprintf("  - action: %s\n", strings.Title(strings.ToLower(action)))
+	if sourceSelector != "" {
+		rule += fmt.Sprintf("    source:\n      selector: %s\n", sourceSelector)
+	}
+	return fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: %s
+spec:
+  order: %d
+  selector: %s
+  ingress:
+%s`,
+		name, order, selector, rule)
+}
+
+// DeleteRenderedPolicy removes a policy created from RenderPolicy output,
+// using the resource kind matching the schema it was rendered for.
+func DeleteRenderedPolicy(ctl *Calicoctl, v PolicyAPIVersion, name string) {
+	if v == PolicyAPIV1 {
+		ctl.Exec("delete", "policy", name)
+	} else {
+		ctl.DeleteGNP(name)
+	}
+}
+
+// GNPRule is one ingress rule for RenderGNPWithOrderedRules.  Zero-valued
+// fields are omitted from the rendered rule.  Action is passed through
+// unvalidated, so builds against datastores that know extra actions (e.g.
+// Reject) can use them; whether the apply succeeds is the caller's signal for
+// support.
+type GNPRule struct {
+	Action      string
+	Protocol    string
+	SrcSelector string
+	DstPorts    []int
+}
+
+// RenderGNPWithOrderedRules renders a GlobalNetworkPolicy whose ingress rules
+// appear exactly in the order given.  Within one policy felix evaluates rules
+// first-match-wins, so tests pinning that behavior need full control over
+// rule order.  Ingress is listed in types, so traffic matching no rule falls
+// through to a deny.
+func RenderGNPWithOrderedRules(name string, order int, selector string, ingress []GNPRule) string {
+	rules := ""
+	for _, r := range ingress {
+		rules += fmt.Sprintf("  - action: %s\n", r.Action)
+		if r.Protocol != "" {
+			rules += fmt.Sprintf("    protocol: %s\n", r.Protocol)
+		}
+		if r.SrcSelector != "" {
+			rules += fmt.Sprintf("    source:\n      selector: %s\n", r.SrcSelector)
+		}
+		if len(r.DstPorts) > 0 {
+			rules += "    destination:\n      ports:\n"
+			for _, p := range r.DstPorts {
+				rules += fmt.Sprintf("      - %d\n", p)
+			}
+		}
+	}
+	return fmt.Sprintf(`
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: %s
+spec:
+  order: %d
+  selector: %s
+  types:
+  - Ingress
+  ingress:
+%s`,
+		name, order, selector, rules)
+}
+
+// Dataplane backends that felix can program.
+const (
+	DataplaneIptables = "iptables"
+	DataplaneNftables = "nftables"
+)
+
+// calicoNodePodOnNode returns the name of the calico-node pod running on the
+// given node.
+func calicoNodePodOnNode(f *framework.Framework, nodeName string) (string, error) {
+	calicoNodePodList, err := f.ClientSet.CoreV1().Pods("kube-system").List(metav1.ListOptions{
+		LabelSelector: "k8s-app=calico-node",
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, calicoNodePod := range calicoNodePodList.Items {
+		if calicoNodePod.Spec.NodeName == nodeName {
+			return calicoNodePod.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no calico-node pod found on node %v", nodeName)
+}
+
+// GetDataplaneBackend reports which packet filtering backend felix is
+// programming on the given node, DataplaneIptables or DataplaneNftables.  It
+// inspects the node through the calico-node pod: calico tables in the native
+// nft ruleset mean the nftables dataplane; otherwise felix is writing
+// iptables rules (possibly via the iptables-nft shim).
+func GetDataplaneBackend(f *framework.Framework, nodeName string) (string, error) {
+	podName, err := calicoNodePodOnNode(f, nodeName)
+	if err != nil {
+		return "", err
+	}
+	out, err := framework.RunHostCmd("kube-system", podName,
+		"nft list tables 2>/dev/null | grep -c calico || true")
+	if err != nil {
+		// No usable nft binary: only the iptables dataplane is possible.
+		return DataplaneIptables, nil
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return "", fmt.Errorf("unexpected nft table count output %q: %v", out, err)
+	}
+	if count > 0 {
+		return DataplaneNftables, nil
+	}
+	return DataplaneIptables, nil
+}
+
+// GetPolicyRuleCounters returns the packet/byte counters for the calico
+// policy rules on the given node, read from whichever filtering backend is
+// active there.
+func GetPolicyRuleCounters(f *framework.Framework, nodeName string) (string, error) {
+	podName, err := calicoNodePodOnNode(f, nodeName)
+	if err != nil {
+		return "", err
+	}
+	backend, err := GetDataplaneBackend(f, nodeName)
+	if err != nil {
+		return "", err
+	}
+	var cmd string
+	if backend == DataplaneNftables {
+		cmd = "nft -a list ruleset | grep cali || true"
+	} else {
+		cmd = "sudo iptables-save -c | grep cali || true"
+	}
+	return framework.RunHostCmd("kube-system", podName, cmd)
+}
+
+// PauseFelix suspends the felix process on the given node with SIGSTOP.  The
+// dataplane keeps whatever rules felix has already programmed, but no further
+// policy updates reach the node until ResumeFelix is called.  Callers should
+// resume felix promptly: calico-node's liveness checks will eventually restart
+// the container if felix stays unresponsive.  An error here means felix could
+// not be safely paused (e.g. no calico-node pod or no felix process found) and
+// is normally grounds for a skip.
+func PauseFelix(f *framework.Framework, nodeName string) error {
+	return signalFelix(f, nodeName, "STOP")
+}
+
+// ResumeFelix resumes a felix previously suspended with PauseFelix.
+func ResumeFelix(f *framework.Framework, nodeName string) error {
+	return signalFelix(f, nodeName, "CONT")
+}
+
+func signalFelix(f *framework.Framework, nodeName, sig string) error {
+	podName, err := calicoNodePodOnNode(f, nodeName)
+	if err != nil {
+		return err
+	}
+	out, err := framework.RunHostCmd("kube-system", podName,
+		fmt.Sprintf("pid=$(pidof calico-felix) && kill -%s $pid && echo signalled $pid", sig))
+	if err != nil {
+		return fmt.Errorf("failed to send SIG%s to felix on node %v: %v", sig, nodeName, err)
+	}
+	framework.Logf("Sent SIG%s to felix on node %v: %s", sig, nodeName, strings.TrimSpace(out))
+	return nil
+}
+
+// felixParsedValueRegexp matches the lines felix logs while resolving its
+// configuration, e.g.
+//   Parsed value for FlowLogsFlushInterval: 5s (from environment variable)
+var felixParsedValueRegexp = regexp.MustCompile(`Parsed value for (\w+): (.*?) \(from ([^)]+)\)`)
+
+// GetEffectiveFelixConfig returns the configuration felix on the given node is
+// actually using, keyed by parameter name.  Felix logs every parameter it
+// resolves along with the source it came from, and environment variables take
+// precedence over the FelixConfiguration resource, so editing the resource
+// (e.g. via resetFelixConfig) does not necessarily change the running value.
+// Each parameter is logged again whenever felix reloads its configuration; the
+// most recent occurrence wins, so the result reflects the current state even
+// after the configuration has been changed mid-test.
+func GetEffectiveFelixConfig(f *framework.Framework, nodeName string) (map[string]string, error) {
+	podName, err := calicoNodePodOnNode(f, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := framework.GetPodLogs(f.ClientSet, "kube-system", podName, "calico-node")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get logs from pod %v: %v", podName, err)
+	}
+	config := map[string]string{}
+	for _, match := range felixParsedValueRegexp.FindAllStringSubmatch(logs, -1) {
+		config[match[1]] = match[2]
+	}
+	if len(config) == 0 {
+		return nil, fmt.Errorf("no parsed config values found in logs of pod %v; "+
+			"the felix startup logs may have rotated away", podName)
+	}
+	return config, nil
+}
+
+// CapturePackets runs tcpdump inside the calico-node pod on the given node for
+// the given duration and returns the raw pcap file contents. The filter is a
+// standard pcap filter expression; calico-node is host-networked, so capturing
+// on "any" sees all of the node's interfaces including tunnel devices.
+func CapturePackets(f *framework.Framework, nodeName, filter string, duration time.Duration) ([]byte, error) {
+	podName, err := calicoNodePodOnNode(f, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := framework.RunHostCmd("kube-system", podName, "command -v tcpdump"); err != nil {
+		return nil, fmt.Errorf("tcpdump is not available in pod %v: %v", podName, err)
+	}
+
+	seconds := int(duration.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	pcapFile := fmt.Sprintf("/tmp/%s.pcap", GenerateRandomName("capture"))
+	defer func() {
+		if _, err := framework.RunHostCmd("kube-system", podName, fmt.Sprintf("rm -f %s", pcapFile)); err != nil {
+			framework.Logf("Failed to remove %v from pod %v: %v", pcapFile, podName, err)
+		}
+	}()
+
+	// timeout terminates tcpdump with a non-zero status once the capture
+	// window is up; that's the expected way for the command to end.
+	captureCmd := fmt.Sprintf("timeout %d tcpdump -i any -U -w %s \"%s\" >/dev/null 2>&1 || true",
+		seconds, pcapFile, filter)
+	if _, err := framework.RunHostCmd("kube-system", podName, captureCmd); err != nil {
+		return nil, fmt.Errorf("failed to capture packets on pod %v: %v", podName, err)
+	}
+
+	// Pull the pcap out via base64 so the binary contents survive the exec
+	// stream.
+	encoded, err := framework.RunHostCmd("kube-system", podName, fmt.Sprintf("base64 %s", pcapFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v from pod %v: %v", pcapFile, podName, err)
+	}
+	return base64.StdEncoding.DecodeString(strings.Replace(encoded, "\n", "", -1))
+}
+
+// ParsePcap splits raw pcap file contents into the individual captured
+// packets, each starting at the link layer. It returns the pcap's link type
+// alongside the packets; only enough of the format is understood to support
+// assertions on CapturePackets output.
+func ParsePcap(data []byte) (linkType uint32, packets [][]byte, err error) {
+	const (
+		globalHeaderLen = 24
+		recordHeaderLen = 16
+	)
+	if len(data) < globalHeaderLen {
+		return 0, nil, fmt.Errorf("pcap too short: %d bytes", len(data))
+	}
+	var order binary.ByteOrder
+	switch magic := binary.BigEndian.Uint32(data[0:4]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.BigEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.LittleEndian
+	default:
+		return 0, nil, fmt.Errorf("unrecognized pcap magic 0x%x", magic)
+	}
+	linkType = order.Uint32(data[20:24])
+
+	for offset := globalHeaderLen; offset < len(data); {
+		if offset+recordHeaderLen > len(data) {
+			return 0, nil, fmt.Errorf("truncated pcap record header at offset %d", offset)
+		}
+		inclLen := int(order.Uint32(data[offset+8 : offset+12]))
+		offset += recordHeaderLen
+		if offset+inclLen > len(data) {
+			return 0, nil, fmt.Errorf("truncated pcap packet at offset %d", offset)
+		}
+		packets = append(packets, data[offset:offset+inclLen])
+		offset += inclLen
+	}
+	return linkType, packets, nil
+}
+
+// CountEncapsulatedPackets parses raw pcap contents and returns how many of
+// the captured packets are IPIP-encapsulated and how many are VXLAN-
+// encapsulated (UDP to port 4789). It understands the Linux cooked capture
+// framing produced by "tcpdump -i any" as well as plain Ethernet.
+func CountEncapsulatedPackets(data []byte) (ipip, vxlan int, err error) {
+	const (
+		linkTypeEthernet = 1
+		linkTypeLinuxSLL = 113
+		etherTypeIPv4    = 0x0800
+		protocolIPIP     = 4
+		protocolUDP      = 17
+		vxlanPort        = 4789
+	)
+	linkType, packets, err := ParsePcap(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, packet := range packets {
+		var etherType uint16
+		var ipStart int
+		switch linkType {
+		case linkTypeLinuxSLL:
+			if len(packet) < 16 {
+				continue
+			}
+			etherType = binary.BigEndian.Uint16(packet[14:16])
+			ipStart = 16
+		case linkTypeEthernet:
+			if len(packet) < 14 {
+				continue
+			}
+			etherType = binary.BigEndian.Uint16(packet[12:14])
+			ipStart = 14
+		default:
+			return 0, 0, fmt.Errorf("unsupported pcap link type %d", linkType)
+		}
+		if etherType != etherTypeIPv4 {
+			continue
+		}
+		ip := packet[ipStart:]
+		if len(ip) < 20 {
+			continue
+		}
+		headerLen := int(ip[0]&0x0f) * 4
+		switch ip[9] {
+		case protocolIPIP:
+			ipip++
+		case protocolUDP:
+			if len(ip) >= headerLen+4 && binary.BigEndian.Uint16(ip[headerLen+2:headerLen+4]) == vxlanPort {
+				vxlan++
+			}
+		}
+	}
+	return ipip, vxlan, nil
+}
+
+// CanSetToS reports whether the given pod's ping can set the IP ToS byte
+// (busybox ping cannot; iputils can, via -Q).  It is checked against loopback
+// so the answer does not depend on network policy, and a false return is
+// normally grounds for a skip.
+func CanSetToS(f *framework.Framework, pod *v1.Pod) bool {
+	_, err := framework.RunHostCmd(pod.Namespace, pod.Name, "ping -Q 4 -c 1 -W 1 127.0.0.1")
+	return err == nil
+}
+
+// ProbeWithToS sends count ICMP echo probes from the given pod to host with
+// the IP ToS byte set to tos.  Callers should gate on CanSetToS first; with
+// an image whose ping lacks -Q this fails on the flag, not the network.
+func ProbeWithToS(f *framework.Framework, pod *v1.Pod, host string, tos, count int) error {
+	_, err := framework.RunHostCmd(pod.Namespace, pod.Name,
+		fmt.Sprintf("ping -Q %d -c %d -W 2 %s", tos, count, host))
+	return err
+}
+
+// CountPacketsWithDSCP parses raw pcap contents and returns how many IPv4
+// packets from srcIP carry the given DSCP value in their ToS byte.  Like
+// CountEncapsulatedPackets it understands Linux cooked capture framing as
+// well as plain Ethernet; a capture on "any" sees the decapsulated packet on
+// the tunnel and workload interfaces, so matching on the pod's own source IP
+// checks the marking after it has crossed any encapsulation.
+func CountPacketsWithDSCP(data []byte, srcIP string, dscp int) (int, error) {
+	const (
+		linkTypeEthernet = 1
+		linkTypeLinuxSLL = 113
+		etherTypeIPv4    = 0x0800
+	)
+	src := net.ParseIP(srcIP).To4()
+	if src == nil {
+		return 0, fmt.Errorf("%q is not an IPv4 address", srcIP)
+	}
+	linkType, packets, err := ParsePcap(data)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, packet := range packets {
+		var etherType uint16
+		var ipStart int
+		switch linkType {
+		case linkTypeLinuxSLL:
+			if len(packet) < 16 {
+				continue
+			}
+			etherType = binary.BigEndian.Uint16(packet[14:16])
+			ipStart = 16
+		case linkTypeEthernet:
+			if len(packet) < 14 {
+				continue
+			}
+			etherType = binary.BigEndian.Uint16(packet[12:14])
+			ipStart = 14
+		default:
+			return 0, fmt.Errorf("unsupported pcap link type %d", linkType)
+		}
+		if etherType != etherTypeIPv4 {
+			continue
+		}
+		ip := packet[ipStart:]
+		if len(ip) < 20 {
+			continue
+		}
+		if !bytes.Equal(ip[12:16], src) {
+			continue
+		}
+		if int(ip[1]>>2) == dscp {
+			count++
+		}
+	}
+	return count, nil
+}
+
 func GetPodNow(f *framework.Framework, ns string, podName string) (*v1.Pod, error) {
 	podNow, err := f.ClientSet.CoreV1().Pods(ns).Get(podName, metav1.GetOptions{})
 	if err != nil {
@@ -1724,6 +3600,34 @@ func RunSSHCommand(cmd, host, user string, timeout time.Duration) (stdout, stder
 	return bout.String(), berr.String(), code, err
 }
 
+// SSHResult captures the outcome of a command run on a node over SSH.
+type SSHResult struct {
+	Stdout string
+	Stderr string
+	Code   int
+}
+
+// RunSSHCommandWithRetries runs the given command on host via SSH, retrying
+// transport-level SSH failures (e.g. connection resets while a node restarts)
+// up to retries times with the given interval between attempts.  A non-zero
+// exit code from the command itself is reported in the result, not retried.
+func RunSSHCommandWithRetries(cmd, host, user string, timeout time.Duration, retries int, interval time.Duration) (SSHResult, error) {
+	var result SSHResult
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			framework.Logf("Retrying SSH command %q on %s (attempt %d of %d)", cmd, host, attempt+1, retries+1)
+			time.Sleep(interval)
+		}
+		result.Stdout, result.Stderr, result.Code, err = RunSSHCommand(cmd, host, user, timeout)
+		if err == nil {
+			return result, nil
+		}
+		framework.Logf("SSH command %q on %s failed: %v", cmd, host, err)
+	}
+	return result, err
+}
+
 type Kubectl struct {
 }
 